@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultActivityType = "run"
+
+type metPoint struct {
+	speedKmh float64
+	met      float64
+}
+
+// ActivityType holds the per-sport rules: which MET table prices the
+// effort, what counts as plausible, and whether it counts towards
+// running leaderboards.
+type ActivityType struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Counts towards running leaderboards and records
+	Running bool `json:"running"`
+	// Hill effort follows the running/walking cost curve (grade-adjusted pace)
+	OnFoot  bool `json:"on_foot"`
+	UsesGPS bool `json:"uses_gps"`
+	// "pace" (min/km) or "speed" (km/h)
+	PrimaryMetric       string  `json:"primary_metric"`
+	MaxDistanceKm       float64 `json:"max_distance_km"`
+	MinPaceSecondsPerKm int     `json:"min_pace_seconds_per_km"`
+
+	mets []metPoint
+}
+
+// METs by speed in km/h from the Compendium of Physical Activities (2011
+// update). Speeds in between are interpolated.
+var (
+	runningMETs = []metPoint{
+		{6.4, 6.0}, {8.0, 8.3}, {8.4, 9.0}, {9.7, 9.8}, {10.8, 10.5},
+		{11.3, 11.0}, {12.1, 11.5}, {12.9, 11.8}, {13.8, 12.3}, {14.5, 12.8},
+		{16.1, 14.5}, {17.7, 16.0}, {19.3, 19.0}, {20.9, 19.8}, {22.5, 23.0},
+	}
+	walkingMETs = []metPoint{
+		{3.2, 2.8}, {4.0, 3.0}, {4.8, 3.5}, {5.6, 4.3}, {6.4, 5.0}, {7.2, 7.0}, {8.0, 8.3},
+	}
+	cyclingMETs = []metPoint{
+		{10.0, 4.0}, {17.7, 6.8}, {20.9, 8.0}, {24.1, 10.0}, {28.2, 12.0}, {32.2, 15.8},
+	}
+)
+
+var activityTypes = []ActivityType{
+	{ID: "run", Name: "Run", Running: true, OnFoot: true, UsesGPS: true, PrimaryMetric: "pace",
+		MaxDistanceKm: 300, MinPaceSecondsPerKm: minPaceSecondsPerKm, mets: runningMETs},
+	{ID: "trail_run", Name: "Trail run", Running: true, OnFoot: true, UsesGPS: true, PrimaryMetric: "pace",
+		MaxDistanceKm: 300, MinPaceSecondsPerKm: minPaceSecondsPerKm, mets: runningMETs},
+	{ID: "treadmill", Name: "Treadmill", Running: true, OnFoot: true, UsesGPS: false, PrimaryMetric: "pace",
+		MaxDistanceKm: 100, MinPaceSecondsPerKm: minPaceSecondsPerKm, mets: runningMETs},
+	{ID: "track_workout", Name: "Track workout", Running: true, OnFoot: true, UsesGPS: true, PrimaryMetric: "pace",
+		MaxDistanceKm: 50, MinPaceSecondsPerKm: minPaceSecondsPerKm, mets: runningMETs},
+	{ID: "walk", Name: "Walk", OnFoot: true, UsesGPS: true, PrimaryMetric: "pace",
+		MaxDistanceKm: 150, MinPaceSecondsPerKm: 270, mets: walkingMETs},
+	{ID: "cycling", Name: "Cycling", UsesGPS: true, PrimaryMetric: "speed",
+		MaxDistanceKm: 1000, MinPaceSecondsPerKm: 40, mets: cyclingMETs},
+}
+
+// Sport names used by GPX <type>, TCX Sport and FIT session.sport
+var importSports = map[string]string{
+	"running":       "run",
+	"run":           "run",
+	"trail_running": "trail_run",
+	"trail running": "trail_run",
+	"treadmill":     "treadmill",
+	"track":         "track_workout",
+	"walking":       "walk",
+	"walk":          "walk",
+	"hiking":        "walk",
+	"cycling":       "cycling",
+	"biking":        "cycling",
+	"ride":          "cycling",
+}
+
+// lookupActivityType resolves an activity type ID; rows created before
+// activity types existed have none and are runs.
+func lookupActivityType(id string) (ActivityType, error) {
+	if id == "" {
+		id = defaultActivityType
+	}
+	for _, activity := range activityTypes {
+		if activity.ID == id {
+			return activity, nil
+		}
+	}
+	return ActivityType{}, fmt.Errorf("activity_type must be one of %s", strings.Join(activityTypeIDs(false), ", "))
+}
+
+// Helper function for stored rows, whose type was validated on the way in
+func storedActivityType(id string) ActivityType {
+	activity, err := lookupActivityType(id)
+	if err != nil {
+		activity, _ = lookupActivityType(defaultActivityType)
+	}
+	return activity
+}
+
+// Helper function to list activity type IDs, optionally only those that
+// count as running
+func activityTypeIDs(runningOnly bool) []string {
+	var ids []string
+	for _, activity := range activityTypes {
+		if !runningOnly || activity.Running {
+			ids = append(ids, activity.ID)
+		}
+	}
+	return ids
+}
+
+func isRunningActivity(id string) bool {
+	activity, err := lookupActivityType(id)
+	return err == nil && activity.Running
+}
+
+// parseActivityTypeFilter reads a comma-separated ?type= list; "running"
+// expands to every type that counts as running.
+func parseActivityTypeFilter(value string) ([]string, error) {
+	var types []string
+	for _, id := range strings.Split(value, ",") {
+		id = strings.TrimSpace(id)
+		switch {
+		case id == "":
+			continue
+		case id == "running":
+			types = append(types, activityTypeIDs(true)...)
+		default:
+			if _, err := lookupActivityType(id); err != nil {
+				return nil, err
+			}
+			types = append(types, id)
+		}
+	}
+	return types, nil
+}
+
+func activityTypeForSport(sport string) string {
+	if id, ok := importSports[strings.ToLower(strings.TrimSpace(sport))]; ok {
+		return id
+	}
+	return defaultActivityType
+}
+
+func (a ActivityType) met(speedKmh float64) float64 {
+	table := a.mets
+	if speedKmh <= table[0].speedKmh {
+		// Slower than the table covers: scale down, but never below light activity
+		return math.Max(2.0, table[0].met*speedKmh/table[0].speedKmh)
+	}
+	for i := 1; i < len(table); i++ {
+		if speedKmh <= table[i].speedKmh {
+			frac := (speedKmh - table[i-1].speedKmh) / (table[i].speedKmh - table[i-1].speedKmh)
+			return table[i-1].met + frac*(table[i].met-table[i-1].met)
+		}
+	}
+	return table[len(table)-1].met
+}
+
+// adjustSummary drops metrics that don't apply to the activity, e.g.
+// grade-adjusted pace, which models running and walking, for cycling.
+func (a ActivityType) adjustSummary(summary TrackSummary) TrackSummary {
+	if !a.OnFoot {
+		summary.GradeAdjustedPace = nil
+	}
+	return summary
+}
+
+// Helper function to set activity-specific columns on a run row
+func applyActivity(run map[string]interface{}, activity ActivityType, distanceKm float64, movingSeconds int) {
+	run["activity_type"] = activity.ID
+	run["avg_speed_kmh"] = avgSpeedKmh(distanceKm, movingSeconds)
+}
+
+// retypeRun sets the columns of a stored run that depend on its activity
+// type: the new type has its own plausibility limits and MET table, GAP
+// only applies on foot and only running types keep best efforts. It
+// reports whether the change moves the run in or out of personal records.
+func retypeRun(updateData map[string]interface{}, run *Run, activity ActivityType, body BodyMetrics) (bool, error) {
+	wasRunning := isRunningActivity(run.ActivityType)
+	retyped := *run
+	retyped.ActivityType = activity.ID
+	calories := runCalories(body, &retyped)
+	if err := validateRunMetrics(activity, run.DistanceKm, run.DurationSeconds, calories); err != nil {
+		return false, err
+	}
+
+	updateData["activity_type"] = activity.ID
+	updateData["calories_burned"] = calories
+	if !activity.OnFoot {
+		updateData["grade_adjusted_pace_seconds_per_km"] = nil
+	}
+	if !activity.Running {
+		updateData["best_efforts"] = nil
+	} else if run.BestEfforts == nil && run.RouteData.HasPoints() {
+		updateData["best_efforts"] = findBestEfforts(run.RouteData.Points)
+	}
+	return activity.Running != wasRunning, nil
+}
+
+// Helper function for the background work once a retyped run is saved
+func (s *Server) refreshRetypedRun(userID string, run *Run, activity ActivityType, recordsChanged bool) {
+	s.refreshUserStats(userID)
+	if recordsChanged {
+		s.rebuildPersonalRecords(userID)
+	}
+	s.rematchRunSegments(userID, run.ID, activity, run.RouteData)
+}
+
+func avgSpeedKmh(distanceKm float64, seconds int) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return math.Round(distanceKm/(float64(seconds)/3600)*100) / 100
+}
+
+// Activity type catalogue
+func (s *Server) getActivityTypes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"activity_types": activityTypes})
+}
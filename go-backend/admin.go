@@ -43,6 +43,11 @@ type UpdateRoleRequest struct {
 	Role string `json:"role" binding:"required,oneof=user editor admin"`
 }
 
+type VerifyUniversityRequest struct {
+	University string `json:"university" binding:"required,max=200"`
+	StudentID  string `json:"student_id" binding:"max=50"`
+}
+
 func (s *Server) getAllUsers(c *gin.Context) {
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
@@ -53,7 +58,7 @@ func (s *Server) getAllUsers(c *gin.Context) {
 
 	query := s.supabase.From("profiles").Select(`
 		id, email, full_name, avatar_url, university, student_id, phone, 
-		role, is_premium, premium_expires_at, created_at, updated_at
+		university_verified_at, role, is_premium, premium_expires_at, created_at, updated_at
 	`, "", false)
 
 	if search != "" {
@@ -130,6 +135,36 @@ func (s *Server) updateUserRole(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "User role updated successfully"})
 }
 
+// Sets a user's university after checking it (e.g. against their student
+// card); only verified universities grant access to university-only runs
+func (s *Server) verifyUserUniversity(c *gin.Context) {
+	userID := c.Param("id")
+
+	var req VerifyUniversityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	_, _, err := s.supabase.From("profiles").
+		Update(map[string]interface{}{
+			"university":             req.University,
+			"student_id":             req.StudentID,
+			"university_verified_at": now,
+			"updated_at":             now,
+		}, "", "").
+		Eq("id", userID).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify university"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "University verified successfully"})
+}
+
 func (s *Server) deleteUser(c *gin.Context) {
 	userID := c.Param("id")
 	currentUserID := c.GetString("user_id")
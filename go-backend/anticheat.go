@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Review states of a run. Only clear and approved runs count on
+// leaderboards; rows stored before scoring existed are treated as clear.
+const (
+	ReviewClear    = "clear"
+	ReviewFlagged  = "flagged"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+const (
+	// A jump this long at several times the activity's top speed is a
+	// teleport, not a fast stretch
+	teleportMinMeters    = 200.0
+	teleportSpeedFactor  = 3.0
+	maxTeleportScore     = 60
+	speedOutlierSeconds  = 60.0
+	speedOutlierFraction = 0.1
+	accelerationMinCount = 3
+	// Real cadence wanders by a few strides per minute even on a treadmill
+	// (cadence is counted per foot)
+	cadenceMinSamples = 120
+	cadenceMinStdDev  = 0.25
+	// Slack allowed between claimed and recorded times
+	timingToleranceSeconds = 120.0
+	timingToleranceRatio   = 0.1
+)
+
+type AntiCheatConfig struct {
+	// Runs scoring at least this much are held for review
+	FlagScore int
+	// Fixes with a worse accuracy radius are GPS noise and not scored
+	MaxAccuracyM float64
+	// Speed changes faster than this between fixes are implausible
+	MaxAccelerationMS2 float64
+}
+
+func loadAntiCheatConfig() AntiCheatConfig {
+	return AntiCheatConfig{
+		FlagScore:          envInt("ANTICHEAT_FLAG_SCORE", 50),
+		MaxAccuracyM:       envFloat("ANTICHEAT_MAX_ACCURACY_M", 30),
+		MaxAccelerationMS2: envFloat("ANTICHEAT_MAX_ACCELERATION_MS2", 6),
+	}
+}
+
+type SuspicionReason struct {
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+	Score  int    `json:"score"`
+}
+
+type SuspicionReport struct {
+	Score   int               `json:"score"`
+	Reasons []SuspicionReason `json:"reasons"`
+}
+
+func (r *SuspicionReport) add(code string, score int, format string, args ...interface{}) {
+	r.Reasons = append(r.Reasons, SuspicionReason{Code: code, Detail: fmt.Sprintf(format, args...), Score: score})
+	r.Score += score
+}
+
+// runTiming is what the client (or the session) says about when the run
+// happened, checked against the GPS timestamps. Zero fields are unknown.
+type runTiming struct {
+	DurationSeconds int
+	Start           time.Time
+	End             time.Time
+}
+
+type ReviewRunRequest struct {
+	Decision string `json:"decision" binding:"required,oneof=approve reject"`
+	Note     string `json:"note" binding:"max=1000"`
+}
+
+// scoreRun looks for the signs of a run that wasn't run: a motorbike ride
+// shows up as sustained speed and sharp accelerations, a spoofed track as
+// teleports, metronome-perfect cadence or timestamps that don't match the
+// claimed duration. Each sign adds to the score; none alone proves
+// anything, which is why high scores go to a person rather than being
+// rejected outright.
+func (cfg AntiCheatConfig) scoreRun(activity ActivityType, points []TrackPoint, timing runTiming) SuspicionReport {
+	report := SuspicionReport{Reasons: []SuspicionReason{}}
+
+	var fixes []TrackPoint
+	for _, p := range points {
+		if p.Accuracy == nil || cfg.MaxAccuracyM <= 0 || *p.Accuracy <= cfg.MaxAccuracyM {
+			fixes = append(fixes, p)
+		}
+	}
+	if len(fixes) < 2 {
+		return report
+	}
+
+	maxSpeed := 1000 / float64(activity.MinPaceSecondsPerKm)
+	span := fixes[len(fixes)-1].Timestamp.Sub(fixes[0].Timestamp).Seconds()
+
+	// Per-segment speeds; teleports are left out of the speed and
+	// acceleration checks so one glitch isn't counted three times
+	speeds := make([]float64, len(fixes)-1)
+	valid := make([]bool, len(fixes)-1)
+	teleports := 0
+	var fastSeconds float64
+	for i := 1; i < len(fixes); i++ {
+		a, b := fixes[i-1], fixes[i]
+		meters := haversineKm(a.Lat, a.Lng, b.Lat, b.Lng) * 1000
+		seconds := b.Timestamp.Sub(a.Timestamp).Seconds()
+		if seconds <= 0 {
+			if meters > teleportMinMeters {
+				teleports++
+			}
+			continue
+		}
+		speed := meters / seconds
+		if meters > teleportMinMeters && speed > teleportSpeedFactor*maxSpeed {
+			teleports++
+			continue
+		}
+		speeds[i-1] = speed
+		valid[i-1] = true
+		if speed > maxSpeed {
+			fastSeconds += seconds
+		}
+	}
+
+	if teleports > 0 {
+		score := 30 * teleports
+		if score > maxTeleportScore {
+			score = maxTeleportScore
+		}
+		report.add("teleport", score, "%d jump(s) of more than %.0f m between consecutive fixes", teleports, teleportMinMeters)
+	}
+
+	if fastSeconds >= speedOutlierSeconds || (span > 0 && fastSeconds/span >= speedOutlierFraction) {
+		report.add("speed", 50, "%.0f s faster than %.1f km/h, the limit for %s",
+			fastSeconds, maxSpeed*3.6, activity.Name)
+	}
+
+	accelerations := 0
+	for i := 1; i < len(speeds); i++ {
+		if !valid[i-1] || !valid[i] {
+			continue
+		}
+		dt := (fixes[i+1].Timestamp.Sub(fixes[i-1].Timestamp).Seconds()) / 2
+		if dt > 0 && math.Abs(speeds[i]-speeds[i-1])/dt > cfg.MaxAccelerationMS2 {
+			accelerations++
+		}
+	}
+	if accelerations >= accelerationMinCount {
+		report.add("acceleration", 25, "%d speed changes sharper than %.1f m/s²",
+			accelerations, cfg.MaxAccelerationMS2)
+	}
+
+	if activity.OnFoot {
+		var cadences []float64
+		for _, p := range fixes {
+			if p.Cadence != nil && *p.Cadence > 0 {
+				cadences = append(cadences, float64(*p.Cadence))
+			}
+		}
+		if len(cadences) >= cadenceMinSamples {
+			if deviation := stdDev(cadences); deviation < cadenceMinStdDev {
+				report.add("cadence", 40, "cadence varies by only %.2f strides/min over %d samples", deviation, len(cadences))
+			}
+		}
+	}
+
+	tolerance := math.Max(timingToleranceSeconds, timingToleranceRatio*span)
+	if timing.DurationSeconds > 0 && math.Abs(float64(timing.DurationSeconds)-span) > tolerance {
+		report.add("timing", 30, "claimed duration %d s but timestamps span %.0f s", timing.DurationSeconds, span)
+	} else if (!timing.Start.IsZero() && fixes[0].Timestamp.Before(timing.Start.Add(-timingToleranceSeconds*time.Second))) ||
+		(!timing.End.IsZero() && fixes[len(fixes)-1].Timestamp.After(timing.End.Add(timingToleranceSeconds*time.Second))) {
+		report.add("timing", 30, "timestamps fall outside the session (%s to %s)",
+			timing.Start.Format(time.RFC3339), timing.End.Format(time.RFC3339))
+	} else if fixes[len(fixes)-1].Timestamp.After(time.Now().Add(timingToleranceSeconds * time.Second)) {
+		report.add("timing", 30, "timestamps are in the future")
+	}
+
+	return report
+}
+
+func stdDev(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(squares / float64(len(values)))
+}
+
+// Helper function to score a new run and record the outcome on its row
+func (s *Server) applySuspicion(run map[string]interface{}, activity ActivityType, points []TrackPoint, timing runTiming) {
+	report := s.antiCheat.scoreRun(activity, points, timing)
+	run["suspicion_score"] = report.Score
+	run["suspicion_reasons"] = report.Reasons
+	run["review_status"] = ReviewClear
+	if report.Score >= s.antiCheat.FlagScore {
+		run["review_status"] = ReviewFlagged
+	}
+}
+
+// reviewCounts reports whether a run counts towards anything shared or
+// ranked: stats, records, leaderboards and the global heatmap. Flagged runs
+// wait for review; rejected ones never count.
+func reviewCounts(reviewStatus string) bool {
+	return reviewStatus == "" || reviewStatus == ReviewClear || reviewStatus == ReviewApproved
+}
+
+// Run review queue (Editor and Admin): flagged runs first by score
+func (s *Server) getRunReviewQueue(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	status := c.DefaultQuery("status", ReviewFlagged)
+
+	offset := (page - 1) * limit
+
+	if status != ReviewFlagged && status != ReviewApproved && status != ReviewRejected {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be flagged, approved or rejected"})
+		return
+	}
+
+	result, count, err := s.supabase.From("runs").
+		Select("id, user_id, title, activity_type, distance_km, duration_seconds, avg_pace_per_km, started_at, created_at, "+
+			"suspicion_score, suspicion_reasons, review_status, reviewed_by, reviewed_at, review_note, "+
+			"profiles!runs_user_id_fkey(full_name, email, university)", "exact", false).
+		Eq("review_status", status).
+		Order("suspicion_score", &map[string]interface{}{"ascending": false}).
+		Order("created_at", &map[string]interface{}{"ascending": true}).
+		Range(offset, offset+limit-1, "", false).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch runs for review"})
+		return
+	}
+
+	var runs []map[string]interface{}
+	if err := json.Unmarshal(result, &runs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse runs for review"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"runs": runs,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": count,
+			"pages": (int(count) + limit - 1) / limit,
+		},
+	})
+}
+
+// Approve a flagged run back onto the leaderboards, or reject it. A
+// decision can be revisited, but clear runs never enter the queue.
+func (s *Server) reviewRun(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req ReviewRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	run, err := s.getRunByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run not found"})
+		return
+	}
+	if run.ReviewStatus == "" || run.ReviewStatus == ReviewClear {
+		c.JSON(http.StatusConflict, gin.H{"error": "Run is not under review"})
+		return
+	}
+
+	status := ReviewApproved
+	if req.Decision == "reject" {
+		status = ReviewRejected
+	}
+
+	_, _, err = s.supabase.From("runs").
+		Update(map[string]interface{}{
+			"review_status": status,
+			"reviewed_by":   userID,
+			"reviewed_at":   time.Now().UTC(),
+			"review_note":   req.Note,
+		}, "", "").
+		Eq("id", run.ID).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to review run"})
+		return
+	}
+
+	// The decision moves the run into or out of the user's totals and records
+	go s.refreshUserStats(run.UserID)
+	go s.rebuildPersonalRecords(run.UserID)
+	s.heatmap.invalidate(run.UserID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Run " + status, "review_status": status})
+}
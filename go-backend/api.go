@@ -12,14 +12,59 @@ import (
 )
 
 type CreateRunRequest struct {
-	Title         string                 `json:"title" binding:"required"`
-	DistanceKm    float64                `json:"distance_km" binding:"required"`
-	DurationSeconds int                  `json:"duration_seconds" binding:"required"`
-	AvgPacePerKm  string                 `json:"avg_pace_per_km"`
-	CaloriesBurned int                   `json:"calories_burned"`
-	RouteData     map[string]interface{} `json:"route_data"`
-	StartLocation map[string]float64     `json:"start_location"`
-	EndLocation   map[string]float64     `json:"end_location"`
+	Title           string            `json:"title" binding:"required"`
+	DistanceKm      float64           `json:"distance_km"`
+	DurationSeconds int               `json:"duration_seconds"`
+	RouteData       *Track            `json:"route_data"`
+	StartLocation   *LatLng           `json:"start_location"`
+	EndLocation     *LatLng           `json:"end_location"`
+	HeartRateStream []HeartRateSample `json:"heart_rate_stream" binding:"omitempty,dive"`
+	ActivityType    string            `json:"activity_type"`
+	Visibility      *string           `json:"visibility" binding:"omitempty,oneof=private followers university public"`
+}
+
+type UpdateRunRequest struct {
+	Title           *string `json:"title" binding:"omitempty,min=1,max=200"`
+	Description     *string `json:"description" binding:"omitempty,max=5000"`
+	ActivityType    *string `json:"activity_type"`
+	PerceivedEffort *int    `json:"perceived_effort" binding:"omitempty,min=1,max=10"`
+	Visibility      *string `json:"visibility" binding:"omitempty,oneof=private followers university public"`
+}
+
+type Run struct {
+	ID                string             `json:"id"`
+	UserID            string             `json:"user_id"`
+	Title             string             `json:"title"`
+	Description       *string            `json:"description"`
+	ActivityType      string             `json:"activity_type"`
+	Visibility        string             `json:"visibility"`
+	Provenance        string             `json:"provenance"`
+	ExternalSource    *string            `json:"external_source"`
+	ExternalID        *string            `json:"external_id"`
+	PerceivedEffort   *int               `json:"perceived_effort"`
+	DistanceKm        float64            `json:"distance_km"`
+	DurationSeconds   int                `json:"duration_seconds"`
+	MovingSeconds     *int               `json:"moving_seconds"`
+	AvgPacePerKm      string             `json:"avg_pace_per_km"`
+	AvgPaceSeconds    *int               `json:"avg_pace_seconds_per_km"`
+	CaloriesBurned    int                `json:"calories_burned"`
+	ElevationGainM    *float64           `json:"elevation_gain_m"`
+	ElevationLossM    *float64           `json:"elevation_loss_m"`
+	GradeAdjustedPace *int               `json:"grade_adjusted_pace_seconds_per_km"`
+	ElevationSource   *string            `json:"elevation_source"`
+	AvgHeartRate      *int               `json:"avg_heart_rate"`
+	MaxHeartRate      *int               `json:"max_heart_rate"`
+	AvgCadence        *int               `json:"avg_cadence"`
+	RouteData         *Track             `json:"route_data"`
+	Splits            *RunSplits         `json:"splits"`
+	HRZones           *HeartRateAnalysis `json:"hr_zones"`
+	TrainingLoad      *float64           `json:"training_load"`
+	BestEfforts       []BestEffort       `json:"best_efforts"`
+	ReviewStatus      string             `json:"review_status"`
+	SuspicionScore    int                `json:"suspicion_score"`
+	SuspicionReasons  []SuspicionReason  `json:"suspicion_reasons"`
+	StartedAt         *time.Time         `json:"started_at"`
+	CreatedAt         time.Time          `json:"created_at"`
 }
 
 type CreateOrderRequest struct {
@@ -153,9 +198,20 @@ func (s *Server) getUserRuns(c *gin.Context) {
 
 	offset := (page - 1) * limit
 
-	result, count, err := s.supabase.From("runs").
+	types, err := parseActivityTypeFilter(c.Query("type"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := s.supabase.From("runs").
 		Select("*", "", false).
-		Eq("user_id", userID).
+		Eq("user_id", userID)
+	if len(types) > 0 {
+		query = query.In("activity_type", types)
+	}
+
+	result, count, err := query.
 		Order("created_at", &map[string]interface{}{"ascending": false}).
 		Range(offset, offset+limit-1, "", false).
 		Execute()
@@ -182,6 +238,157 @@ func (s *Server) getUserRuns(c *gin.Context) {
 	})
 }
 
+// Run detail with splits; ?unit=mi recomputes splits per mile from the
+// stored route.
+func (s *Server) getRunDetail(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	unit := c.DefaultQuery("unit", "km")
+	if unit != "km" && unit != "mi" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unit must be km or mi"})
+		return
+	}
+
+	viewer, err := s.currentViewer(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch run"})
+		return
+	}
+
+	run, err := s.getVisibleRun(viewer, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run not found"})
+		return
+	}
+
+	splits := run.Splits
+	if run.RouteData.HasPoints() && (splits == nil || unit != "km") {
+		track := run.RouteData
+		splits = &RunSplits{
+			Distance: computeSplits(track.Points, track.Pauses, unit),
+			Laps:     computeLaps(track.Points, track.Pauses, track.Laps),
+		}
+	}
+
+	// Splits above use the full route; other viewers get it trimmed
+	if err := s.redactRun(run, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch run"})
+		return
+	}
+
+	// Zone and training-load analysis is a premium feature
+	if !hasPremium(currentProfile(c)) {
+		run.HRZones = nil
+		run.TrainingLoad = nil
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"run":    run,
+		"splits": splits,
+	})
+}
+
+func (s *Server) updateRun(c *gin.Context) {
+	userID := c.GetString("user_id")
+	runID := c.Param("id")
+
+	var req UpdateRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	existing, err := s.getUserRun(runID, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run not found"})
+		return
+	}
+
+	updateData := map[string]interface{}{
+		"updated_at": time.Now().UTC(),
+	}
+	if req.Title != nil {
+		updateData["title"] = *req.Title
+	}
+	if req.Description != nil {
+		updateData["description"] = *req.Description
+	}
+	if req.PerceivedEffort != nil {
+		updateData["perceived_effort"] = *req.PerceivedEffort
+	}
+	if req.Visibility != nil {
+		updateData["visibility"] = *req.Visibility
+	}
+
+	var retyped *ActivityType
+	recordsChanged := false
+	if req.ActivityType != nil && *req.ActivityType != existing.ActivityType {
+		activity, err := lookupActivityType(*req.ActivityType)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		recordsChanged, err = retypeRun(updateData, existing, activity, bodyMetrics(currentProfile(c)))
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		retyped = &activity
+	}
+
+	_, _, err = s.supabase.From("runs").
+		Update(updateData, "", "").
+		Eq("id", runID).
+		Eq("user_id", userID).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update run"})
+		return
+	}
+
+	run, err := s.getUserRun(runID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch run"})
+		return
+	}
+
+	if retyped != nil {
+		go s.refreshRetypedRun(userID, existing, *retyped, recordsChanged)
+	} else {
+		go s.refreshUserStats(userID)
+	}
+
+	c.JSON(http.StatusOK, run)
+}
+
+func (s *Server) deleteRun(c *gin.Context) {
+	userID := c.GetString("user_id")
+	runID := c.Param("id")
+
+	if _, err := s.getUserRun(runID, userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run not found"})
+		return
+	}
+
+	if err := s.removeRun(runID, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete run"})
+		return
+	}
+
+	stats, err := s.recomputeUserStats(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Run deleted successfully",
+		"stats":   stats,
+	})
+}
+
 func (s *Server) createRun(c *gin.Context) {
 	userID := c.GetString("user_id")
 	
@@ -191,51 +398,198 @@ func (s *Server) createRun(c *gin.Context) {
 		return
 	}
 
+	now := time.Now().UTC()
 	run := map[string]interface{}{
 		"id":              uuid.New().String(),
 		"user_id":         userID,
 		"title":           req.Title,
-		"distance_km":     req.DistanceKm,
-		"duration_seconds": req.DurationSeconds,
-		"avg_pace_per_km": req.AvgPacePerKm,
-		"calories_burned": req.CaloriesBurned,
-		"route_data":      req.RouteData,
-		"created_at":      time.Now().UTC(),
+		"visibility":      runVisibility(req.Visibility, currentProfile(c)),
+		"started_at":      now,
+		"created_at":      now,
 	}
 
-	// Handle location data if provided
-	if req.StartLocation != nil {
-		if lat, ok := req.StartLocation["lat"]; ok {
-			if lng, ok := req.StartLocation["lng"]; ok {
-				run["start_location"] = fmt.Sprintf("(%f,%f)", lat, lng)
-			}
+	sortHeartRateSamples(req.HeartRateStream)
+
+	activity, err := lookupActivityType(req.ActivityType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.RouteData != nil {
+		if err := req.RouteData.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !activity.UsesGPS && req.RouteData.HasPoints() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": activity.Name + " activities cannot include a GPS route"})
+			return
+		}
+	}
+
+	// When a GPS track is present its metrics are authoritative and the
+	// client-supplied totals are ignored.
+	var track *Track
+	var efforts []BestEffort
+	if req.RouteData.HasPoints() {
+		mergeHeartRate(req.RouteData.Points, req.HeartRateStream)
+		processed := s.pipeline.Process(req.RouteData)
+		track = processed.Track()
+		summary := activity.adjustSummary(processed.Summary())
+		calories := summaryCalories(currentProfile(c), activity, summary)
+		if err := validateRunMetrics(activity, summary.DistanceKm, summary.DurationSeconds, calories); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		applyTrackSummary(run, summary)
+		applyActivity(run, activity, summary.DistanceKm, summary.MovingSeconds)
+		applyRunSplits(run, processed)
+		applyHeartRate(run, pointHeartRates(processed.Points), currentProfile(c))
+		efforts = applyBestEfforts(run, activity, processed.Points)
+		s.applySuspicion(run, activity, req.RouteData.Points, runTiming{DurationSeconds: req.DurationSeconds})
+		run["calories_burned"] = calories
+	} else {
+		calories := estimateCalories(bodyMetrics(currentProfile(c)), activity, req.DistanceKm, req.DurationSeconds, 1)
+		if err := validateRunMetrics(activity, req.DistanceKm, req.DurationSeconds, calories); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		applyActivity(run, activity, req.DistanceKm, req.DurationSeconds)
+		pace := paceSecondsPerKm(req.DistanceKm, req.DurationSeconds)
+		run["distance_km"] = req.DistanceKm
+		run["duration_seconds"] = req.DurationSeconds
+		run["avg_pace_seconds_per_km"] = pace
+		run["avg_pace_per_km"] = formatPace(pace)
+		run["calories_burned"] = calories
+
+		// Treadmill and indoor runs can still send a heart-rate strap stream
+		if len(req.HeartRateStream) > 0 {
+			run["avg_heart_rate"], run["max_heart_rate"] = summarizeHeartRate(req.HeartRateStream)
+			applyHeartRate(run, req.HeartRateStream, currentProfile(c))
 		}
 	}
 
-	if req.EndLocation != nil {
-		if lat, ok := req.EndLocation["lat"]; ok {
-			if lng, ok := req.EndLocation["lng"]; ok {
-				run["end_location"] = fmt.Sprintf("(%f,%f)", lat, lng)
+	// Handle location data if provided
+	if track.HasPoints() {
+		applyTrack(run, track)
+		run["provenance"] = ProvenanceGPSLive
+	} else {
+		// Without a track nothing was recorded, so this is a manual entry
+		run["provenance"] = ProvenanceManual
+		for column, location := range map[string]*LatLng{
+			"start_location": req.StartLocation,
+			"end_location":   req.EndLocation,
+		} {
+			if location == nil {
+				continue
+			}
+			if err := location.Validate(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": column + ": " + err.Error()})
+				return
 			}
+			run[column] = location.EWKT()
 		}
 	}
 
+	createdRun, err := s.saveRun(run)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create run"})
+		return
+	}
+	createdRun["new_records"] = s.detectPersonalRecords(userID, run, efforts)
+	createdRun["possible_duplicates"] = s.possibleDuplicates(userID, run["id"].(string))
+	if track.HasPoints() {
+		go s.matchRunSegments(userID, run["id"].(string), activity, track.Points)
+	}
+
+	c.JSON(http.StatusCreated, createdRun)
+}
+
+// Helper function to delete a run and everything derived from it except
+// the owner's stats, which callers refresh
+func (s *Server) removeRun(runID, userID string) error {
+	if err := s.deleteRunRow(runID, userID); err != nil {
+		return err
+	}
+
+	// The deleted run may have held a record the next best effort now takes
+	go s.rebuildPersonalRecords(userID)
+	return nil
+}
+
+// Helper function to delete a run without rebuilding the owner's records,
+// for callers that remove several runs and rebuild once at the end
+func (s *Server) deleteRunRow(runID, userID string) error {
+	// Detach the live session that produced the run, if any
+	_, _, err := s.supabase.From("run_sessions").
+		Update(map[string]interface{}{
+			"run_id":     nil,
+			"updated_at": time.Now().UTC(),
+		}, "", "").
+		Eq("run_id", runID).
+		Execute()
+
+	if err != nil {
+		return err
+	}
+
+	_, _, err = s.supabase.From("runs").
+		Delete("", "").
+		Eq("id", runID).
+		Eq("user_id", userID).
+		Execute()
+
+	if err != nil {
+		return err
+	}
+
+	s.heatmap.invalidate(userID)
+	return nil
+}
+
+// Helper function to insert a run row, refresh the owner's stats and
+// return the stored record
+func (s *Server) saveRun(run map[string]interface{}) (map[string]interface{}, error) {
 	result, _, err := s.supabase.From("runs").
 		Insert(run, false, "", "", "").
 		Execute()
 
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create run"})
-		return
+		return nil, err
 	}
 
 	var createdRun map[string]interface{}
 	if err := json.Unmarshal(result, &createdRun); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse created run"})
-		return
+		return nil, err
 	}
 
-	c.JSON(http.StatusCreated, createdRun)
+	if userID, ok := run["user_id"].(string); ok {
+		s.heatmap.invalidate(userID)
+		go s.refreshUserStats(userID)
+	}
+
+	return createdRun, nil
+}
+
+func (s *Server) getUserRun(runID, userID string) (*Run, error) {
+	var run Run
+
+	result, _, err := s.supabase.From("runs").
+		Select("*", "", false).
+		Eq("id", runID).
+		Eq("user_id", userID).
+		Single().
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(result, &run); err != nil {
+		return nil, err
+	}
+
+	return &run, nil
 }
 
 // Orders
@@ -248,6 +602,12 @@ func (s *Server) createOrder(c *gin.Context) {
 		return
 	}
 
+	// Event orders come from registering for the event
+	if req.ProductType == "event" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Register for the event to create its order"})
+		return
+	}
+
 	// Generate order number
 	orderNumber := fmt.Sprintf("VSM-%d-%s", time.Now().Unix(), uuid.New().String()[:8])
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/supabase-community/gotrue-go"
@@ -25,18 +26,46 @@ type RegisterRequest struct {
 }
 
 type Profile struct {
-	ID               string `json:"id"`
-	Email            string `json:"email"`
-	FullName         string `json:"full_name"`
-	AvatarURL        string `json:"avatar_url"`
-	University       string `json:"university"`
-	StudentID        string `json:"student_id"`
-	Phone            string `json:"phone"`
-	Role             string `json:"role"`
-	IsPremium        bool   `json:"is_premium"`
-	PremiumExpiresAt string `json:"premium_expires_at"`
-	CreatedAt        string `json:"created_at"`
-	UpdatedAt        string `json:"updated_at"`
+	ID               string   `json:"id"`
+	Email            string   `json:"email"`
+	FullName         string   `json:"full_name"`
+	AvatarURL        string   `json:"avatar_url"`
+	University       string   `json:"university"`
+	StudentID        string   `json:"student_id"`
+	Phone            string   `json:"phone"`
+	Role             string   `json:"role"`
+	IsPremium        bool     `json:"is_premium"`
+	PremiumExpiresAt string   `json:"premium_expires_at"`
+	MaxHeartRate     *int     `json:"max_heart_rate"`
+	RestingHeartRate *int     `json:"resting_heart_rate"`
+	WeightKg         *float64 `json:"weight_kg"`
+	HeightCm         *float64 `json:"height_cm"`
+	BirthDate        *string  `json:"birth_date"`
+	Sex              *string  `json:"sex"`
+	Timezone         *string  `json:"timezone"`
+	// Visibility for new runs: private, followers, university or public
+	DefaultRunVisibility *string `json:"default_run_visibility"`
+	// Set once an admin has checked the university; until then it doesn't
+	// unlock other students' university-only runs
+	UniversityVerifiedAt *string `json:"university_verified_at"`
+	CreatedAt            string  `json:"created_at"`
+	UpdatedAt            string  `json:"updated_at"`
+}
+
+// University and student ID aren't editable here: university visibility
+// trusts them, so only admins change them (see verifyUserUniversity)
+type UpdateProfileRequest struct {
+	FullName             *string  `json:"full_name" binding:"omitempty,min=1"`
+	AvatarURL            *string  `json:"avatar_url" binding:"omitempty,url"`
+	Phone                *string  `json:"phone"`
+	MaxHeartRate         *int     `json:"max_heart_rate" binding:"omitempty,min=100,max=230"`
+	RestingHeartRate     *int     `json:"resting_heart_rate" binding:"omitempty,min=25,max=120"`
+	WeightKg             *float64 `json:"weight_kg" binding:"omitempty,min=25,max=300"`
+	HeightCm             *float64 `json:"height_cm" binding:"omitempty,min=100,max=250"`
+	BirthDate            *string  `json:"birth_date" binding:"omitempty,datetime=2006-01-02"`
+	Sex                  *string  `json:"sex" binding:"omitempty,oneof=male female other"`
+	Timezone             *string  `json:"timezone" binding:"omitempty,max=64"`
+	DefaultRunVisibility *string  `json:"default_run_visibility" binding:"omitempty,oneof=private followers university public"`
 }
 
 func (s *Server) healthCheck(c *gin.Context) {
@@ -135,6 +164,88 @@ func (s *Server) getCurrentUser(c *gin.Context) {
 	c.JSON(http.StatusOK, profile)
 }
 
+func (s *Server) updateProfile(c *gin.Context) {
+	userID := c.GetString("user_id")
+	profile := currentProfile(c)
+
+	var req UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	maxHR, restingHR := heartRateSettings(profile)
+	if req.MaxHeartRate != nil {
+		maxHR = *req.MaxHeartRate
+	}
+	if req.RestingHeartRate != nil {
+		restingHR = *req.RestingHeartRate
+	}
+	if restingHR >= maxHR {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "resting_heart_rate must be below max_heart_rate"})
+		return
+	}
+
+	if req.Timezone != nil {
+		if _, err := time.LoadLocation(*req.Timezone); err != nil || *req.Timezone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "timezone must be an IANA name such as Asia/Ho_Chi_Minh"})
+			return
+		}
+	}
+
+	updateData := map[string]interface{}{
+		"updated_at": time.Now().UTC(),
+	}
+	for column, value := range map[string]*string{
+		"full_name":              req.FullName,
+		"avatar_url":             req.AvatarURL,
+		"phone":                  req.Phone,
+		"birth_date":             req.BirthDate,
+		"sex":                    req.Sex,
+		"timezone":               req.Timezone,
+		"default_run_visibility": req.DefaultRunVisibility,
+	} {
+		if value != nil {
+			updateData[column] = *value
+		}
+	}
+	if req.MaxHeartRate != nil {
+		updateData["max_heart_rate"] = *req.MaxHeartRate
+	}
+	if req.RestingHeartRate != nil {
+		updateData["resting_heart_rate"] = *req.RestingHeartRate
+	}
+	if req.WeightKg != nil {
+		updateData["weight_kg"] = *req.WeightKg
+	}
+	if req.HeightCm != nil {
+		updateData["height_cm"] = *req.HeightCm
+	}
+
+	_, _, err := s.supabase.From("profiles").
+		Update(updateData, "", "").
+		Eq("id", userID).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+
+	updated, err := s.getUserProfile(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user profile"})
+		return
+	}
+
+	// Stored calories depend on body metrics, so refresh run history
+	if req.WeightKg != nil || req.HeightCm != nil || req.BirthDate != nil || req.Sex != nil {
+		go s.recomputeUserCalories(userID)
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
 func (s *Server) getUserProfile(userID string) (*Profile, error) {
 	var profile Profile
 	
@@ -206,3 +317,33 @@ func (s *Server) requireRole(roles ...string) gin.HandlerFunc {
 		c.Abort()
 	}
 }
+
+// Middleware to restrict a route to users with an active premium subscription
+func (s *Server) requirePremium() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasPremium(currentProfile(c)) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Requires an active premium subscription"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Helper function to get the profile loaded by authMiddleware
+func currentProfile(c *gin.Context) *Profile {
+	profile, _ := c.Get("user_profile")
+	p, _ := profile.(*Profile)
+	return p
+}
+
+func hasPremium(profile *Profile) bool {
+	if profile == nil || !profile.IsPremium {
+		return false
+	}
+	if profile.PremiumExpiresAt == "" {
+		return true
+	}
+	expiresAt, err := time.Parse(time.RFC3339, profile.PremiumExpiresAt)
+	return err == nil && expiresAt.After(time.Now())
+}
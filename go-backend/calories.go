@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// Used when the profile has no weight
+	defaultWeightKg = 65.0
+	// Standard resting oxygen uptake that MET values are defined against
+	standardRestingVO2 = 3.5 // ml/kg/min
+	recomputePageSize  = 100
+)
+
+type BodyMetrics struct {
+	WeightKg float64
+	HeightCm *float64
+	Age      *int
+	Sex      string
+}
+
+// Helper function to read body metrics off a profile, falling back to a
+// default weight so calories are never zero for incomplete profiles.
+func bodyMetrics(profile *Profile) BodyMetrics {
+	body := BodyMetrics{WeightKg: defaultWeightKg}
+	if profile == nil {
+		return body
+	}
+	if profile.WeightKg != nil {
+		body.WeightKg = *profile.WeightKg
+	}
+	body.HeightCm = profile.HeightCm
+	if profile.Sex != nil {
+		body.Sex = *profile.Sex
+	}
+	if profile.BirthDate != nil {
+		if birth, err := time.Parse("2006-01-02", *profile.BirthDate); err == nil {
+			age := ageOn(birth, time.Now())
+			body.Age = &age
+		}
+	}
+	return body
+}
+
+// ageOn compares month and day rather than day of year, which shifts by
+// one after February in leap years
+func ageOn(birth, now time.Time) int {
+	age := now.Year() - birth.Year()
+	if now.Month() < birth.Month() || (now.Month() == birth.Month() && now.Day() < birth.Day()) {
+		age--
+	}
+	return age
+}
+
+// Energy from oxygen, roughly 5 kcal per litre of O2
+const kcalPerLitreO2 = 5.0
+
+// Helper function for the Mifflin-St Jeor BMR in kcal/day; false when the
+// profile lacks what it needs
+func (b BodyMetrics) bmr() (float64, bool) {
+	if b.HeightCm == nil || b.Age == nil || (b.Sex != "male" && b.Sex != "female") {
+		return 0, false
+	}
+	bmr := 10*b.WeightKg + 6.25**b.HeightCm - 5*float64(*b.Age)
+	if b.Sex == "male" {
+		bmr += 5
+	} else {
+		bmr -= 161
+	}
+	return bmr, true
+}
+
+// restingKcalPerKgHour is the user's own resting energy expenditure
+func (b BodyMetrics) restingKcalPerKgHour() float64 {
+	bmr, ok := b.bmr()
+	if !ok {
+		return standardRestingVO2 * 60 / 1000 * kcalPerLitreO2
+	}
+	return bmr / 24 / b.WeightKg
+}
+
+// estimateCalories uses the activity's MET for the average moving speed,
+// priced at the user's own resting rate from their BMR rather than the
+// standard 1.05 kcal/kg/h a plain MET implies, which overstates the
+// resting rate of heavier and older people. gradeFactor scales for the
+// extra (or reduced) cost of hills and is 1 on the flat.
+func estimateCalories(body BodyMetrics, activity ActivityType, distanceKm float64, movingSeconds int, gradeFactor float64) int {
+	if distanceKm <= 0 || movingSeconds <= 0 {
+		return 0
+	}
+	hours := float64(movingSeconds) / 3600
+	met := activity.met(distanceKm / hours)
+	if gradeFactor <= 0 {
+		gradeFactor = 1
+	}
+	return int(math.Round(met * body.restingKcalPerKgHour() * body.WeightKg * hours * gradeFactor))
+}
+
+// Helper function to derive the hill factor from flat and grade-adjusted pace
+func gradeFactor(paceSeconds int, gradeAdjustedPace *int) float64 {
+	if gradeAdjustedPace == nil || *gradeAdjustedPace <= 0 || paceSeconds <= 0 {
+		return 1
+	}
+	return float64(paceSeconds) / float64(*gradeAdjustedPace)
+}
+
+func summaryCalories(profile *Profile, activity ActivityType, summary TrackSummary) int {
+	return estimateCalories(bodyMetrics(profile), activity, summary.DistanceKm, summary.MovingSeconds,
+		gradeFactor(summary.PaceSecondsPerKm, summary.GradeAdjustedPace))
+}
+
+// runCalories re-prices a stored run, e.g. after a weight or activity
+// type change
+func runCalories(body BodyMetrics, run *Run) int {
+	activity := storedActivityType(run.ActivityType)
+
+	moving := run.DurationSeconds
+	if run.MovingSeconds != nil && *run.MovingSeconds > 0 {
+		moving = *run.MovingSeconds
+	}
+	pace := 0
+	if run.AvgPaceSeconds != nil {
+		pace = *run.AvgPaceSeconds
+	}
+	grade := 1.0
+	if activity.OnFoot {
+		grade = gradeFactor(pace, run.GradeAdjustedPace)
+	}
+	return estimateCalories(body, activity, run.DistanceKm, moving, grade)
+}
+
+// Helper function to recompute calories for every run of a user after
+// their body metrics change
+func (s *Server) recomputeUserCalories(userID string) {
+	profile, err := s.getUserProfile(userID)
+	if err != nil {
+		log.Printf("recompute calories for %s: %v", userID, err)
+		return
+	}
+	body := bodyMetrics(profile)
+
+	for offset := 0; ; offset += recomputePageSize {
+		result, _, err := s.supabase.From("runs").
+			Select("id, activity_type, distance_km, duration_seconds, moving_seconds, avg_pace_seconds_per_km, grade_adjusted_pace_seconds_per_km", "", false).
+			Eq("user_id", userID).
+			Order("created_at", &map[string]interface{}{"ascending": true}).
+			Range(offset, offset+recomputePageSize-1, "", false).
+			Execute()
+
+		if err != nil {
+			log.Printf("recompute calories for %s: %v", userID, err)
+			return
+		}
+
+		var runs []Run
+		if err := json.Unmarshal(result, &runs); err != nil {
+			log.Printf("recompute calories for %s: %v", userID, err)
+			return
+		}
+
+		for i := range runs {
+			run := &runs[i]
+			_, _, err := s.supabase.From("runs").
+				Update(map[string]interface{}{
+					"calories_burned": runCalories(body, run),
+				}, "", "").
+				Eq("id", run.ID).
+				Execute()
+
+			if err != nil {
+				log.Printf("recompute calories for run %s: %v", run.ID, err)
+			}
+		}
+
+		if len(runs) < recomputePageSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEstimateCaloriesUsesBodyMetrics(t *testing.T) {
+	run := storedActivityType("run")
+	met := run.met(10)
+	height := 175.0
+	age30, age60 := 30, 60
+
+	// 10 km in an hour, where weight cancels out of the Mifflin-St Jeor
+	// price and kcal is MET x BMR / 24
+	tests := []struct {
+		name string
+		body BodyMetrics
+		want float64
+	}{
+		{name: "incomplete profile uses 1.05 kcal/kg/h", body: BodyMetrics{WeightKg: 70}, want: met * 1.05 * 70},
+		{name: "male, 30", body: BodyMetrics{WeightKg: 70, HeightCm: &height, Age: &age30, Sex: "male"}, want: met * 1648.75 / 24},
+		{name: "female, 30", body: BodyMetrics{WeightKg: 70, HeightCm: &height, Age: &age30, Sex: "female"}, want: met * 1482.75 / 24},
+		{name: "male, 60", body: BodyMetrics{WeightKg: 70, HeightCm: &height, Age: &age60, Sex: "male"}, want: met * 1498.75 / 24},
+	}
+
+	seen := map[int]string{}
+	for _, tt := range tests {
+		got := estimateCalories(tt.body, run, 10, 3600, 1)
+		if got != int(math.Round(tt.want)) {
+			t.Errorf("%s: estimateCalories = %d, want %.0f", tt.name, got, tt.want)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("%s and %s both came to %d kcal", tt.name, other, got)
+		}
+		seen[got] = tt.name
+	}
+
+	flat := estimateCalories(BodyMetrics{WeightKg: 70}, run, 10, 3600, 1)
+	if hilly := estimateCalories(BodyMetrics{WeightKg: 70}, run, 10, 3600, 1.2); hilly != int(math.Round(float64(flat)*1.2)) {
+		t.Errorf("grade factor 1.2 gave %d kcal from %d on the flat", hilly, flat)
+	}
+	if got := estimateCalories(BodyMetrics{WeightKg: 70}, run, 0, 3600, 1); got != 0 {
+		t.Errorf("zero distance gave %d kcal", got)
+	}
+}
+
+func TestAgeOn(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	tests := []struct {
+		birth, now string
+		want       int
+	}{
+		{birth: "1990-06-15", now: "2024-06-14", want: 33},
+		{birth: "1990-06-15", now: "2024-06-15", want: 34},
+		// 1 March is day 61 of a leap year but day 60 of any other
+		{birth: "1992-03-01", now: "2023-03-01", want: 31},
+		{birth: "1992-03-01", now: "2023-02-28", want: 30},
+		{birth: "1990-03-01", now: "2024-02-29", want: 33},
+		{birth: "1992-12-31", now: "2023-12-31", want: 31},
+		{birth: "2000-02-29", now: "2023-02-28", want: 22},
+		{birth: "2000-02-29", now: "2023-03-01", want: 23},
+	}
+
+	for _, tt := range tests {
+		if got := ageOn(date(tt.birth), date(tt.now)); got != tt.want {
+			t.Errorf("ageOn(%s, %s) = %d, want %d", tt.birth, tt.now, got, tt.want)
+		}
+	}
+}
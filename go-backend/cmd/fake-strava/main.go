@@ -0,0 +1,419 @@
+// Command fake-strava serves the slice of the Strava API the backend's
+// sync connector uses, with in-memory athletes and activities, so the
+// OAuth, webhook and backfill flows can be exercised without a Strava
+// app. Point the backend at it with STRAVA_API_URL=http://localhost:8090.
+//
+// Besides the Strava endpoints it offers a few helpers that change data
+// and fire the webhook Strava would send:
+//
+//	POST   /fake/activities              {"name": "...", "sport_type": "Run", "minutes": 30}
+//	PUT    /fake/activities/{id}         {"name": "..."}
+//	DELETE /fake/activities/{id}
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type activity struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	SportType   string    `json:"sport_type"`
+	StartDate   time.Time `json:"start_date"`
+	ElapsedTime int       `json:"elapsed_time"`
+	MovingTime  int       `json:"moving_time"`
+	Distance    float64   `json:"distance"`
+	Manual      bool      `json:"manual"`
+
+	latlng    [][2]float64
+	offsets   []int
+	heartRate []int
+	cadence   []int
+}
+
+type fakeStrava struct {
+	mu          sync.Mutex
+	athleteID   int64
+	nextID      int64
+	activities  map[int64]*activity
+	tokens      map[string]time.Time
+	revoked     map[string]bool
+	callbackURL string
+}
+
+func main() {
+	addr := flag.String("addr", ":8090", "listen address")
+	athleteID := flag.Int64("athlete", 1001, "athlete ID returned by the token exchange")
+	flag.Parse()
+
+	fake := &fakeStrava{
+		athleteID:  *athleteID,
+		nextID:     9000,
+		activities: make(map[int64]*activity),
+		tokens:     make(map[string]time.Time),
+		revoked:    make(map[string]bool),
+	}
+	fake.seed()
+
+	log.Printf("fake Strava listening on %s (athlete %d)", *addr, fake.athleteID)
+	log.Fatal(http.ListenAndServe(*addr, fake.routes()))
+}
+
+func (f *fakeStrava) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/authorize", f.authorize)
+	mux.HandleFunc("/oauth/token", f.token)
+	mux.HandleFunc("/oauth/deauthorize", f.deauthorize)
+	mux.HandleFunc("/api/v3/athlete/activities", f.listActivities)
+	mux.HandleFunc("/api/v3/activities/", f.activity)
+	mux.HandleFunc("/api/v3/push_subscriptions", f.subscribe)
+	mux.HandleFunc("/fake/activities", f.createActivity)
+	mux.HandleFunc("/fake/activities/", f.changeActivity)
+	return mux
+}
+
+// Three activities over the last few days: an outdoor run with a GPS
+// track, a treadmill run without one and a swim the backend skips
+func (f *fakeStrava) seed() {
+	now := time.Now().UTC().Truncate(time.Second)
+	f.add("Morning Run", "Run", now.AddDate(0, 0, -3).Add(-2*time.Hour), 35*60, true)
+	f.add("Treadmill intervals", "VirtualRun", now.AddDate(0, 0, -2).Add(-3*time.Hour), 30*60, false)
+	f.add("Pool session", "Swim", now.AddDate(0, 0, -1).Add(-4*time.Hour), 45*60, false)
+}
+
+// add creates an activity; GPS ones follow a loop around Ho Chi Minh City
+// at about 5:20/km with a little noise in speed and cadence
+func (f *fakeStrava) add(name, sport string, start time.Time, seconds int, gps bool) *activity {
+	f.nextID++
+	a := &activity{
+		ID:          f.nextID,
+		Name:        name,
+		Type:        sport,
+		SportType:   sport,
+		StartDate:   start,
+		ElapsedTime: seconds,
+		MovingTime:  seconds,
+		Distance:    float64(seconds) * 3.1,
+	}
+	if gps {
+		const radiusM = 600.0
+		var travelled float64
+		for t := 0; t <= seconds; t += 2 {
+			speed := 3.1 + 0.25*math.Sin(float64(t)/45)
+			travelled += speed * 2
+			angle := travelled / radiusM
+			a.latlng = append(a.latlng, [2]float64{
+				10.7769 + radiusM*math.Sin(angle)/111195,
+				106.7009 + radiusM*(1-math.Cos(angle))/(111195*math.Cos(10.7769*math.Pi/180)),
+			})
+			a.offsets = append(a.offsets, t)
+			a.heartRate = append(a.heartRate, 145+int(10*math.Sin(float64(t)/120)))
+			a.cadence = append(a.cadence, 84+t%3)
+		}
+		a.Distance = travelled
+	}
+	f.activities[a.ID] = a
+	return a
+}
+
+func (f *fakeStrava) authorize(w http.ResponseWriter, r *http.Request) {
+	redirect, err := url.Parse(r.URL.Query().Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "redirect_uri is required", http.StatusBadRequest)
+		return
+	}
+	query := redirect.Query()
+	query.Set("code", "fake-code")
+	query.Set("state", r.URL.Query().Get("state"))
+	query.Set("scope", r.URL.Query().Get("scope"))
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (f *fakeStrava) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		if r.FormValue("code") == "" {
+			http.Error(w, `{"message":"Bad Request"}`, http.StatusBadRequest)
+			return
+		}
+	case "refresh_token":
+		refresh := r.FormValue("refresh_token")
+		f.mu.Lock()
+		revoked := f.revoked[refresh]
+		f.mu.Unlock()
+		if !strings.HasPrefix(refresh, "refresh-") || revoked {
+			http.Error(w, `{"message":"Bad Request"}`, http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, `{"message":"Bad Request"}`, http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	access := fmt.Sprintf("access-%d", f.nextID)
+	expires := time.Now().Add(6 * time.Hour)
+	f.tokens[access] = expires
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token_type":    "Bearer",
+		"access_token":  access,
+		"refresh_token": fmt.Sprintf("refresh-%d", f.nextID),
+		"expires_at":    expires.Unix(),
+		"athlete":       map[string]interface{}{"id": f.athleteID},
+	})
+}
+
+func (f *fakeStrava) deauthorize(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	access := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	delete(f.tokens, access)
+	// Tokens are issued in pairs, so this also revokes the refresh token
+	f.revoked["refresh-"+strings.TrimPrefix(access, "access-")] = true
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// Helper function to reject requests without a live access token
+func (f *fakeStrava) authorized(w http.ResponseWriter, r *http.Request) bool {
+	expires, ok := f.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	if !ok || time.Now().After(expires) {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"message": "Authorization Error"})
+		return false
+	}
+	return true
+}
+
+func (f *fakeStrava) listActivities(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.authorized(w, r) {
+		return
+	}
+
+	after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = 30
+	}
+
+	var matching []*activity
+	for _, a := range f.activities {
+		if a.StartDate.Unix() > after {
+			matching = append(matching, a)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].StartDate.Before(matching[j].StartDate)
+	})
+
+	start := (page - 1) * perPage
+	if start > len(matching) {
+		start = len(matching)
+	}
+	end := start + perPage
+	if end > len(matching) {
+		end = len(matching)
+	}
+	writeJSON(w, http.StatusOK, matching[start:end])
+}
+
+// GET /api/v3/activities/{id} and /api/v3/activities/{id}/streams
+func (f *fakeStrava) activity(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.authorized(w, r) {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v3/activities/"), "/")
+	id, _ := strconv.ParseInt(parts[0], 10, 64)
+	a, ok := f.activities[id]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "Record Not Found"})
+		return
+	}
+
+	if len(parts) == 1 {
+		writeJSON(w, http.StatusOK, a)
+		return
+	}
+	if parts[1] != "streams" {
+		http.NotFound(w, r)
+		return
+	}
+
+	streams := map[string]interface{}{}
+	if len(a.latlng) > 0 {
+		streams["latlng"] = map[string]interface{}{"data": a.latlng}
+		streams["time"] = map[string]interface{}{"data": a.offsets}
+		streams["heartrate"] = map[string]interface{}{"data": a.heartRate}
+		streams["cadence"] = map[string]interface{}{"data": a.cadence}
+	}
+	writeJSON(w, http.StatusOK, streams)
+}
+
+// Like Strava, validate the callback with a GET before accepting it
+func (f *fakeStrava) subscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	callback := r.FormValue("callback_url")
+	query := url.Values{
+		"hub.mode":         {"subscribe"},
+		"hub.challenge":    {"fake-challenge"},
+		"hub.verify_token": {r.FormValue("verify_token")},
+	}
+	resp, err := http.Get(callback + "?" + query.Encode())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "callback url not reachable: " + err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+
+	var echo map[string]string
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&echo) != nil || echo["hub.challenge"] != "fake-challenge" {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "callback url did not echo hub.challenge"})
+		return
+	}
+
+	f.mu.Lock()
+	f.callbackURL = callback
+	f.mu.Unlock()
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": 1})
+}
+
+func (f *fakeStrava) createActivity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name      string `json:"name"`
+		SportType string `json:"sport_type"`
+		Minutes   int    `json:"minutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.SportType == "" {
+		req.SportType = "Run"
+	}
+	if req.Minutes <= 0 {
+		req.Minutes = 30
+	}
+	if req.Name == "" {
+		req.Name = "Afternoon " + req.SportType
+	}
+
+	f.mu.Lock()
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Duration(req.Minutes) * time.Minute)
+	a := f.add(req.Name, req.SportType, start, req.Minutes*60, req.SportType != "VirtualRun")
+	f.mu.Unlock()
+
+	f.notify("activity", a.ID, "create", nil)
+	writeJSON(w, http.StatusCreated, a)
+}
+
+// PUT renames, DELETE removes; both notify the webhook
+func (f *fakeStrava) changeActivity(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/fake/activities/"), 10, 64)
+
+	f.mu.Lock()
+	a, ok := f.activities[id]
+	f.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		a.Name = req.Name
+		f.mu.Unlock()
+		f.notify("activity", id, "update", map[string]string{"title": req.Name})
+		writeJSON(w, http.StatusOK, a)
+	case http.MethodDelete:
+		f.mu.Lock()
+		delete(f.activities, id)
+		f.mu.Unlock()
+		f.notify("activity", id, "delete", nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// notify posts a webhook event to the subscribed callback, if any
+func (f *fakeStrava) notify(objectType string, objectID int64, aspect string, updates map[string]string) {
+	f.mu.Lock()
+	callback := f.callbackURL
+	f.mu.Unlock()
+	if callback == "" {
+		log.Printf("no subscription; %s %s %d not delivered", objectType, aspect, objectID)
+		return
+	}
+
+	if updates == nil {
+		updates = map[string]string{}
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"object_type":     objectType,
+		"object_id":       objectID,
+		"aspect_type":     aspect,
+		"owner_id":        f.athleteID,
+		"subscription_id": 1,
+		"event_time":      time.Now().Unix(),
+		"updates":         updates,
+	})
+	resp, err := http.Post(callback, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("webhook %s %s %d: %v", objectType, aspect, objectID, err)
+		return
+	}
+	resp.Body.Close()
+	log.Printf("webhook %s %s %d: %s", objectType, aspect, objectID, resp.Status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
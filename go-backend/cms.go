@@ -65,7 +65,7 @@ type SupportTicket struct {
 }
 
 type UpdateOrderRequest struct {
-	Status string `json:"status" binding:"required,oneof=pending paid failed refunded"`
+	Status string `json:"status" binding:"required,oneof=pending paid failed refund_pending refunded"`
 }
 
 type RespondToTicketRequest struct {
@@ -302,6 +302,9 @@ func (s *Server) updateOrderStatus(c *gin.Context) {
 		return
 	}
 
+	// Confirms or releases the event registration paid by this order, if any
+	go s.applyEventOrderStatus(orderID, req.Status)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Order status updated successfully"})
 }
 
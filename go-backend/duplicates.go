@@ -0,0 +1,496 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Two runs are duplicates when they overlap for at least this share of
+	// the shorter one...
+	duplicateMinOverlap = 0.5
+	// ...and, when both have routes, this share of each route lies within
+	// duplicateRouteToleranceM of the other
+	duplicateMinRouteSimilarity = 0.6
+	duplicateRouteToleranceM    = 50.0
+	duplicateRouteSamples       = 100
+)
+
+// Richer sources win ties when picking which copy to keep: a watch file
+// usually has better GPS and sensors than the phone
+var provenanceRank = map[string]int{
+	ProvenanceFileUpload: 3,
+	ProvenanceGPSLive:    2,
+	ProvenanceThirdParty: 1,
+	ProvenanceManual:     0,
+}
+
+type DuplicateRun struct {
+	ID              string     `json:"id"`
+	Title           string     `json:"title"`
+	ActivityType    string     `json:"activity_type"`
+	Provenance      string     `json:"provenance"`
+	DistanceKm      float64    `json:"distance_km"`
+	DurationSeconds int        `json:"duration_seconds"`
+	HasRoute        bool       `json:"has_route"`
+	HasHeartRate    bool       `json:"has_heart_rate"`
+	StartedAt       *time.Time `json:"started_at"`
+}
+
+type RunDuplicate struct {
+	Runs        [2]DuplicateRun `json:"runs"`
+	TimeOverlap float64         `json:"time_overlap"`
+	// Nil unless both runs have a route
+	RouteSimilarity *float64 `json:"route_similarity"`
+	SuggestedKeepID string   `json:"suggested_keep_id"`
+}
+
+type MergeRunsRequest struct {
+	RunIDs    []string `json:"run_ids" binding:"required,len=2"`
+	KeepRunID string   `json:"keep_run_id"`
+}
+
+type MergedRuns struct {
+	KeptRunID    string `json:"kept_run_id"`
+	RemovedRunID string `json:"removed_run_id"`
+}
+
+func runSpan(run Run) (time.Time, time.Time, bool) {
+	if run.StartedAt == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	return *run.StartedAt, run.StartedAt.Add(time.Duration(run.DurationSeconds) * time.Second), true
+}
+
+// timeOverlap is the overlap of two runs as a share of the shorter one
+func timeOverlap(a, b Run) float64 {
+	aStart, aEnd, ok := runSpan(a)
+	if !ok {
+		return 0
+	}
+	bStart, bEnd, ok := runSpan(b)
+	if !ok {
+		return 0
+	}
+
+	start, end := aStart, aEnd
+	if bStart.After(start) {
+		start = bStart
+	}
+	if bEnd.Before(end) {
+		end = bEnd
+	}
+	shorter := math.Min(aEnd.Sub(aStart).Seconds(), bEnd.Sub(bStart).Seconds())
+	if !end.After(start) || shorter <= 0 {
+		return 0
+	}
+	return end.Sub(start).Seconds() / shorter
+}
+
+// routeCoverage is the share of sampled points of a that lie within the
+// tolerance of b's line
+func routeCoverage(a, b []TrackPoint) float64 {
+	plane := newLocalPlane(LatLng{b[0].Lat, b[0].Lng})
+	line := make([][2]float64, len(b))
+	for i, p := range b {
+		line[i][0], line[i][1] = plane.xy(p.Lat, p.Lng)
+	}
+
+	step := int(math.Max(1, math.Ceil(float64(len(a))/duplicateRouteSamples)))
+	near, sampled := 0, 0
+	for i := 0; i < len(a); i += step {
+		x, y := plane.xy(a[i].Lat, a[i].Lng)
+		sampled++
+		for j := 1; j < len(line); j++ {
+			if _, d := projectOnto(x, y, line[j-1][0], line[j-1][1], line[j][0], line[j][1]); d <= duplicateRouteToleranceM {
+				near++
+				break
+			}
+		}
+	}
+	return float64(near) / float64(sampled)
+}
+
+// routeSimilarity is symmetric: a run that only covers half the other's
+// route isn't the same run
+func routeSimilarity(a, b []TrackPoint) float64 {
+	return math.Min(routeCoverage(a, b), routeCoverage(b, a))
+}
+
+// Helper function to decide whether two of a user's runs are the same
+// activity recorded twice
+func compareRuns(a, b Run) (*RunDuplicate, bool) {
+	overlap := timeOverlap(a, b)
+	if overlap < duplicateMinOverlap {
+		return nil, false
+	}
+
+	duplicate := &RunDuplicate{
+		Runs:        [2]DuplicateRun{duplicateRun(a), duplicateRun(b)},
+		TimeOverlap: math.Round(overlap*100) / 100,
+	}
+	if a.RouteData.HasPoints() && b.RouteData.HasPoints() {
+		similarity := routeSimilarity(a.RouteData.Points, b.RouteData.Points)
+		if similarity < duplicateMinRouteSimilarity {
+			return nil, false
+		}
+		similarity = math.Round(similarity*100) / 100
+		duplicate.RouteSimilarity = &similarity
+	}
+	duplicate.SuggestedKeepID = richerRun(a, b).ID
+	return duplicate, true
+}
+
+func duplicateRun(run Run) DuplicateRun {
+	return DuplicateRun{
+		ID:              run.ID,
+		Title:           run.Title,
+		ActivityType:    storedActivityType(run.ActivityType).ID,
+		Provenance:      run.Provenance,
+		DistanceKm:      run.DistanceKm,
+		DurationSeconds: run.DurationSeconds,
+		HasRoute:        run.RouteData.HasPoints(),
+		HasHeartRate:    run.AvgHeartRate != nil,
+		StartedAt:       run.StartedAt,
+	}
+}
+
+// richness scores how much a copy of a run records
+func richness(run Run) int {
+	score := 0
+	if run.RouteData.HasPoints() {
+		score += 8
+	}
+	if run.AvgHeartRate != nil {
+		score += 4
+	}
+	if run.AvgCadence != nil {
+		score += 2
+	}
+	if run.ElevationGainM != nil {
+		score++
+	}
+	return score
+}
+
+// richerRun picks the copy to keep: more data, then the better source,
+// then the denser track, then the earlier upload
+func richerRun(a, b Run) Run {
+	if ra, rb := richness(a), richness(b); ra != rb {
+		if ra > rb {
+			return a
+		}
+		return b
+	}
+	if pa, pb := provenanceRank[a.Provenance], provenanceRank[b.Provenance]; pa != pb {
+		if pa > pb {
+			return a
+		}
+		return b
+	}
+	var na, nb int
+	if a.RouteData != nil {
+		na = len(a.RouteData.Points)
+	}
+	if b.RouteData != nil {
+		nb = len(b.RouteData.Points)
+	}
+	if na != nb {
+		if na > nb {
+			return a
+		}
+		return b
+	}
+	if b.CreatedAt.Before(a.CreatedAt) {
+		return b
+	}
+	return a
+}
+
+// findDuplicates sweeps the user's runs in start order for pairs that
+// overlap in time, then loads just those runs' routes to compare them.
+func (s *Server) findDuplicates(userID string) ([]RunDuplicate, error) {
+	var spans []Run
+	for offset := 0; ; offset += recomputePageSize {
+		result, _, err := s.supabase.From("runs").
+			Select("id, started_at, duration_seconds", "", false).
+			Eq("user_id", userID).
+			Order("started_at", &map[string]interface{}{"ascending": true}).
+			Range(offset, offset+recomputePageSize-1, "", false).
+			Execute()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var page []Run
+		if err := json.Unmarshal(result, &page); err != nil {
+			return nil, err
+		}
+		for _, run := range page {
+			if run.StartedAt != nil {
+				spans = append(spans, run)
+			}
+		}
+
+		if len(page) < recomputePageSize {
+			break
+		}
+	}
+
+	var pairs [][2]string
+	candidates := make(map[string]bool)
+	for i, a := range spans {
+		_, aEnd, _ := runSpan(a)
+		for _, b := range spans[i+1:] {
+			if !b.StartedAt.Before(aEnd) {
+				break
+			}
+			if timeOverlap(a, b) >= duplicateMinOverlap {
+				pairs = append(pairs, [2]string{a.ID, b.ID})
+				candidates[a.ID] = true
+				candidates[b.ID] = true
+			}
+		}
+	}
+	if len(pairs) == 0 {
+		return []RunDuplicate{}, nil
+	}
+
+	ids := make([]string, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	runs := make(map[string]Run, len(ids))
+	for start := 0; start < len(ids); start += visibilityLookupChunk {
+		end := start + visibilityLookupChunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		result, _, err := s.supabase.From("runs").
+			Select("*", "", false).
+			Eq("user_id", userID).
+			In("id", ids[start:end]).
+			Execute()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var page []Run
+		if err := json.Unmarshal(result, &page); err != nil {
+			return nil, err
+		}
+		for _, run := range page {
+			runs[run.ID] = run
+		}
+	}
+
+	duplicates := []RunDuplicate{}
+	for _, pair := range pairs {
+		if duplicate, ok := compareRuns(runs[pair[0]], runs[pair[1]]); ok {
+			duplicates = append(duplicates, *duplicate)
+		}
+	}
+	return duplicates, nil
+}
+
+// Helper function to list runs a new run may duplicate, reported when it is
+// saved so the client can offer a merge straight away
+func (s *Server) possibleDuplicates(userID, runID string) []string {
+	run, err := s.getUserRun(runID, userID)
+	if err != nil {
+		return []string{}
+	}
+	start, end, ok := runSpan(*run)
+	if !ok {
+		return []string{}
+	}
+
+	overlapping, err := s.findOverlappingRuns(userID, start, end)
+	if err != nil {
+		log.Printf("find duplicates of run %s: %v", runID, err)
+		return []string{}
+	}
+
+	ids := []string{}
+	for _, other := range overlapping {
+		if other.ID == runID {
+			continue
+		}
+		if _, ok := compareRuns(*run, other); ok {
+			ids = append(ids, other.ID)
+		}
+	}
+	return ids
+}
+
+// mergeRuns keeps one copy and deletes the other, first carrying over the
+// notes the user only added to the copy being removed
+func (s *Server) mergeRuns(userID string, keep, remove Run) error {
+	updateData := map[string]interface{}{}
+	if keep.Description == nil && remove.Description != nil {
+		updateData["description"] = *remove.Description
+	}
+	if keep.PerceivedEffort == nil && remove.PerceivedEffort != nil {
+		updateData["perceived_effort"] = *remove.PerceivedEffort
+	}
+	if len(updateData) > 0 {
+		_, _, err := s.supabase.From("runs").
+			Update(updateData, "", "").
+			Eq("id", keep.ID).
+			Eq("user_id", userID).
+			Execute()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Callers rebuild personal records once they're done merging
+	return s.deleteRunRow(remove.ID, userID)
+}
+
+// Duplicate runs
+func (s *Server) getDuplicateRuns(c *gin.Context) {
+	duplicates, err := s.findDuplicates(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find duplicate runs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"duplicates": duplicates})
+}
+
+// Merge two copies of a run, keeping keep_run_id or, if omitted, the
+// richer one
+func (s *Server) mergeDuplicateRuns(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req MergeRunsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.RunIDs[0] == req.RunIDs[1] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "run_ids must name two different runs"})
+		return
+	}
+
+	var runs [2]Run
+	for i, id := range req.RunIDs {
+		run, err := s.getUserRun(id, userID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Run not found"})
+			return
+		}
+		runs[i] = *run
+	}
+
+	if _, ok := compareRuns(runs[0], runs[1]); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Runs are not duplicates of each other"})
+		return
+	}
+
+	keep, remove := runs[0], runs[1]
+	switch req.KeepRunID {
+	case "":
+		if richerRun(runs[0], runs[1]).ID == runs[1].ID {
+			keep, remove = runs[1], runs[0]
+		}
+	case runs[0].ID:
+	case runs[1].ID:
+		keep, remove = runs[1], runs[0]
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "keep_run_id must be one of run_ids"})
+		return
+	}
+
+	if err := s.mergeRuns(userID, keep, remove); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge runs"})
+		return
+	}
+	go s.rebuildPersonalRecords(userID)
+
+	stats, err := s.recomputeUserStats(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"merged": MergedRuns{KeptRunID: keep.ID, RemovedRunID: remove.ID},
+		"stats":  stats,
+	})
+}
+
+// Resolve every detected duplicate by keeping the richer copy
+func (s *Server) mergeAllDuplicateRuns(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	duplicates, err := s.findDuplicates(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find duplicate runs"})
+		return
+	}
+
+	// Stop after the first failure so the response says what was merged
+	removed := make(map[string]bool)
+	merged := []MergedRuns{}
+	var mergeErr error
+	sort.SliceStable(duplicates, func(i, j int) bool {
+		return duplicates[i].TimeOverlap > duplicates[j].TimeOverlap
+	})
+	for _, duplicate := range duplicates {
+		a, b := duplicate.Runs[0].ID, duplicate.Runs[1].ID
+		if removed[a] || removed[b] {
+			continue
+		}
+
+		keepID, removeID := a, b
+		if duplicate.SuggestedKeepID == b {
+			keepID, removeID = b, a
+		}
+		keep, err := s.getUserRun(keepID, userID)
+		if err != nil {
+			mergeErr = err
+			break
+		}
+		remove, err := s.getUserRun(removeID, userID)
+		if err != nil {
+			mergeErr = err
+			break
+		}
+		if err := s.mergeRuns(userID, *keep, *remove); err != nil {
+			mergeErr = err
+			break
+		}
+		removed[removeID] = true
+		merged = append(merged, MergedRuns{KeptRunID: keepID, RemovedRunID: removeID})
+	}
+	if len(merged) > 0 {
+		go s.rebuildPersonalRecords(userID)
+	}
+
+	stats, err := s.recomputeUserStats(userID)
+	if mergeErr != nil || err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":  fmt.Sprintf("Failed to merge runs after %d merges", len(merged)),
+			"merged": merged,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"merged": merged,
+		"stats":  stats,
+	})
+}
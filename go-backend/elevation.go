@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// Altitude must move this far from the last turning point before it
+	// counts as climb or descent, which filters out barometer/GPS noise.
+	elevationHysteresisM = 3.0
+	// Grades are measured over at least this much ground; point-to-point
+	// grades on a GPS track are mostly noise.
+	gradeWindowM = 50.0
+	// Minetti's cost curve is only fitted between -45% and +45%
+	maxGrade = 0.45
+	// Energy cost of running on the flat, J/kg/m (Minetti et al. 2002)
+	flatRunningCost = 3.6
+)
+
+// ElevationProvider looks up ground elevation for tracks recorded without
+// altitude. Implementations must be safe for concurrent use.
+type ElevationProvider interface {
+	Elevation(lat, lng float64) (float64, bool)
+}
+
+type ElevationStats struct {
+	GainM float64
+	LossM float64
+}
+
+// elevationChange totals ascent and descent, only counting a change once
+// altitude has moved elevationHysteresisM away from the last turning point.
+func elevationChange(altitudes []float64) ElevationStats {
+	var stats ElevationStats
+	if len(altitudes) == 0 {
+		return stats
+	}
+
+	ref := altitudes[0]
+	for _, alt := range altitudes[1:] {
+		diff := alt - ref
+		if diff >= elevationHysteresisM {
+			stats.GainM += diff
+			ref = alt
+		} else if diff <= -elevationHysteresisM {
+			stats.LossM -= diff
+			ref = alt
+		}
+	}
+	return stats
+}
+
+func trackAltitudes(points []TrackPoint) []float64 {
+	altitudes := make([]float64, 0, len(points))
+	for _, p := range points {
+		if p.Altitude != nil {
+			altitudes = append(altitudes, *p.Altitude)
+		}
+	}
+	return altitudes
+}
+
+// minettiCost is the metabolic cost of running at the given grade
+// relative to running on the flat.
+func minettiCost(grade float64) float64 {
+	g := math.Max(-maxGrade, math.Min(maxGrade, grade))
+	cost := 155.4*math.Pow(g, 5) - 30.4*math.Pow(g, 4) - 43.3*math.Pow(g, 3) + 46.3*g*g + 19.5*g + flatRunningCost
+	return cost / flatRunningCost
+}
+
+// gradeAdjustedDistanceKm is the flat distance that would have taken the
+// same effort as the track, or false if the track carries no altitude.
+func gradeAdjustedDistanceKm(points []TrackPoint) (float64, bool) {
+	var adjusted float64
+	var from int
+	var windowM float64
+	hasAltitude := false
+
+	flush := func(to int) {
+		if windowM <= 0 {
+			return
+		}
+		grade := 0.0
+		if points[from].Altitude != nil && points[to].Altitude != nil {
+			grade = (*points[to].Altitude - *points[from].Altitude) / windowM
+		}
+		adjusted += windowM * minettiCost(grade)
+	}
+
+	for i := 1; i < len(points); i++ {
+		if points[i].Altitude != nil {
+			hasAltitude = true
+		}
+		windowM += haversineKm(points[i-1].Lat, points[i-1].Lng, points[i].Lat, points[i].Lng) * 1000
+		if windowM >= gradeWindowM {
+			flush(i)
+			from, windowM = i, 0
+		}
+	}
+	flush(len(points) - 1)
+
+	return adjusted / 1000, hasAltitude
+}
+
+// Helper function to fill in altitude from the DEM when a track has none.
+// Tracks that already carry device altitude are left alone so barometric
+// and DEM readings are never mixed.
+func fillElevation(points []TrackPoint, provider ElevationProvider) bool {
+	if provider == nil || len(points) == 0 {
+		return false
+	}
+	for _, p := range points {
+		if p.Altitude != nil {
+			return false
+		}
+	}
+
+	filled := false
+	for i := range points {
+		if alt, ok := provider.Elevation(points[i].Lat, points[i].Lng); ok {
+			points[i].Altitude = &alt
+			filled = true
+		}
+	}
+	return filled
+}
+
+// SRTMProvider reads elevation from SRTM .hgt tiles (1 or 3 arc-second)
+// in a local directory, e.g. N11E108.hgt for Da Lat. Tiles are loaded on
+// first use and kept in memory.
+type SRTMProvider struct {
+	dir   string
+	mu    sync.Mutex
+	tiles map[string]*srtmTile
+}
+
+type srtmTile struct {
+	size    int
+	samples []int16
+}
+
+// SRTM marks missing samples with this value
+const srtmVoid = -32768
+
+func NewSRTMProvider(dir string) *SRTMProvider {
+	return &SRTMProvider{dir: dir, tiles: make(map[string]*srtmTile)}
+}
+
+func loadElevationProvider() ElevationProvider {
+	dir := envString("ELEVATION_DEM_DIR", "")
+	if dir == "" {
+		return nil
+	}
+	return NewSRTMProvider(dir)
+}
+
+func (p *SRTMProvider) Elevation(lat, lng float64) (float64, bool) {
+	baseLat, baseLng := math.Floor(lat), math.Floor(lng)
+	tile := p.tile(srtmTileName(int(baseLat), int(baseLng)))
+	if tile == nil {
+		return 0, false
+	}
+
+	// Rows run north to south, columns west to east
+	last := float64(tile.size - 1)
+	row := (1 - (lat - baseLat)) * last
+	col := (lng - baseLng) * last
+
+	r0, c0 := int(math.Floor(row)), int(math.Floor(col))
+	r1, c1 := min(r0+1, tile.size-1), min(c0+1, tile.size-1)
+	fr, fc := row-float64(r0), col-float64(c0)
+
+	var sum, weight float64
+	for _, s := range []struct {
+		r, c int
+		w    float64
+	}{
+		{r0, c0, (1 - fr) * (1 - fc)},
+		{r0, c1, (1 - fr) * fc},
+		{r1, c0, fr * (1 - fc)},
+		{r1, c1, fr * fc},
+	} {
+		v := tile.samples[s.r*tile.size+s.c]
+		if v == srtmVoid || s.w == 0 {
+			continue
+		}
+		sum += float64(v) * s.w
+		weight += s.w
+	}
+
+	if weight == 0 {
+		return 0, false
+	}
+	return sum / weight, true
+}
+
+func (p *SRTMProvider) tile(name string) *srtmTile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if tile, ok := p.tiles[name]; ok {
+		return tile
+	}
+
+	// A missing or unreadable tile is cached as nil so it isn't retried on
+	// every point.
+	tile, _ := readSRTMTile(filepath.Join(p.dir, name))
+	p.tiles[name] = tile
+	return tile
+}
+
+func readSRTMTile(path string) (*srtmTile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int
+	switch len(data) {
+	case 3601 * 3601 * 2:
+		size = 3601
+	case 1201 * 1201 * 2:
+		size = 1201
+	default:
+		return nil, fmt.Errorf("%s is not an SRTM tile", path)
+	}
+
+	samples := make([]int16, size*size)
+	for i := range samples {
+		samples[i] = int16(binary.BigEndian.Uint16(data[i*2:]))
+	}
+	return &srtmTile{size: size, samples: samples}, nil
+}
+
+func srtmTileName(lat, lng int) string {
+	ns, ew := 'N', 'E'
+	if lat < 0 {
+		ns, lat = 'S', -lat
+	}
+	if lng < 0 {
+		ew, lng = 'W', -lng
+	}
+	return fmt.Sprintf("%c%02d%c%03d.hgt", ns, lat, ew, lng)
+}
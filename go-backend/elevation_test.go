@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestElevationChange(t *testing.T) {
+	tests := []struct {
+		name      string
+		altitudes []float64
+		wantGain  float64
+		wantLoss  float64
+	}{
+		{name: "empty", altitudes: nil},
+		{name: "noise inside the hysteresis", altitudes: []float64{100, 102, 100, 102, 101, 99}},
+		{name: "climb, dip and climb", altitudes: []float64{100, 101, 102, 103, 101, 99, 98, 104}, wantGain: 8, wantLoss: 4},
+		{name: "steady descent", altitudes: []float64{50, 45, 40, 38, 30}, wantLoss: 20},
+	}
+
+	for _, tt := range tests {
+		got := elevationChange(tt.altitudes)
+		if math.Abs(got.GainM-tt.wantGain) > 1e-9 || math.Abs(got.LossM-tt.wantLoss) > 1e-9 {
+			t.Errorf("%s: gain/loss = %v/%v, want %v/%v", tt.name, got.GainM, got.LossM, tt.wantGain, tt.wantLoss)
+		}
+	}
+}
+
+func TestMinettiCost(t *testing.T) {
+	tests := []struct {
+		grade float64
+		want  float64
+	}{
+		{grade: 0, want: 1},
+		{grade: 0.1, want: 5.968214 / 3.6},
+		{grade: -0.1, want: 2.151706 / 3.6},
+		// Outside the fitted range the curve is clamped
+		{grade: 1, want: minettiCost(maxGrade)},
+		{grade: -1, want: minettiCost(-maxGrade)},
+	}
+
+	for _, tt := range tests {
+		if got := minettiCost(tt.grade); math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("minettiCost(%v) = %v, want %v", tt.grade, got, tt.want)
+		}
+	}
+
+	// Gentle downhill is the cheapest running there is
+	if minettiCost(-0.1) >= minettiCost(0) || minettiCost(-0.1) >= minettiCost(-0.4) {
+		t.Error("a 10% descent should cost less than the flat and a steep descent")
+	}
+}
+
+func TestGradeAdjustedDistance(t *testing.T) {
+	// 300 m at 3 m/s, at a constant altitude or climbing 10%
+	withAltitude := func(climbPerFix float64) []TrackPoint {
+		points := syntheticTrack(steady(3, 100)...)
+		for i := range points {
+			alt := 20 + float64(i)*climbPerFix
+			points[i].Altitude = &alt
+		}
+		return points
+	}
+
+	tests := []struct {
+		name   string
+		points []TrackPoint
+		wantKm float64
+		wantOK bool
+	}{
+		{name: "no altitude", points: syntheticTrack(steady(3, 100)...), wantKm: 0.3},
+		{name: "flat", points: withAltitude(0), wantKm: 0.3, wantOK: true},
+		{name: "10% climb", points: withAltitude(0.3), wantKm: 0.3 * minettiCost(0.1), wantOK: true},
+		{name: "10% descent", points: withAltitude(-0.3), wantKm: 0.3 * minettiCost(-0.1), wantOK: true},
+	}
+
+	for _, tt := range tests {
+		got, ok := gradeAdjustedDistanceKm(tt.points)
+		if ok != tt.wantOK || math.Abs(got-tt.wantKm) > 0.001 {
+			t.Errorf("%s: gradeAdjustedDistanceKm = %.4f, %v, want %.4f, %v", tt.name, got, ok, tt.wantKm, tt.wantOK)
+		}
+	}
+}
+
+func TestSRTMTileName(t *testing.T) {
+	tests := []struct {
+		lat, lng int
+		want     string
+	}{
+		{lat: 10, lng: 106, want: "N10E106.hgt"},
+		{lat: -34, lng: 151, want: "S34E151.hgt"},
+		{lat: 0, lng: -1, want: "N00W001.hgt"},
+	}
+
+	for _, tt := range tests {
+		if got := srtmTileName(tt.lat, tt.lng); got != tt.want {
+			t.Errorf("srtmTileName(%d, %d) = %q, want %q", tt.lat, tt.lng, got, tt.want)
+		}
+	}
+}
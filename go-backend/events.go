@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Event lifecycle. Upcoming, ongoing and completed follow the event's
+// dates; cancelled and archived are set by editors and never change again
+// on their own.
+const (
+	EventUpcoming  = "upcoming"
+	EventOngoing   = "ongoing"
+	EventCompleted = "completed"
+	EventCancelled = "cancelled"
+	EventArchived  = "archived"
+)
+
+var eventStatuses = []string{EventUpcoming, EventOngoing, EventCompleted, EventCancelled, EventArchived}
+
+type EventConfig struct {
+	// How often dated events are moved between upcoming, ongoing and completed
+	StatusInterval time.Duration
+	// How long a spot on a paid event is held while its order is unpaid.
+	// Payments are confirmed by hand in the CMS, so by default (0) holds
+	// last until an editor marks the order paid or failed.
+	PaymentHold time.Duration
+}
+
+func loadEventConfig() EventConfig {
+	return EventConfig{
+		StatusInterval: time.Duration(envInt("EVENT_STATUS_INTERVAL_SECONDS", 60)) * time.Second,
+		PaymentHold:    time.Duration(envInt("EVENT_PAYMENT_HOLD_MINUTES", 0)) * time.Minute,
+	}
+}
+
+// EventDistance is one of the categories an event offers, e.g. a 5K fun
+// run next to the half marathon
+type EventDistance struct {
+	ID         string  `json:"id" binding:"required,max=50"`
+	Label      string  `json:"label" binding:"required,max=100"`
+	DistanceKm float64 `json:"distance_km" binding:"required,gt=0"`
+}
+
+type Event struct {
+	ID                   string          `json:"id"`
+	Name                 string          `json:"name"`
+	Description          string          `json:"description"`
+	EventDate            time.Time       `json:"event_date"`
+	EndDate              time.Time       `json:"end_date"`
+	Location             string          `json:"location"`
+	Distances            []EventDistance `json:"distances"`
+	Capacity             int             `json:"capacity"`
+	Price                float64         `json:"price"`
+	Currency             string          `json:"currency"`
+	RegistrationOpensAt  *time.Time      `json:"registration_opens_at"`
+	RegistrationClosesAt *time.Time      `json:"registration_closes_at"`
+	CoverImage           string          `json:"cover_image"`
+	Status               string          `json:"status"`
+	CancellationReason   *string         `json:"cancellation_reason"`
+	CancelledAt          *time.Time      `json:"cancelled_at"`
+	CreatedBy            string          `json:"created_by"`
+	CreatedAt            time.Time       `json:"created_at"`
+	UpdatedAt            time.Time       `json:"updated_at"`
+}
+
+// A capacity of 0 means the event has no limit
+type CreateEventRequest struct {
+	Name                 string          `json:"name" binding:"required,min=1,max=200"`
+	Description          string          `json:"description" binding:"max=10000"`
+	EventDate            time.Time       `json:"event_date" binding:"required"`
+	EndDate              *time.Time      `json:"end_date"`
+	Location             string          `json:"location" binding:"required,max=300"`
+	Distances            []EventDistance `json:"distances" binding:"required,min=1,dive"`
+	Capacity             int             `json:"capacity" binding:"min=0"`
+	Price                float64         `json:"price" binding:"min=0"`
+	RegistrationOpensAt  *time.Time      `json:"registration_opens_at"`
+	RegistrationClosesAt *time.Time      `json:"registration_closes_at"`
+	CoverImage           string          `json:"cover_image" binding:"max=500"`
+}
+
+type UpdateEventRequest struct {
+	Name                 *string          `json:"name" binding:"omitempty,min=1,max=200"`
+	Description          *string          `json:"description" binding:"omitempty,max=10000"`
+	EventDate            *time.Time       `json:"event_date"`
+	EndDate              *time.Time       `json:"end_date"`
+	Location             *string          `json:"location" binding:"omitempty,max=300"`
+	Distances            *[]EventDistance `json:"distances" binding:"omitempty,min=1,dive"`
+	Capacity             *int             `json:"capacity" binding:"omitempty,min=0"`
+	Price                *float64         `json:"price" binding:"omitempty,min=0"`
+	RegistrationOpensAt  *time.Time       `json:"registration_opens_at"`
+	RegistrationClosesAt *time.Time       `json:"registration_closes_at"`
+	CoverImage           *string          `json:"cover_image" binding:"omitempty,max=500"`
+}
+
+type CancelEventRequest struct {
+	Reason string `json:"reason" binding:"required,min=1,max=1000"`
+}
+
+func isEventStatus(name string) bool {
+	for _, status := range eventStatuses {
+		if name == status {
+			return true
+		}
+	}
+	return false
+}
+
+// eventStatusFor is the status an event's dates put it in at now.
+// Cancelled and archived events keep their status.
+func eventStatusFor(event *Event, now time.Time) string {
+	switch {
+	case event.Status == EventCancelled || event.Status == EventArchived:
+		return event.Status
+	case !now.Before(event.EndDate):
+		return EventCompleted
+	case !now.Before(event.EventDate):
+		return EventOngoing
+	default:
+		return EventUpcoming
+	}
+}
+
+// Helper function to default an event without an end date to the end of
+// its start day, local time
+func defaultEventEnd(start time.Time) time.Time {
+	location, err := summaryLocation("", nil)
+	if err != nil {
+		location = time.UTC
+	}
+	y, m, d := start.In(location).Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, location).UTC()
+}
+
+func validateEvent(event *Event) error {
+	if !event.EndDate.After(event.EventDate) {
+		return errors.New("end_date must be after event_date")
+	}
+	opens, closes := event.RegistrationOpensAt, event.RegistrationClosesAt
+	if opens != nil && closes != nil && !closes.After(*opens) {
+		return errors.New("registration_closes_at must be after registration_opens_at")
+	}
+	if closes != nil && closes.After(event.EndDate) {
+		return errors.New("registration must close before the event ends")
+	}
+	if opens != nil && opens.After(event.EndDate) {
+		return errors.New("registration must open before the event ends")
+	}
+
+	seen := make(map[string]bool, len(event.Distances))
+	for _, distance := range event.Distances {
+		id := strings.TrimSpace(distance.ID)
+		if id == "" {
+			return errors.New("every distance needs an id")
+		}
+		if seen[id] {
+			return errors.New("duplicate distance id " + strconv.Quote(id))
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+func (s *Server) getEventByID(eventID string) (*Event, error) {
+	var event Event
+
+	result, _, err := s.supabase.From("events").
+		Select("*", "", false).
+		Eq("id", eventID).
+		Single().
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(result, &event); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// Events Management
+func (s *Server) getManagedEvents(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	status := c.Query("status")
+
+	offset := (page - 1) * limit
+
+	query := s.supabase.From("events").
+		Select("*", "exact", false).
+		Order("event_date", &map[string]interface{}{"ascending": false})
+
+	if status != "" {
+		statuses := strings.Split(status, ",")
+		for _, name := range statuses {
+			if !isEventStatus(name) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event status " + strconv.Quote(name)})
+				return
+			}
+		}
+		query = query.In("status", statuses)
+	}
+
+	result, count, err := query.
+		Range(offset, offset+limit-1, "", false).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch events"})
+		return
+	}
+
+	var events []Event
+	if err := json.Unmarshal(result, &events); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": count,
+			"pages": (int(count) + limit - 1) / limit,
+		},
+	})
+}
+
+func (s *Server) getManagedEvent(c *gin.Context) {
+	event, err := s.getEventByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, event)
+}
+
+func (s *Server) createEvent(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req CreateEventRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	event := Event{
+		ID:                   uuid.New().String(),
+		Name:                 req.Name,
+		Description:          req.Description,
+		EventDate:            req.EventDate.UTC(),
+		EndDate:              defaultEventEnd(req.EventDate),
+		Location:             req.Location,
+		Distances:            req.Distances,
+		Capacity:             req.Capacity,
+		Price:                req.Price,
+		Currency:             "VND",
+		RegistrationOpensAt:  req.RegistrationOpensAt,
+		RegistrationClosesAt: req.RegistrationClosesAt,
+		CoverImage:           req.CoverImage,
+		CreatedBy:            userID,
+		CreatedAt:            now,
+		UpdatedAt:            now,
+	}
+	if req.EndDate != nil {
+		event.EndDate = req.EndDate.UTC()
+	}
+	if err := validateEvent(&event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	event.Status = eventStatusFor(&event, now)
+
+	result, _, err := s.supabase.From("events").
+		Insert(event, false, "", "", "").
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create event"})
+		return
+	}
+
+	var created []Event
+	if err := json.Unmarshal(result, &created); err != nil || len(created) == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse created event"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, created[0])
+}
+
+func (s *Server) updateEvent(c *gin.Context) {
+	var req UpdateEventRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Capacity changes must not race with registrations
+	unlock := s.eventLocks.lock(c.Param("id"))
+	defer unlock()
+
+	event, err := s.getEventByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+	if event.Status == EventCancelled || event.Status == EventArchived {
+		c.JSON(http.StatusConflict, gin.H{"error": "A " + event.Status + " event can't be edited"})
+		return
+	}
+
+	updateData := map[string]interface{}{}
+	if req.Name != nil {
+		event.Name = *req.Name
+		updateData["name"] = event.Name
+	}
+	if req.Description != nil {
+		event.Description = *req.Description
+		updateData["description"] = event.Description
+	}
+	if req.EventDate != nil {
+		// Moving the start without a new end keeps the event's length
+		if req.EndDate == nil {
+			event.EndDate = req.EventDate.UTC().Add(event.EndDate.Sub(event.EventDate))
+			updateData["end_date"] = event.EndDate
+		}
+		event.EventDate = req.EventDate.UTC()
+		updateData["event_date"] = event.EventDate
+	}
+	if req.EndDate != nil {
+		event.EndDate = req.EndDate.UTC()
+		updateData["end_date"] = event.EndDate
+	}
+	if req.Location != nil {
+		event.Location = *req.Location
+		updateData["location"] = event.Location
+	}
+	var removedDistances []string
+	if req.Distances != nil {
+		kept := make(map[string]bool, len(*req.Distances))
+		for _, distance := range *req.Distances {
+			kept[distance.ID] = true
+		}
+		for _, distance := range event.Distances {
+			if !kept[distance.ID] {
+				removedDistances = append(removedDistances, distance.ID)
+			}
+		}
+		event.Distances = *req.Distances
+		updateData["distances"] = event.Distances
+	}
+	if req.Capacity != nil {
+		event.Capacity = *req.Capacity
+		updateData["capacity"] = event.Capacity
+	}
+	if req.Price != nil {
+		event.Price = *req.Price
+		updateData["price"] = event.Price
+	}
+	if req.RegistrationOpensAt != nil {
+		event.RegistrationOpensAt = req.RegistrationOpensAt
+		updateData["registration_opens_at"] = event.RegistrationOpensAt
+	}
+	if req.RegistrationClosesAt != nil {
+		event.RegistrationClosesAt = req.RegistrationClosesAt
+		updateData["registration_closes_at"] = event.RegistrationClosesAt
+	}
+	if req.CoverImage != nil {
+		event.CoverImage = *req.CoverImage
+		updateData["cover_image"] = event.CoverImage
+	}
+
+	if err := validateEvent(event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Capacity != nil && event.Capacity > 0 {
+		held, err := s.countRegistrations(event.ID, heldRegistrationStatuses)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check registrations"})
+			return
+		}
+		if event.Capacity < held {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Capacity can't be lower than the %d spots already taken", held)})
+			return
+		}
+	}
+
+	// Registrations point at a distance by ID, so it can only go once
+	// nobody has chosen it
+	if len(removedDistances) > 0 {
+		_, count, err := s.supabase.From("event_registrations").
+			Select("id", "exact", false).
+			Eq("event_id", event.ID).
+			In("status", activeRegistrationStatuses).
+			In("distance_id", removedDistances).
+			Execute()
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check registrations"})
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Can't remove distances %d registrations have chosen", count)})
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	event.Status = eventStatusFor(event, now)
+	event.UpdatedAt = now
+	updateData["status"] = event.Status
+	updateData["updated_at"] = now
+
+	// The status filter keeps an edit from reviving an event that was
+	// cancelled or archived since it was loaded
+	result, _, err := s.supabase.From("events").
+		Update(updateData, "", "").
+		Eq("id", event.ID).
+		Not("status", "in", "("+EventCancelled+","+EventArchived+")").
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update event"})
+		return
+	}
+	if affectedRows(result) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cancelled or archived events can't be edited"})
+		return
+	}
+
+	// A larger capacity lets people in off the waitlist
+	if req.Capacity != nil {
+		if err := s.promoteWaitlist(event, now); err != nil {
+			log.Printf("promote waitlist of event %s: %v", event.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, event)
+}
+
+func (s *Server) cancelEvent(c *gin.Context) {
+	var req CancelEventRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	unlock := s.eventLocks.lock(c.Param("id"))
+	defer unlock()
+
+	event, err := s.getEventByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+	if event.Status != EventUpcoming && event.Status != EventOngoing {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only upcoming or ongoing events can be cancelled"})
+		return
+	}
+
+	now := time.Now().UTC()
+	result, _, err := s.supabase.From("events").
+		Update(map[string]interface{}{
+			"status":              EventCancelled,
+			"cancellation_reason": req.Reason,
+			"cancelled_at":        now,
+			"updated_at":          now,
+		}, "", "").
+		Eq("id", event.ID).
+		In("status", []string{EventUpcoming, EventOngoing}).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel event"})
+		return
+	}
+	if affectedRows(result) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only upcoming or ongoing events can be cancelled"})
+		return
+	}
+
+	go s.cancelEventRegistrations(event.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Event cancelled successfully", "status": EventCancelled})
+}
+
+// Archiving hides a finished event from the public listing
+func (s *Server) archiveEvent(c *gin.Context) {
+	unlock := s.eventLocks.lock(c.Param("id"))
+	defer unlock()
+
+	event, err := s.getEventByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+	if event.Status != EventCompleted && event.Status != EventCancelled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only completed or cancelled events can be archived"})
+		return
+	}
+
+	result, _, err := s.supabase.From("events").
+		Update(map[string]interface{}{
+			"status":     EventArchived,
+			"updated_at": time.Now().UTC(),
+		}, "", "").
+		Eq("id", event.ID).
+		In("status", []string{EventCompleted, EventCancelled}).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to archive event"})
+		return
+	}
+	if affectedRows(result) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only completed or cancelled events can be archived"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Event archived successfully", "status": EventArchived})
+}
+
+// advanceEventStatuses moves events along as their dates pass. Completed
+// goes first so an event that started and ended since the last pass skips
+// straight to completed.
+func (s *Server) advanceEventStatuses(now time.Time) error {
+	cutoff := now.UTC().Format(time.RFC3339)
+
+	_, _, err := s.supabase.From("events").
+		Update(map[string]interface{}{"status": EventCompleted, "updated_at": now.UTC()}, "", "").
+		In("status", []string{EventUpcoming, EventOngoing}).
+		Lte("end_date", cutoff).
+		Execute()
+
+	if err != nil {
+		return err
+	}
+
+	_, _, err = s.supabase.From("events").
+		Update(map[string]interface{}{"status": EventOngoing, "updated_at": now.UTC()}, "", "").
+		Eq("status", EventUpcoming).
+		Lte("event_date", cutoff).
+		Execute()
+
+	return err
+}
+
+func (s *Server) runEventStatusTicker() {
+	ticker := time.NewTicker(s.events.StatusInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.advanceEventStatuses(time.Now()); err != nil {
+			log.Printf("advance event statuses: %v", err)
+		}
+		if err := s.settleOverdueEvents(time.Now()); err != nil {
+			log.Printf("release overdue event payments: %v", err)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const exportPageSize = 50
+
+var errNoRouteData = errors.New("run has no GPS route to export")
+
+type exportFormat struct {
+	extension   string
+	contentType string
+	write       func(w io.Writer, run *Run) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"gpx":     {"gpx", "application/gpx+xml", writeGPX},
+	"tcx":     {"tcx", "application/vnd.garmin.tcx+xml", writeTCX},
+	"geojson": {"geojson", "application/geo+json", writeGeoJSON},
+}
+
+// Run export
+func (s *Server) exportRun(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	format, ok := exportFormats[c.DefaultQuery("format", "gpx")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of gpx, tcx, geojson"})
+		return
+	}
+
+	viewer, err := s.currentViewer(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch run"})
+		return
+	}
+
+	run, err := s.getVisibleRun(viewer, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run not found"})
+		return
+	}
+
+	if err := s.redactRun(run, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch run"})
+		return
+	}
+
+	if !run.RouteData.HasPoints() {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": errNoRouteData.Error()})
+		return
+	}
+
+	c.Header("Content-Type", format.contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(run, format.extension)))
+	c.Status(http.StatusOK)
+
+	w := bufio.NewWriter(c.Writer)
+	if err := format.write(w, run); err != nil {
+		c.Error(err)
+		return
+	}
+	w.Flush()
+}
+
+// Bulk export streams every run into a ZIP archive page by page, so the
+// full history is never held in memory at once.
+func (s *Server) exportAllRuns(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	format, ok := exportFormats[c.DefaultQuery("format", "gpx")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of gpx, tcx, geojson"})
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "vsm-runs-"+format.extension+".zip"))
+	c.Status(http.StatusOK)
+
+	// The archive is only closed once every run is in it. On errors the
+	// central directory is never written, so the client is left with a
+	// truncated (invalid) archive instead of a valid one with a silent gap.
+	archive := zip.NewWriter(c.Writer)
+
+	for offset := 0; ; offset += exportPageSize {
+		runs, err := s.getUserRunsPage(userID, offset, exportPageSize)
+		if err != nil {
+			// Headers are already sent, so all we can do is stop
+			c.Error(err)
+			c.Abort()
+			return
+		}
+
+		for i := range runs {
+			run := &runs[i]
+			if !run.RouteData.HasPoints() {
+				continue
+			}
+
+			entry, err := archive.CreateHeader(&zip.FileHeader{
+				Name:     exportFilename(run, format.extension),
+				Method:   zip.Deflate,
+				Modified: run.CreatedAt,
+			})
+			if err != nil {
+				c.Error(err)
+				c.Abort()
+				return
+			}
+
+			if err := format.write(entry, run); err != nil {
+				c.Error(err)
+				c.Abort()
+				return
+			}
+		}
+
+		c.Writer.Flush()
+
+		if len(runs) < exportPageSize {
+			if err := archive.Close(); err != nil {
+				c.Error(err)
+			}
+			return
+		}
+	}
+}
+
+func (s *Server) getUserRunsPage(userID string, offset, limit int) ([]Run, error) {
+	result, _, err := s.supabase.From("runs").
+		Select("*", "", false).
+		Eq("user_id", userID).
+		Order("created_at", &map[string]interface{}{"ascending": true}).
+		Range(offset, offset+limit-1, "", false).
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []Run
+	if err := json.Unmarshal(result, &runs); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+func exportFilename(run *Run, extension string) string {
+	start := run.CreatedAt
+	if run.RouteData.HasPoints() {
+		start = run.RouteData.Points[0].Timestamp
+	}
+
+	id := run.ID
+	if len(id) > 8 {
+		id = id[:8]
+	}
+
+	return fmt.Sprintf("%s-%s-%s.%s", start.Format("2006-01-02"), generateSlug(run.Title), id, extension)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func exportTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Helper function for the GPX <type> of a run, using the names Strava and
+// Garmin Connect recognise
+func gpxActivityType(run *Run) string {
+	activity := storedActivityType(run.ActivityType)
+	switch {
+	case activity.ID == "cycling":
+		return "cycling"
+	case activity.ID == "walk":
+		return "walking"
+	case activity.ID == "trail_run":
+		return "trail_running"
+	default:
+		return "running"
+	}
+}
+
+// Helper function for the TCX Sport attribute, which only knows Running,
+// Biking and Other
+func tcxSport(run *Run) string {
+	activity := storedActivityType(run.ActivityType)
+	switch {
+	case activity.Running:
+		return "Running"
+	case activity.ID == "cycling":
+		return "Biking"
+	default:
+		return "Other"
+	}
+}
+
+// GPX 1.1 with Garmin TrackPointExtension v1 for heart rate and cadence
+func writeGPX(w io.Writer, run *Run) error {
+	points := run.RouteData.Points
+
+	fmt.Fprint(w, xml.Header)
+	fmt.Fprint(w, `<gpx version="1.1" creator="VSM" xmlns="http://www.topografix.com/GPX/1/1"`+
+		` xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"`+
+		` xmlns:gpxtpx="http://www.garmin.com/xmlschemas/TrackPointExtension/v1"`+
+		` xsi:schemaLocation="http://www.topografix.com/GPX/1/1 http://www.topografix.com/GPX/1/1/gpx.xsd`+
+		` http://www.garmin.com/xmlschemas/TrackPointExtension/v1 http://www.garmin.com/xmlschemas/TrackPointExtensionv1.xsd">`+"\n")
+	fmt.Fprintf(w, "  <metadata>\n    <name>%s</name>\n    <time>%s</time>\n  </metadata>\n", xmlEscape(run.Title), exportTime(points[0].Timestamp))
+	fmt.Fprintf(w, "  <trk>\n    <name>%s</name>\n    <type>%s</type>\n    <trkseg>\n", xmlEscape(run.Title), gpxActivityType(run))
+
+	for _, p := range points {
+		fmt.Fprintf(w, "      <trkpt lat=\"%.7f\" lon=\"%.7f\">\n", p.Lat, p.Lng)
+		if p.Altitude != nil {
+			fmt.Fprintf(w, "        <ele>%.1f</ele>\n", *p.Altitude)
+		}
+		fmt.Fprintf(w, "        <time>%s</time>\n", exportTime(p.Timestamp))
+		if p.HeartRate != nil || p.Cadence != nil {
+			fmt.Fprint(w, "        <extensions>\n          <gpxtpx:TrackPointExtension>\n")
+			if p.HeartRate != nil {
+				fmt.Fprintf(w, "            <gpxtpx:hr>%d</gpxtpx:hr>\n", *p.HeartRate)
+			}
+			if p.Cadence != nil {
+				fmt.Fprintf(w, "            <gpxtpx:cad>%d</gpxtpx:cad>\n", *p.Cadence)
+			}
+			fmt.Fprint(w, "          </gpxtpx:TrackPointExtension>\n        </extensions>\n")
+		}
+		fmt.Fprint(w, "      </trkpt>\n")
+	}
+
+	_, err := fmt.Fprint(w, "    </trkseg>\n  </trk>\n</gpx>\n")
+	return err
+}
+
+// Training Center XML v2; element order follows the XSD sequence
+func writeTCX(w io.Writer, run *Run) error {
+	points := run.RouteData.Points
+	start := exportTime(points[0].Timestamp)
+	sport := tcxSport(run)
+
+	fmt.Fprint(w, xml.Header)
+	fmt.Fprint(w, `<TrainingCenterDatabase xmlns="http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2"`+
+		` xmlns:ns3="http://www.garmin.com/xmlschemas/ActivityExtension/v2"`+
+		` xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"`+
+		` xsi:schemaLocation="http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2 http://www.garmin.com/xmlschemas/TrainingCenterDatabasev2.xsd">`+"\n")
+	fmt.Fprintf(w, "  <Activities>\n    <Activity Sport=\"%s\">\n      <Id>%s</Id>\n", sport, start)
+	fmt.Fprintf(w, "      <Lap StartTime=\"%s\">\n", start)
+	fmt.Fprintf(w, "        <TotalTimeSeconds>%d</TotalTimeSeconds>\n", run.DurationSeconds)
+	fmt.Fprintf(w, "        <DistanceMeters>%.1f</DistanceMeters>\n", run.DistanceKm*1000)
+	fmt.Fprintf(w, "        <Calories>%d</Calories>\n", run.CaloriesBurned)
+	if run.AvgHeartRate != nil {
+		fmt.Fprintf(w, "        <AverageHeartRateBpm><Value>%d</Value></AverageHeartRateBpm>\n", *run.AvgHeartRate)
+	}
+	if run.MaxHeartRate != nil {
+		fmt.Fprintf(w, "        <MaximumHeartRateBpm><Value>%d</Value></MaximumHeartRateBpm>\n", *run.MaxHeartRate)
+	}
+	fmt.Fprint(w, "        <Intensity>Active</Intensity>\n        <TriggerMethod>Manual</TriggerMethod>\n        <Track>\n")
+
+	var distance float64
+	for i, p := range points {
+		if i > 0 {
+			distance += haversineKm(points[i-1].Lat, points[i-1].Lng, p.Lat, p.Lng) * 1000
+		}
+		fmt.Fprintf(w, "          <Trackpoint>\n            <Time>%s</Time>\n", exportTime(p.Timestamp))
+		fmt.Fprintf(w, "            <Position>\n              <LatitudeDegrees>%.7f</LatitudeDegrees>\n              <LongitudeDegrees>%.7f</LongitudeDegrees>\n            </Position>\n", p.Lat, p.Lng)
+		if p.Altitude != nil {
+			fmt.Fprintf(w, "            <AltitudeMeters>%.1f</AltitudeMeters>\n", *p.Altitude)
+		}
+		fmt.Fprintf(w, "            <DistanceMeters>%.1f</DistanceMeters>\n", distance)
+		if p.HeartRate != nil {
+			fmt.Fprintf(w, "            <HeartRateBpm><Value>%d</Value></HeartRateBpm>\n", *p.HeartRate)
+		}
+		// Pedalling cadence has its own element; RunCadence is for feet
+		biking := sport == "Biking"
+		if biking && p.Cadence != nil {
+			fmt.Fprintf(w, "            <Cadence>%d</Cadence>\n", *p.Cadence)
+		}
+		if (p.Cadence != nil && !biking) || p.Speed != nil {
+			fmt.Fprint(w, "            <Extensions>\n              <ns3:TPX>\n")
+			if p.Speed != nil {
+				fmt.Fprintf(w, "                <ns3:Speed>%.3f</ns3:Speed>\n", *p.Speed)
+			}
+			if p.Cadence != nil && !biking {
+				fmt.Fprintf(w, "                <ns3:RunCadence>%d</ns3:RunCadence>\n", *p.Cadence)
+			}
+			fmt.Fprint(w, "              </ns3:TPX>\n            </Extensions>\n")
+		}
+		fmt.Fprint(w, "          </Trackpoint>\n")
+	}
+
+	_, err := fmt.Fprint(w, "        </Track>\n      </Lap>\n      <Creator xsi:type=\"Device_t\">\n        <Name>VSM</Name>\n        <UnitId>0</UnitId>\n        <ProductID>0</ProductID>\n        <Version>\n          <VersionMajor>1</VersionMajor>\n          <VersionMinor>0</VersionMinor>\n        </Version>\n      </Creator>\n    </Activity>\n  </Activities>\n</TrainingCenterDatabase>\n")
+	return err
+}
+
+// GeoJSON Feature with a LineString and per-point times in "coordTimes"
+func writeGeoJSON(w io.Writer, run *Run) error {
+	points := run.RouteData.Points
+
+	coordinates := make([][]float64, len(points))
+	times := make([]string, len(points))
+	var heartRates []interface{}
+	for i, p := range points {
+		coord := []float64{p.Lng, p.Lat}
+		if p.Altitude != nil {
+			coord = append(coord, *p.Altitude)
+		}
+		coordinates[i] = coord
+		times[i] = exportTime(p.Timestamp)
+		if p.HeartRate != nil {
+			if heartRates == nil {
+				heartRates = make([]interface{}, len(points))
+			}
+			heartRates[i] = *p.HeartRate
+		}
+	}
+
+	properties := map[string]interface{}{
+		"id":               run.ID,
+		"title":            run.Title,
+		"distance_km":      run.DistanceKm,
+		"duration_seconds": run.DurationSeconds,
+		"start_time":       times[0],
+		"coordTimes":       times,
+	}
+	if heartRates != nil {
+		properties["heartRates"] = heartRates
+	}
+
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"type": "Feature",
+		"geometry": map[string]interface{}{
+			"type":        "LineString",
+			"coordinates": coordinates,
+		},
+		"properties": properties,
+	})
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const earthRadiusKm = 6371.0
+
+type RunSession struct {
+	ID              string      `json:"id"`
+	UserID          string      `json:"user_id"`
+	Title           string      `json:"title"`
+	Status          string      `json:"status"`
+	StartedAt       time.Time   `json:"started_at"`
+	EndedAt         *time.Time  `json:"ended_at"`
+	DistanceKm      float64     `json:"distance_km"`
+	DurationSeconds int         `json:"duration_seconds"`
+	LastLat         *float64    `json:"last_lat"`
+	LastLng         *float64    `json:"last_lng"`
+	LastRecordedAt  *time.Time  `json:"last_recorded_at"`
+	RunID           *string     `json:"run_id"`
+	LapMarkers      []time.Time `json:"lap_markers"`
+	ActivityType    string      `json:"activity_type"`
+	ShareToken      *string     `json:"share_token"`
+	UpdatedAt       *time.Time  `json:"updated_at"`
+}
+
+type StartSessionRequest struct {
+	Title        string `json:"title"`
+	ActivityType string `json:"activity_type"`
+}
+
+type PositionUpdate struct {
+	Lat       *float64   `json:"lat" binding:"required,min=-90,max=90"`
+	Lng       *float64   `json:"lng" binding:"required,min=-180,max=180"`
+	Timestamp *time.Time `json:"timestamp"`
+	Accuracy  *float64   `json:"accuracy"`
+	Altitude  *float64   `json:"altitude"`
+	Speed     *float64   `json:"speed"`
+}
+
+type LapRequest struct {
+	Timestamp *time.Time `json:"timestamp"`
+}
+
+type PushPositionsRequest struct {
+	Positions []PositionUpdate `json:"positions" binding:"required,min=1,dive"`
+}
+
+// Live GPS run sessions
+func (s *Server) startRunSession(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req StartSessionRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	activity, err := lookupActivityType(req.ActivityType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !activity.UsesGPS {
+		c.JSON(http.StatusBadRequest, gin.H{"error": activity.Name + " activities are logged without live GPS"})
+		return
+	}
+
+	now := time.Now().UTC()
+	title := req.Title
+	if title == "" {
+		title = fmt.Sprintf("%s %s", activity.Name, now.Format("2006-01-02"))
+	}
+
+	session := map[string]interface{}{
+		"id":               uuid.New().String(),
+		"user_id":          userID,
+		"title":            title,
+		"status":           "active",
+		"activity_type":    activity.ID,
+		"started_at":       now,
+		"distance_km":      0,
+		"duration_seconds": 0,
+		"created_at":       now,
+		"updated_at":       now,
+	}
+
+	result, _, err := s.supabase.From("run_sessions").
+		Insert(session, false, "", "", "").
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start run session"})
+		return
+	}
+
+	var createdSession RunSession
+	if err := json.Unmarshal(result, &createdSession); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse run session"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"session": createdSession,
+		"message": "Run session started successfully",
+	})
+}
+
+func (s *Server) getRunSessionStatus(c *gin.Context) {
+	session, err := s.getRunSession(c.Param("id"), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+func (s *Server) pushPositions(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req PushPositionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, err := s.getRunSession(c.Param("id"), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run session not found"})
+		return
+	}
+
+	if session.Status != "active" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Run session is not active"})
+		return
+	}
+
+	now := time.Now().UTC()
+
+	// The session row is updated compare-and-swap on last_recorded_at, so
+	// concurrent pushes can't overwrite each other's distance; the loser
+	// re-reads the session and tries again.
+	var progress sessionProgress
+	for attempt := 0; ; attempt++ {
+		progress = nextSessionProgress(session, req.Positions, now)
+		if len(progress.rows) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No new positions in request"})
+			return
+		}
+
+		claimed, err := s.advanceRunSession(session, progress, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update run session"})
+			return
+		}
+		if claimed {
+			break
+		}
+		if attempt == sessionUpdateRetries {
+			c.JSON(http.StatusConflict, gin.H{"error": "Run session is busy, please retry"})
+			return
+		}
+
+		session, err = s.getRunSession(session.ID, userID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Run session not found"})
+			return
+		}
+		if session.Status != "active" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Run session is not active"})
+			return
+		}
+	}
+
+	_, _, err = s.supabase.From("run_positions").
+		Insert(progress.rows, false, "", "", "").
+		Execute()
+
+	if err != nil {
+		// Put the session back so the client can retry the same batch
+		s.revertRunSession(session, progress, now)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store positions"})
+		return
+	}
+
+	distance, duration, last := progress.distance, progress.duration, progress.last
+
+	// Followers never see points inside the runner's privacy zones
+	if session.ShareToken != nil {
+		if zones, err := s.getUserPrivacyZones(userID); err == nil {
+			s.publishLive(session.ID, "position", gin.H{
+				"positions":        trimPrivatePoints(progress.accepted, zones),
+				"distance_km":      distance,
+				"duration_seconds": duration,
+				"pace":             formatPace(paceSecondsPerKm(distance, duration)),
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"distance_km":      distance,
+		"duration_seconds": duration,
+		"pace":             formatPace(paceSecondsPerKm(distance, duration)),
+		"calories":         estimateCalories(bodyMetrics(currentProfile(c)), storedActivityType(session.ActivityType), distance, duration, 1),
+		"current_position": last,
+		"accepted":         len(progress.rows),
+	})
+}
+
+// Attempts beyond the first when a concurrent push moved the session on
+const sessionUpdateRetries = 3
+
+// sessionProgress is a batch of new positions and the session totals after
+// appending them
+type sessionProgress struct {
+	rows     []map[string]interface{}
+	accepted []TrackPoint
+	distance float64
+	duration int
+	last     *TrackPoint
+}
+
+// Helper function to append positions to the session's current state.
+// Positions are appended in time order; anything older than the last
+// stored fix (e.g. a retried batch) is dropped.
+func nextSessionProgress(session *RunSession, positions []PositionUpdate, now time.Time) sessionProgress {
+	var last *TrackPoint
+	if session.LastLat != nil && session.LastLng != nil && session.LastRecordedAt != nil {
+		last = &TrackPoint{Lat: *session.LastLat, Lng: *session.LastLng, Timestamp: *session.LastRecordedAt}
+	}
+
+	progress := sessionProgress{distance: session.DistanceKm}
+	for _, p := range positions {
+		point := TrackPoint{
+			Lat:      *p.Lat,
+			Lng:      *p.Lng,
+			Accuracy: p.Accuracy,
+			Altitude: p.Altitude,
+			Speed:    p.Speed,
+		}
+		point.Timestamp = now
+		if p.Timestamp != nil {
+			point.Timestamp = p.Timestamp.UTC()
+		}
+		// Stored at the database's microsecond precision so the last fix
+		// compares equal when it's read back
+		point.Timestamp = point.Timestamp.Truncate(time.Microsecond)
+
+		if point.Timestamp.Before(session.StartedAt) || point.Timestamp.After(now.Add(time.Minute)) {
+			continue
+		}
+		if last != nil {
+			if !point.Timestamp.After(last.Timestamp) {
+				continue
+			}
+			progress.distance += haversineKm(last.Lat, last.Lng, point.Lat, point.Lng)
+		}
+
+		progress.rows = append(progress.rows, map[string]interface{}{
+			"id":          uuid.New().String(),
+			"session_id":  session.ID,
+			"lat":         point.Lat,
+			"lng":         point.Lng,
+			"accuracy":    point.Accuracy,
+			"altitude":    point.Altitude,
+			"speed":       point.Speed,
+			"recorded_at": point.Timestamp,
+		})
+		progress.accepted = append(progress.accepted, point)
+		last = &point
+	}
+
+	if last != nil {
+		progress.last = last
+		progress.duration = int(last.Timestamp.Sub(session.StartedAt).Seconds())
+	}
+	return progress
+}
+
+// advanceRunSession stores the new totals if the session is still active
+// and nobody else has appended positions since it was read
+func (s *Server) advanceRunSession(session *RunSession, progress sessionProgress, now time.Time) (bool, error) {
+	query := s.supabase.From("run_sessions").
+		Update(map[string]interface{}{
+			"distance_km":      progress.distance,
+			"duration_seconds": progress.duration,
+			"last_lat":         progress.last.Lat,
+			"last_lng":         progress.last.Lng,
+			"last_recorded_at": progress.last.Timestamp,
+			"updated_at":       now,
+		}, "", "").
+		Eq("id", session.ID).
+		Eq("status", "active")
+
+	if session.LastRecordedAt == nil {
+		query = query.Is("last_recorded_at", "null")
+	} else {
+		query = query.Eq("last_recorded_at", session.LastRecordedAt.UTC().Format(time.RFC3339Nano))
+	}
+
+	result, _, err := query.Execute()
+	if err != nil {
+		return false, err
+	}
+	return affectedRows(result) > 0, nil
+}
+
+// Helper function to undo advanceRunSession, unless another push has
+// already built on top of it
+func (s *Server) revertRunSession(session *RunSession, progress sessionProgress, now time.Time) {
+	s.supabase.From("run_sessions").
+		Update(map[string]interface{}{
+			"distance_km":      session.DistanceKm,
+			"duration_seconds": session.DurationSeconds,
+			"last_lat":         session.LastLat,
+			"last_lng":         session.LastLng,
+			"last_recorded_at": session.LastRecordedAt,
+			"updated_at":       now,
+		}, "", "").
+		Eq("id", session.ID).
+		Eq("last_recorded_at", progress.last.Timestamp.UTC().Format(time.RFC3339Nano)).
+		Execute()
+}
+
+// Manual lap button; the markers become lap boundaries when the session ends
+func (s *Server) markLap(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req LapRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	session, err := s.getRunSession(c.Param("id"), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run session not found"})
+		return
+	}
+
+	now := time.Now().UTC()
+	marker := now
+	if req.Timestamp != nil {
+		marker = req.Timestamp.UTC()
+	}
+
+	// Markers are rewritten whole, so the update is compare-and-swap on
+	// updated_at like the position append; a lap tapped concurrently makes
+	// the loser re-read the markers and try again
+	var markers []time.Time
+	for attempt := 0; ; attempt++ {
+		if session.Status != "active" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Run session is not active"})
+			return
+		}
+		if !marker.After(session.StartedAt) || marker.After(now.Add(time.Minute)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Lap timestamp is outside the session"})
+			return
+		}
+		if n := len(session.LapMarkers); n > 0 && !marker.After(session.LapMarkers[n-1]) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Lap timestamp must be after the previous lap"})
+			return
+		}
+
+		markers = append(append([]time.Time{}, session.LapMarkers...), marker)
+		query := s.supabase.From("run_sessions").
+			Update(map[string]interface{}{
+				"lap_markers": markers,
+				"updated_at":  now,
+			}, "", "").
+			Eq("id", session.ID).
+			Eq("status", "active")
+
+		if session.UpdatedAt == nil {
+			query = query.Is("updated_at", "null")
+		} else {
+			query = query.Eq("updated_at", session.UpdatedAt.UTC().Format(time.RFC3339Nano))
+		}
+
+		result, _, err := query.Execute()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record lap"})
+			return
+		}
+		if affectedRows(result) > 0 {
+			break
+		}
+		if attempt == sessionUpdateRetries {
+			c.JSON(http.StatusConflict, gin.H{"error": "Run session is busy, please retry"})
+			return
+		}
+
+		session, err = s.getRunSession(session.ID, userID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Run session not found"})
+			return
+		}
+	}
+
+	s.publishLive(session.ID, "lap", gin.H{
+		"lap":        len(markers) + 1,
+		"started_at": marker,
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"lap":        len(markers) + 1,
+		"started_at": marker,
+	})
+}
+
+func (s *Server) endRunSession(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	session, err := s.getRunSession(c.Param("id"), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run session not found"})
+		return
+	}
+
+	// A retry after the run was saved but the session wasn't linked to it
+	// finishes the link instead of failing
+	if session.Status == "completed" && session.RunID == nil {
+		run, err := s.findSessionRun(session)
+		if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Run session is still being ended, please retry"})
+			return
+		}
+		if err := s.linkSessionRun(session, run.ID, run.DistanceKm, run.DurationSeconds); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close run session"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"run":         run,
+			"new_records": []PersonalRecord{},
+			"message":     "Run session completed successfully",
+		})
+		return
+	}
+
+	if session.Status != "active" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Run session is not active"})
+		return
+	}
+
+	now := time.Now().UTC()
+
+	// Close the session before building the run: only the request that
+	// flips it from active gets to save one, and later pushes are refused
+	result, _, err := s.supabase.From("run_sessions").
+		Update(map[string]interface{}{
+			"status":     "completed",
+			"ended_at":   now,
+			"updated_at": now,
+		}, "", "").
+		Eq("id", session.ID).
+		Eq("status", "active").
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close run session"})
+		return
+	}
+	if affectedRows(result) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Run session is not active"})
+		return
+	}
+
+	points, err := s.getSessionPositions(session.ID)
+	if err != nil {
+		s.reopenRunSession(session.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch session positions"})
+		return
+	}
+
+	// Elapsed time runs from session start to end, not just between fixes
+	activity := storedActivityType(session.ActivityType)
+	processed := s.pipeline.Process(&Track{Points: points, Laps: session.LapMarkers, SourceFormat: "live"})
+	summary := activity.adjustSummary(processed.Summary())
+	summary.DurationSeconds = int(now.Sub(session.StartedAt).Seconds())
+
+	run := map[string]interface{}{
+		"id":              uuid.New().String(),
+		"user_id":         userID,
+		"title":           session.Title,
+		"visibility":      runVisibility(nil, currentProfile(c)),
+		"provenance":      ProvenanceGPSLive,
+		"calories_burned": summaryCalories(currentProfile(c), activity, summary),
+		"started_at":      session.StartedAt,
+		"created_at":      now,
+	}
+	applyTrackSummary(run, summary)
+	applyActivity(run, activity, summary.DistanceKm, summary.MovingSeconds)
+	applyRunSplits(run, processed)
+	applyHeartRate(run, pointHeartRates(processed.Points), currentProfile(c))
+	efforts := applyBestEfforts(run, activity, processed.Points)
+	s.applySuspicion(run, activity, points, runTiming{Start: session.StartedAt, End: now})
+
+	track := processed.Track()
+	if track.HasPoints() {
+		applyTrack(run, track)
+	}
+
+	createdRun, err := s.saveRun(run)
+	if err != nil {
+		s.reopenRunSession(session.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create run"})
+		return
+	}
+
+	if track.HasPoints() {
+		go s.matchRunSegments(userID, run["id"].(string), activity, track.Points)
+	}
+	records := s.detectPersonalRecords(userID, run, efforts)
+
+	if err := s.linkSessionRun(session, run["id"].(string), summary.DistanceKm, summary.DurationSeconds); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close run session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"run":         createdRun,
+		"new_records": records,
+		"message":     "Run session completed successfully",
+	})
+}
+
+// Helper function to point an ended session at its run, revoke the share
+// link and tell followers the run is over
+func (s *Server) linkSessionRun(session *RunSession, runID string, distanceKm float64, durationSeconds int) error {
+	_, _, err := s.supabase.From("run_sessions").
+		Update(map[string]interface{}{
+			"distance_km":      distanceKm,
+			"duration_seconds": durationSeconds,
+			"run_id":           runID,
+			"share_token":      nil,
+			"updated_at":       time.Now().UTC(),
+		}, "", "").
+		Eq("id", session.ID).
+		Execute()
+
+	if err != nil {
+		return err
+	}
+
+	s.endLive(session.ID, gin.H{
+		"distance_km":      distanceKm,
+		"duration_seconds": durationSeconds,
+	})
+	return nil
+}
+
+// Helper function to find the run an ended session saved. Runs keep the
+// session's start time, which no other live run of the user shares.
+func (s *Server) findSessionRun(session *RunSession) (*Run, error) {
+	var run Run
+
+	result, _, err := s.supabase.From("runs").
+		Select("*", "", false).
+		Eq("user_id", session.UserID).
+		Eq("provenance", ProvenanceGPSLive).
+		Eq("started_at", session.StartedAt.UTC().Format(time.RFC3339Nano)).
+		Single().
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(result, &run); err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// Helper function to make a session active again when ending it failed
+// before its run was saved
+func (s *Server) reopenRunSession(sessionID string) {
+	s.supabase.From("run_sessions").
+		Update(map[string]interface{}{
+			"status":     "active",
+			"ended_at":   nil,
+			"updated_at": time.Now().UTC(),
+		}, "", "").
+		Eq("id", sessionID).
+		Eq("status", "completed").
+		Is("run_id", "null").
+		Execute()
+}
+
+func (s *Server) getRunSession(sessionID, userID string) (*RunSession, error) {
+	var session RunSession
+
+	result, _, err := s.supabase.From("run_sessions").
+		Select("*", "", false).
+		Eq("id", sessionID).
+		Eq("user_id", userID).
+		Single().
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(result, &session); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (s *Server) getSessionPositions(sessionID string) ([]TrackPoint, error) {
+	result, _, err := s.supabase.From("run_positions").
+		Select("lat, lng, accuracy, altitude, speed, recorded_at", "", false).
+		Eq("session_id", sessionID).
+		Order("recorded_at", &map[string]interface{}{"ascending": true}).
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		TrackPoint
+		RecordedAt time.Time `json:"recorded_at"`
+	}
+	if err := json.Unmarshal(result, &rows); err != nil {
+		return nil, err
+	}
+
+	points := make([]TrackPoint, len(rows))
+	for i, row := range rows {
+		points[i] = row.TrackPoint
+		points[i].Timestamp = row.RecordedAt
+	}
+
+	return points, nil
+}
+
+// affectedRows counts the rows an Update returned, so conditional updates
+// can tell whether they matched
+func affectedRows(result []byte) int {
+	var rows []json.RawMessage
+	if err := json.Unmarshal(result, &rows); err != nil {
+		return 0
+	}
+	return len(rows)
+}
+
+// Helper functions for GPS calculations
+func haversineKm(lat1, lng1, lat2, lng2 float64) float64 {
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*
+			math.Sin(dLng/2)*math.Sin(dLng/2)
+	return earthRadiusKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func trackDistanceKm(points []TrackPoint) float64 {
+	var total float64
+	for i := 1; i < len(points); i++ {
+		total += haversineKm(points[i-1].Lat, points[i-1].Lng, points[i].Lat, points[i].Lng)
+	}
+	return total
+}
+
+func paceSecondsPerKm(distanceKm float64, durationSeconds int) int {
+	if distanceKm <= 0 {
+		return 0
+	}
+	return int(math.Round(float64(durationSeconds) / distanceKm))
+}
+
+func formatPace(secondsPerKm int) string {
+	if secondsPerKm <= 0 {
+		return "0:00"
+	}
+	return fmt.Sprintf("%d:%02d", secondsPerKm/60, secondsPerKm%60)
+}
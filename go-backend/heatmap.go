@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	heatmapTileSize = 256
+	heatmapMaxZoom  = 18
+	// Consecutive points further apart than this are a GPS gap, not a path
+	heatmapMaxSegmentM = 200.0
+	// Pass counts at which a pixel is drawn at full heat
+	heatmapUserSaturation   = 10
+	heatmapGlobalSaturation = 50
+	heatmapCacheEntries     = 4096
+)
+
+type HeatmapConfig struct {
+	TileTTL  time.Duration
+	RouteTTL time.Duration
+	// Global tiles only show pixels that at least this many people passed
+	MinUsers int
+	// Meters trimmed from both ends of every route on global tiles so
+	// nobody's front door lights up
+	TrimMeters float64
+}
+
+func loadHeatmapConfig() HeatmapConfig {
+	return HeatmapConfig{
+		TileTTL:    time.Duration(envInt("HEATMAP_TILE_TTL_SECONDS", 900)) * time.Second,
+		RouteTTL:   time.Duration(envInt("HEATMAP_ROUTE_TTL_SECONDS", 900)) * time.Second,
+		MinUsers:   envInt("HEATMAP_MIN_USERS", 3),
+		TrimMeters: envFloat("HEATMAP_TRIM_M", 200),
+	}
+}
+
+// heatRoute is one run's path in global pixel coordinates at zoom 0,
+// scaled by 2^z when a tile is rendered.
+type heatRoute struct {
+	userIndex int
+	x, y      []float64
+}
+
+type heatmapEntry struct {
+	routes  []heatRoute
+	tile    []byte
+	expires time.Time
+}
+
+// HeatmapCache keeps both the decoded routes of a scope (a user, or the
+// global map) and rendered tiles, so panning doesn't re-read route_data.
+type HeatmapCache struct {
+	mu      sync.Mutex
+	config  HeatmapConfig
+	routes  map[string]heatmapEntry
+	tiles   map[string]heatmapEntry
+	version map[string]int
+}
+
+func NewHeatmapCache(config HeatmapConfig) *HeatmapCache {
+	return &HeatmapCache{
+		config:  config,
+		routes:  make(map[string]heatmapEntry),
+		tiles:   make(map[string]heatmapEntry),
+		version: make(map[string]int),
+	}
+}
+
+func (h *HeatmapCache) tileKey(scope string, z, x, y int) string {
+	return scope + "@" + strconv.Itoa(h.version[scope]) + "/" +
+		strconv.Itoa(z) + "/" + strconv.Itoa(x) + "/" + strconv.Itoa(y)
+}
+
+func (h *HeatmapCache) getTile(scope string, z, x, y int) ([]byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.tiles[h.tileKey(scope, z, x, y)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.tile, true
+}
+
+func (h *HeatmapCache) putTile(scope string, z, x, y int, tile []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.evictLocked(h.tiles)
+	h.tiles[h.tileKey(scope, z, x, y)] = heatmapEntry{tile: tile, expires: time.Now().Add(h.config.TileTTL)}
+}
+
+func (h *HeatmapCache) getRoutes(scope string) ([]heatRoute, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.routes[scope]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.routes, true
+}
+
+func (h *HeatmapCache) putRoutes(scope string, routes []heatRoute) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.evictLocked(h.routes)
+	h.routes[scope] = heatmapEntry{routes: routes, expires: time.Now().Add(h.config.RouteTTL)}
+}
+
+// invalidate drops a user's cached routes and orphans their tiles, which
+// then age out. Global tiles are left to expire on their TTL.
+func (h *HeatmapCache) invalidate(userID string) {
+	scope := "user:" + userID
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.routes, scope)
+	h.version[scope]++
+}
+
+// Helper function to keep a cache map bounded: expired entries go first,
+// then arbitrary ones
+func (h *HeatmapCache) evictLocked(entries map[string]heatmapEntry) {
+	if len(entries) < heatmapCacheEntries {
+		return
+	}
+	now := time.Now()
+	for key, entry := range entries {
+		if now.After(entry.expires) {
+			delete(entries, key)
+		}
+	}
+	for key := range entries {
+		if len(entries) < heatmapCacheEntries {
+			break
+		}
+		delete(entries, key)
+	}
+}
+
+// Web Mercator projection to pixel coordinates at zoom 0
+func mercatorPixel(lat, lng float64) (float64, float64) {
+	lat = math.Max(-85.05112878, math.Min(85.05112878, lat))
+	x := (lng + 180) / 360 * heatmapTileSize
+	sin := math.Sin(lat * math.Pi / 180)
+	y := (0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)) * heatmapTileSize
+	return x, y
+}
+
+// projectRoute converts a track to a heat route, dropping trimMeters from
+// each end and splitting at GPS gaps (marked with NaN).
+func projectRoute(points []TrackPoint, userIndex int, trimMeters float64) heatRoute {
+	route := heatRoute{userIndex: userIndex}
+	if len(points) < 2 {
+		return route
+	}
+
+	profile := newTrackProfile(points, nil)
+	total := profile.totalDistance()
+	if total <= 2*trimMeters {
+		return route
+	}
+
+	for i, p := range points {
+		if profile.distance[i] < trimMeters || profile.distance[i] > total-trimMeters {
+			continue
+		}
+		if i > 0 && profile.distance[i]-profile.distance[i-1] > heatmapMaxSegmentM {
+			route.x = append(route.x, math.NaN())
+			route.y = append(route.y, math.NaN())
+		}
+		x, y := mercatorPixel(p.Lat, p.Lng)
+		route.x = append(route.x, x)
+		route.y = append(route.y, y)
+	}
+	return route
+}
+
+// heatGrid accumulates passes per pixel of one tile. A route crossing a
+// pixel several times (e.g. laps of a track) counts once, and users
+// tracks how many different people passed.
+type heatGrid struct {
+	counts    []int
+	users     []int
+	lastUser  []int
+	lastRoute []int
+}
+
+func newHeatGrid() *heatGrid {
+	n := heatmapTileSize * heatmapTileSize
+	grid := &heatGrid{
+		counts:    make([]int, n),
+		users:     make([]int, n),
+		lastUser:  make([]int, n),
+		lastRoute: make([]int, n),
+	}
+	for i := range grid.lastUser {
+		grid.lastUser[i] = -1
+		grid.lastRoute[i] = -1
+	}
+	return grid
+}
+
+func (g *heatGrid) mark(px, py, routeIndex, userIndex int) {
+	if px < 0 || py < 0 || px >= heatmapTileSize || py >= heatmapTileSize {
+		return
+	}
+	i := py*heatmapTileSize + px
+	if g.lastRoute[i] == routeIndex {
+		return
+	}
+	g.lastRoute[i] = routeIndex
+	g.counts[i]++
+	if g.lastUser[i] != userIndex {
+		g.lastUser[i] = userIndex
+		g.users[i]++
+	}
+}
+
+// rasterize draws every route segment that touches the tile, sampling
+// each segment at sub-pixel steps.
+func rasterize(routes []heatRoute, z, tx, ty int) *heatGrid {
+	grid := newHeatGrid()
+	scale := math.Exp2(float64(z))
+	originX := float64(tx * heatmapTileSize)
+	originY := float64(ty * heatmapTileSize)
+
+	for r, route := range routes {
+		for i := 1; i < len(route.x); i++ {
+			if math.IsNaN(route.x[i]) || math.IsNaN(route.x[i-1]) {
+				continue
+			}
+			x0, y0 := route.x[i-1]*scale-originX, route.y[i-1]*scale-originY
+			x1, y1 := route.x[i]*scale-originX, route.y[i]*scale-originY
+			if math.Max(x0, x1) < 0 || math.Min(x0, x1) >= heatmapTileSize ||
+				math.Max(y0, y1) < 0 || math.Min(y0, y1) >= heatmapTileSize {
+				continue
+			}
+
+			steps := int(math.Ceil(math.Max(math.Abs(x1-x0), math.Abs(y1-y0)) * 2))
+			if steps < 1 {
+				steps = 1
+			}
+			for s := 0; s <= steps; s++ {
+				f := float64(s) / float64(steps)
+				grid.mark(int(math.Floor(x0+f*(x1-x0))), int(math.Floor(y0+f*(y1-y0))), r, route.userIndex)
+			}
+		}
+	}
+	return grid
+}
+
+// heatColor maps a normalized intensity to the red-yellow-white ramp
+func heatColor(v float64) color.NRGBA {
+	alpha := uint8(90 + 165*v)
+	if v < 0.5 {
+		return color.NRGBA{R: 255, G: uint8(510 * v), B: 0, A: alpha}
+	}
+	return color.NRGBA{R: 255, G: 255, B: uint8(510 * (v - 0.5)), A: alpha}
+}
+
+func renderHeatTile(grid *heatGrid, saturation, minUsers int) ([]byte, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, heatmapTileSize, heatmapTileSize))
+	logSaturation := math.Log1p(float64(saturation))
+	for i, count := range grid.counts {
+		if count == 0 || grid.users[i] < minUsers {
+			continue
+		}
+		v := math.Min(1, math.Log1p(float64(count))/logSaturation)
+		img.SetNRGBA(i%heatmapTileSize, i/heatmapTileSize, heatColor(v))
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Helper function to parse z/x/y, accepting an optional .png suffix
+func parseTileCoords(c *gin.Context) (int, int, int, bool) {
+	z, errZ := strconv.Atoi(c.Param("z"))
+	x, errX := strconv.Atoi(c.Param("x"))
+	y, errY := strconv.Atoi(strings.TrimSuffix(c.Param("y"), ".png"))
+	if errZ != nil || errX != nil || errY != nil || z < 0 || z > heatmapMaxZoom {
+		return 0, 0, 0, false
+	}
+	n := 1 << z
+	if x < 0 || y < 0 || x >= n || y >= n {
+		return 0, 0, 0, false
+	}
+	return z, x, y, true
+}
+
+// Helper function to page through route_data for one user, or for every
+// user in include (nil meaning everyone) when userID is empty. Routes come
+// back grouped by user, which heatGrid's distinct-user count relies on.
+// zones, when set, hides each user's privacy zones.
+func (s *Server) loadHeatRoutes(userID string, include map[string]bool, zones map[string][]PrivacyZone, trimMeters float64) ([]heatRoute, error) {
+	var routes []heatRoute
+	userIndex := make(map[string]int)
+	for offset := 0; ; offset += recomputePageSize {
+		query := s.supabase.From("runs").
+			Select("user_id, visibility, review_status, route_data", "", false)
+		if userID != "" {
+			query = query.Eq("user_id", userID)
+		}
+
+		result, _, err := query.
+			Order("created_at", &map[string]interface{}{"ascending": true}).
+			Range(offset, offset+recomputePageSize-1, "", false).
+			Execute()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var page []struct {
+			UserID       string `json:"user_id"`
+			Visibility   string `json:"visibility"`
+			ReviewStatus string `json:"review_status"`
+			RouteData    *Track `json:"route_data"`
+		}
+		if err := json.Unmarshal(result, &page); err != nil {
+			return nil, err
+		}
+
+		for _, run := range page {
+			if !run.RouteData.HasPoints() || (include != nil && !include[run.UserID]) {
+				continue
+			}
+			// Private runs never feed the shared heatmap, even anonymized,
+			// and neither do runs held for review or rejected
+			if userID == "" && (run.Visibility == VisibilityPrivate || run.Visibility == "" || !reviewCounts(run.ReviewStatus)) {
+				continue
+			}
+			index, ok := userIndex[run.UserID]
+			if !ok {
+				index = len(userIndex)
+				userIndex[run.UserID] = index
+			}
+			points := trimPrivatePoints(run.RouteData.Points, zones[run.UserID])
+			if route := projectRoute(points, index, trimMeters); len(route.x) > 1 {
+				routes = append(routes, route)
+			}
+		}
+
+		if len(page) < recomputePageSize {
+			sort.SliceStable(routes, func(i, j int) bool {
+				return routes[i].userIndex < routes[j].userIndex
+			})
+			return routes, nil
+		}
+	}
+}
+
+// Helper function to render (or fetch from cache) one tile of a scope
+func (s *Server) serveHeatTile(c *gin.Context, scope string, load func() ([]heatRoute, error), saturation, minUsers int) {
+	z, x, y, ok := parseTileCoords(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tile coordinates"})
+		return
+	}
+
+	tile, ok := s.heatmap.getTile(scope, z, x, y)
+	if !ok {
+		routes, cached := s.heatmap.getRoutes(scope)
+		if !cached {
+			var err error
+			routes, err = load()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load routes"})
+				return
+			}
+			s.heatmap.putRoutes(scope, routes)
+		}
+
+		var err error
+		tile, err = renderHeatTile(rasterize(routes, z, x, y), saturation, minUsers)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render tile"})
+			return
+		}
+		s.heatmap.putTile(scope, z, x, y, tile)
+	}
+
+	c.Header("Cache-Control", "private, max-age="+strconv.Itoa(int(s.heatmap.config.TileTTL.Seconds())))
+	c.Data(http.StatusOK, "image/png", tile)
+}
+
+// Personal heatmap tile of every route the user has recorded
+func (s *Server) getHeatmapTile(c *gin.Context) {
+	userID := c.GetString("user_id")
+	s.serveHeatTile(c, "user:"+userID, func() ([]heatRoute, error) {
+		return s.loadHeatRoutes(userID, nil, nil, 0)
+	}, heatmapUserSaturation, 1)
+}
+
+// Anonymized heatmap across all users, optionally for one university
+// (campus). Route ends are trimmed and sparsely used pixels hidden.
+func (s *Server) getGlobalHeatmapTile(c *gin.Context) {
+	university := c.Query("university")
+	config := s.heatmap.config
+	s.serveHeatTile(c, "global:"+university, func() ([]heatRoute, error) {
+		var include map[string]bool
+		if university != "" {
+			result, _, err := s.supabase.From("profiles").
+				Select("id", "", false).
+				Eq("university", university).
+				Execute()
+
+			if err != nil {
+				return nil, err
+			}
+
+			var profiles []struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal(result, &profiles); err != nil {
+				return nil, err
+			}
+			if len(profiles) == 0 {
+				return nil, nil
+			}
+			include = make(map[string]bool, len(profiles))
+			for _, profile := range profiles {
+				include[profile.ID] = true
+			}
+		}
+		zones, err := s.getAllPrivacyZones()
+		if err != nil {
+			return nil, err
+		}
+		return s.loadHeatRoutes("", include, zones, config.TrimMeters)
+	}, heatmapGlobalSaturation, config.MinUsers)
+}
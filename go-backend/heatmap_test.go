@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMercatorPixel(t *testing.T) {
+	tests := []struct {
+		name         string
+		lat, lng     float64
+		wantX, wantY float64
+	}{
+		{name: "null island", lat: 0, lng: 0, wantX: 128, wantY: 128},
+		{name: "north-west corner", lat: 85.05112878, lng: -180, wantX: 0, wantY: 0},
+		{name: "south-east corner", lat: -85.05112878, lng: 180, wantX: 256, wantY: 256},
+		{name: "poles are clamped", lat: 90, lng: -180, wantX: 0, wantY: 0},
+	}
+
+	for _, tt := range tests {
+		x, y := mercatorPixel(tt.lat, tt.lng)
+		if math.Abs(x-tt.wantX) > 1e-6 || math.Abs(y-tt.wantY) > 1e-6 {
+			t.Errorf("%s: mercatorPixel = %v,%v, want %v,%v", tt.name, x, y, tt.wantX, tt.wantY)
+		}
+	}
+}
+
+func TestMercatorPixelMatchesSlippyTiles(t *testing.T) {
+	// The usual OSM tile formula, which tile URLs are addressed by
+	points := []struct{ lat, lng float64 }{
+		{10.7769, 106.7009},
+		{-33.8568, 151.2153},
+		{51.5007, -0.1246},
+	}
+
+	for _, p := range points {
+		for _, z := range []int{0, 5, 12, 15, 18} {
+			n := math.Exp2(float64(z))
+			latRad := p.lat * math.Pi / 180
+			wantTX := int(math.Floor((p.lng + 180) / 360 * n))
+			wantTY := int(math.Floor((1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n))
+
+			x, y := mercatorPixel(p.lat, p.lng)
+			tx := int(math.Floor(x * n / heatmapTileSize))
+			ty := int(math.Floor(y * n / heatmapTileSize))
+			if tx != wantTX || ty != wantTY {
+				t.Errorf("%v,%v at z%d: tile %d/%d, want %d/%d", p.lat, p.lng, z, tx, ty, wantTX, wantTY)
+			}
+		}
+	}
+}
+
+func TestProjectRoute(t *testing.T) {
+	// 300 m north at 3 m/s
+	points := syntheticTrack(steady(3, 100)...)
+
+	if route := projectRoute(points, 0, 0); len(route.x) != len(points) {
+		t.Errorf("untrimmed route has %d points, want %d", len(route.x), len(points))
+	}
+	// Only fixes between 50 m and 250 m survive: 51 m to 249 m in 3 m steps
+	if route := projectRoute(points, 0, 50); len(route.x) != 67 {
+		t.Errorf("trimmed route has %d points, want 67", len(route.x))
+	}
+	if route := projectRoute(points, 0, 160); len(route.x) != 0 {
+		t.Errorf("route shorter than both trims kept %d points", len(route.x))
+	}
+
+	// A 300 m jump is a GPS gap, not a path
+	gap := syntheticTrack(append(append(steady(3, 10), 300), steady(3, 10)...)...)
+	route := projectRoute(gap, 2, 0)
+	if route.userIndex != 2 || len(route.x) != len(gap)+1 || !math.IsNaN(route.x[11]) || !math.IsNaN(route.y[11]) {
+		t.Errorf("gap not marked: user %d, %d points", route.userIndex, len(route.x))
+	}
+}
+
+func TestRasterizeCountsRoutesAndUsers(t *testing.T) {
+	outAndBack := []float64{10.2, 20.2, 10.2}
+	flat := []float64{5.5, 5.5, 5.5}
+	routes := []heatRoute{
+		{userIndex: 0, x: outAndBack, y: flat},
+		{userIndex: 0, x: outAndBack, y: flat},
+		{userIndex: 1, x: outAndBack, y: flat},
+		// Broken by a gap, so nothing is drawn between 30 and 40
+		{userIndex: 1, x: []float64{30.2, math.NaN(), 40.2}, y: []float64{5.5, math.NaN(), 5.5}},
+	}
+
+	grid := rasterize(routes, 0, 0, 0)
+	at := func(px, py int) (int, int) {
+		i := py*heatmapTileSize + px
+		return grid.counts[i], grid.users[i]
+	}
+
+	tests := []struct {
+		name            string
+		px, py          int
+		wantCount, want int
+	}{
+		{name: "crossed out and back by three routes", px: 15, py: 5, wantCount: 3, want: 2},
+		{name: "off the route", px: 15, py: 6},
+		{name: "across a gap", px: 35, py: 5},
+	}
+
+	for _, tt := range tests {
+		count, users := at(tt.px, tt.py)
+		if count != tt.wantCount || users != tt.want {
+			t.Errorf("%s: count/users = %d/%d, want %d/%d", tt.name, count, users, tt.wantCount, tt.want)
+		}
+	}
+
+	// At zoom 1 the same routes land in tile 0/0 at twice the scale and
+	// miss tile 1/0 entirely
+	grid = rasterize(routes, 1, 0, 0)
+	if count, _ := at(30, 11); count != 3 {
+		t.Errorf("zoom 1 count = %d, want 3", count)
+	}
+	grid = rasterize(routes, 1, 1, 0)
+	for i, count := range grid.counts {
+		if count != 0 {
+			t.Fatalf("tile 1/0 pixel %d has count %d, want empty", i, count)
+		}
+	}
+}
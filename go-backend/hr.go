@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Used until the user sets their own values on the profile
+	defaultMaxHeartRate     = 190
+	defaultRestingHeartRate = 60
+	// A sample is assumed to hold until the next one, but never for longer
+	// than this; longer gaps are dropouts, not time spent at that rate.
+	maxHeartRateGap = 30 * time.Second
+	// Banister TRIMP weighting factor
+	trimpWeighting = 1.92
+	// External samples are matched to GPS points within this window
+	heartRateMatchWindow = 5 * time.Second
+)
+
+// Zone boundaries as a fraction of heart-rate reserve (Karvonen)
+var heartRateZoneBounds = []float64{0.5, 0.6, 0.7, 0.8, 0.9}
+
+type HeartRateSample struct {
+	Timestamp time.Time `json:"timestamp" binding:"required"`
+	BPM       int       `json:"bpm" binding:"required,min=20,max=250"`
+}
+
+type HeartRateZone struct {
+	Zone    int `json:"zone"`
+	MinBPM  int `json:"min_bpm"`
+	MaxBPM  int `json:"max_bpm"`
+	Seconds int `json:"seconds"`
+}
+
+type HeartRateAnalysis struct {
+	MaxHeartRate     int             `json:"max_heart_rate"`
+	RestingHeartRate int             `json:"resting_heart_rate"`
+	Zones            []HeartRateZone `json:"zones"`
+	TRIMP            float64         `json:"trimp"`
+}
+
+type WeeklyLoad struct {
+	WeekStart time.Time `json:"week_start"`
+	Acute     float64   `json:"acute"`
+	Chronic   float64   `json:"chronic"`
+	Ratio     *float64  `json:"acwr"`
+	Status    string    `json:"status"`
+}
+
+// Helper function to resolve the heart-rate settings used for zones
+func heartRateSettings(profile *Profile) (int, int) {
+	maxHR, restingHR := defaultMaxHeartRate, defaultRestingHeartRate
+	if profile != nil && profile.MaxHeartRate != nil {
+		maxHR = *profile.MaxHeartRate
+	}
+	if profile != nil && profile.RestingHeartRate != nil {
+		restingHR = *profile.RestingHeartRate
+	}
+	return maxHR, restingHR
+}
+
+func pointHeartRates(points []TrackPoint) []HeartRateSample {
+	var samples []HeartRateSample
+	for _, p := range points {
+		if p.HeartRate != nil {
+			samples = append(samples, HeartRateSample{Timestamp: p.Timestamp, BPM: *p.HeartRate})
+		}
+	}
+	return samples
+}
+
+func sortHeartRateSamples(samples []HeartRateSample) {
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+}
+
+func summarizeHeartRate(samples []HeartRateSample) (*int, *int) {
+	if len(samples) == 0 {
+		return nil, nil
+	}
+	var sum, peak int
+	for _, s := range samples {
+		sum += s.BPM
+		if s.BPM > peak {
+			peak = s.BPM
+		}
+	}
+	avg := sum / len(samples)
+	return &avg, &peak
+}
+
+// mergeHeartRate attaches an external heart-rate stream (e.g. a chest
+// strap recorded separately) to GPS points that carry no reading. The
+// samples must be sorted by time.
+func mergeHeartRate(points []TrackPoint, samples []HeartRateSample) {
+	if len(samples) == 0 {
+		return
+	}
+
+	j := 0
+	for i := range points {
+		if points[i].HeartRate != nil {
+			continue
+		}
+		t := points[i].Timestamp
+		for j+1 < len(samples) && !samples[j+1].Timestamp.After(t) {
+			j++
+		}
+
+		best := -1
+		bestDiff := heartRateMatchWindow + 1
+		for _, k := range []int{j, j + 1} {
+			if k >= len(samples) {
+				continue
+			}
+			diff := samples[k].Timestamp.Sub(t)
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff < bestDiff {
+				best, bestDiff = k, diff
+			}
+		}
+		if best >= 0 && bestDiff <= heartRateMatchWindow {
+			bpm := samples[best].BPM
+			points[i].HeartRate = &bpm
+		}
+	}
+}
+
+func analyzeHeartRate(samples []HeartRateSample, maxHR, restingHR int) *HeartRateAnalysis {
+	if len(samples) < 2 || maxHR <= restingHR {
+		return nil
+	}
+
+	reserve := float64(maxHR - restingHR)
+	analysis := &HeartRateAnalysis{MaxHeartRate: maxHR, RestingHeartRate: restingHR}
+	for i, bound := range heartRateZoneBounds {
+		zone := HeartRateZone{Zone: i + 1, MinBPM: restingHR + int(math.Round(bound*reserve)), MaxBPM: maxHR}
+		if i+1 < len(heartRateZoneBounds) {
+			zone.MaxBPM = restingHR + int(math.Round(heartRateZoneBounds[i+1]*reserve)) - 1
+		}
+		analysis.Zones = append(analysis.Zones, zone)
+	}
+
+	zoneSeconds := make([]float64, len(analysis.Zones))
+	for i := 0; i+1 < len(samples); i++ {
+		dt := samples[i+1].Timestamp.Sub(samples[i].Timestamp)
+		if dt <= 0 {
+			continue
+		}
+		if dt > maxHeartRateGap {
+			dt = maxHeartRateGap
+		}
+
+		// Time below zone 1 is counted in zone 1
+		fraction := (float64(samples[i].BPM) - float64(restingHR)) / reserve
+		zone := 0
+		for z, bound := range heartRateZoneBounds {
+			if fraction >= bound {
+				zone = z
+			}
+		}
+		zoneSeconds[zone] += dt.Seconds()
+
+		// Banister TRIMP: minutes weighted by exponential intensity
+		hrr := math.Max(0, math.Min(1, fraction))
+		analysis.TRIMP += dt.Minutes() * hrr * 0.64 * math.Exp(trimpWeighting*hrr)
+	}
+
+	for i := range analysis.Zones {
+		analysis.Zones[i].Seconds = int(math.Round(zoneSeconds[i]))
+	}
+	analysis.TRIMP = math.Round(analysis.TRIMP*10) / 10
+
+	return analysis
+}
+
+// Helper function to store heart-rate analysis on a run row
+func applyHeartRate(run map[string]interface{}, samples []HeartRateSample, profile *Profile) {
+	maxHR, restingHR := heartRateSettings(profile)
+	analysis := analyzeHeartRate(samples, maxHR, restingHR)
+	if analysis == nil {
+		return
+	}
+	run["hr_zones"] = analysis
+	run["training_load"] = analysis.TRIMP
+}
+
+// Acute:chronic workload ratio per week. Acute load is the last 7 days,
+// chronic load the weekly average over the last 28 days.
+func (s *Server) getTrainingLoad(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	weeks, err := strconv.Atoi(c.DefaultQuery("weeks", "8"))
+	if err != nil || weeks < 1 || weeks > 52 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "weeks must be between 1 and 52"})
+		return
+	}
+
+	now := time.Now().UTC()
+	from := now.AddDate(0, 0, -7*(weeks+3))
+
+	result, _, err := s.supabase.From("runs").
+		Select("started_at, training_load", "", false).
+		Eq("user_id", userID).
+		Gte("started_at", from.Format(time.RFC3339)).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch runs"})
+		return
+	}
+
+	var runs []struct {
+		StartedAt    time.Time `json:"started_at"`
+		TrainingLoad *float64  `json:"training_load"`
+	}
+	if err := json.Unmarshal(result, &runs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse runs"})
+		return
+	}
+
+	loadBetween := func(from, to time.Time) float64 {
+		var total float64
+		for _, run := range runs {
+			if run.TrainingLoad != nil && !run.StartedAt.Before(from) && run.StartedAt.Before(to) {
+				total += *run.TrainingLoad
+			}
+		}
+		return total
+	}
+
+	history := make([]WeeklyLoad, 0, weeks)
+	for i := weeks - 1; i >= 0; i-- {
+		end := now.AddDate(0, 0, -7*i)
+		week := WeeklyLoad{
+			WeekStart: end.AddDate(0, 0, -7),
+			Acute:     loadBetween(end.AddDate(0, 0, -7), end),
+			Chronic:   loadBetween(end.AddDate(0, 0, -28), end) / 4,
+		}
+		week.Status = "insufficient_data"
+		if week.Chronic > 0 {
+			ratio := math.Round(week.Acute/week.Chronic*100) / 100
+			week.Ratio = &ratio
+			week.Status = workloadStatus(ratio)
+		}
+		history = append(history, week)
+	}
+
+	current := history[len(history)-1]
+	c.JSON(http.StatusOK, gin.H{
+		"current": current,
+		"weeks":   history,
+	})
+}
+
+func workloadStatus(ratio float64) string {
+	switch {
+	case ratio < 0.8:
+		return "undertraining"
+	case ratio <= 1.3:
+		return "optimal"
+	case ratio <= 1.5:
+		return "caution"
+	default:
+		return "high_risk"
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const maxImportFileSize = 20 << 20
+
+var errNoTrackPoints = errors.New("file contains no GPS track points")
+
+type ParsedActivity struct {
+	Format string
+	Name   string
+	Sport  string
+	Points []TrackPoint
+	Laps   []time.Time
+
+	fitLapStarts []time.Time
+}
+
+// GPX 1.1 with Garmin TrackPointExtension
+type gpxFile struct {
+	Tracks []struct {
+		Name     string `xml:"name"`
+		Type     string `xml:"type"`
+		Segments []struct {
+			Points []struct {
+				Lat       float64  `xml:"lat,attr"`
+				Lon       float64  `xml:"lon,attr"`
+				Ele       *float64 `xml:"ele"`
+				Time      string   `xml:"time"`
+				HeartRate *int     `xml:"extensions>TrackPointExtension>hr"`
+				Cadence   *int     `xml:"extensions>TrackPointExtension>cad"`
+				Speed     *float64 `xml:"extensions>TrackPointExtension>speed"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// Garmin Training Center XML v2
+type tcxFile struct {
+	Activities []struct {
+		Sport string `xml:"Sport,attr"`
+		ID    string `xml:"Id"`
+		Laps  []struct {
+			StartTime string `xml:"StartTime,attr"`
+			Points    []struct {
+				Time       string   `xml:"Time"`
+				Lat        *float64 `xml:"Position>LatitudeDegrees"`
+				Lng        *float64 `xml:"Position>LongitudeDegrees"`
+				Altitude   *float64 `xml:"AltitudeMeters"`
+				HeartRate  *int     `xml:"HeartRateBpm>Value"`
+				Cadence    *int     `xml:"Cadence"`
+				RunCadence *int     `xml:"Extensions>TPX>RunCadence"`
+				Speed      *float64 `xml:"Extensions>TPX>Speed"`
+			} `xml:"Track>Trackpoint"`
+		} `xml:"Lap"`
+	} `xml:"Activities>Activity"`
+}
+
+// Run file import
+func (s *Server) importRun(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportFileSize)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A GPX, TCX or FIT file is required"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read uploaded file"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read uploaded file"})
+		return
+	}
+
+	activity, err := parseActivityFile(fileHeader.Filename, data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input := &Track{
+		Points:       activity.Points,
+		Laps:         activity.Laps,
+		SourceFormat: activity.Format,
+		Sport:        activity.Sport,
+	}
+	if err := input.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The sport recorded in the file decides the type unless overridden
+	activityType := c.PostForm("activity_type")
+	if activityType == "" {
+		activityType = activityTypeForSport(activity.Sport)
+	}
+	activityRules, err := lookupActivityType(activityType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !activityRules.UsesGPS {
+		c.JSON(http.StatusBadRequest, gin.H{"error": activityRules.Name + " activities cannot include a GPS route"})
+		return
+	}
+
+	var visibility *string
+	if value := c.PostForm("visibility"); value != "" {
+		if !validVisibility(value) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid visibility"})
+			return
+		}
+		visibility = &value
+	}
+
+	processed := s.pipeline.Process(input)
+	track := processed.Track()
+	summary := activityRules.adjustSummary(processed.Summary())
+	calories := summaryCalories(currentProfile(c), activityRules, summary)
+	if err := validateRunMetrics(activityRules, summary.DistanceKm, summary.DurationSeconds, calories); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	title := c.PostForm("title")
+	if title == "" {
+		title = activity.Name
+	}
+	if title == "" {
+		title = fmt.Sprintf("%s %s", activityRules.Name, activity.Points[0].Timestamp.Format("2006-01-02"))
+	}
+
+	run := map[string]interface{}{
+		"id":              uuid.New().String(),
+		"user_id":         userID,
+		"title":           title,
+		"calories_burned": calories,
+		"visibility":      runVisibility(visibility, currentProfile(c)),
+		"provenance":      ProvenanceFileUpload,
+		"created_at":      time.Now().UTC(),
+	}
+	applyTrackSummary(run, summary)
+	applyActivity(run, activityRules, summary.DistanceKm, summary.MovingSeconds)
+	applyRunSplits(run, processed)
+	applyHeartRate(run, pointHeartRates(processed.Points), currentProfile(c))
+	efforts := applyBestEfforts(run, activityRules, processed.Points)
+	s.applySuspicion(run, activityRules, activity.Points, runTiming{})
+	applyTrack(run, track)
+
+	createdRun, err := s.saveRun(run)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create run"})
+		return
+	}
+
+	go s.matchRunSegments(userID, run["id"].(string), activityRules, track.Points)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"run":                 createdRun,
+		"summary":             summary,
+		"new_records":         s.detectPersonalRecords(userID, run, efforts),
+		"possible_duplicates": s.possibleDuplicates(userID, run["id"].(string)),
+	})
+}
+
+// Helper function to pick a parser from the file extension, falling back
+// to sniffing the content for files without one.
+func parseActivityFile(filename string, data []byte) (*ParsedActivity, error) {
+	var activity *ParsedActivity
+	var err error
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gpx":
+		activity, err = parseGPX(data)
+	case ".tcx":
+		activity, err = parseTCX(data)
+	case ".fit":
+		activity, err = parseFIT(data)
+	default:
+		switch {
+		case len(data) >= 12 && string(data[8:12]) == ".FIT":
+			activity, err = parseFIT(data)
+		case bytes.Contains(data[:min(len(data), 1024)], []byte("<gpx")):
+			activity, err = parseGPX(data)
+		case bytes.Contains(data[:min(len(data), 1024)], []byte("<TrainingCenterDatabase")):
+			activity, err = parseTCX(data)
+		default:
+			return nil, errors.New("unsupported file format, expected GPX, TCX or FIT")
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(activity.Points, func(i, j int) bool {
+		return activity.Points[i].Timestamp.Before(activity.Points[j].Timestamp)
+	})
+
+	if len(activity.Points) < 2 {
+		return nil, errNoTrackPoints
+	}
+
+	return activity, nil
+}
+
+func parseGPX(data []byte) (*ParsedActivity, error) {
+	var doc gpxFile
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid GPX file: %w", err)
+	}
+
+	activity := &ParsedActivity{Format: "gpx"}
+	for _, trk := range doc.Tracks {
+		if activity.Name == "" {
+			activity.Name = strings.TrimSpace(trk.Name)
+			activity.Sport = strings.TrimSpace(trk.Type)
+		}
+		for _, seg := range trk.Segments {
+			for _, pt := range seg.Points {
+				ts, err := time.Parse(time.RFC3339, strings.TrimSpace(pt.Time))
+				if err != nil {
+					continue
+				}
+				activity.Points = append(activity.Points, TrackPoint{
+					Lat:       pt.Lat,
+					Lng:       pt.Lon,
+					Timestamp: ts.UTC(),
+					Altitude:  pt.Ele,
+					Speed:     pt.Speed,
+					HeartRate: pt.HeartRate,
+					Cadence:   pt.Cadence,
+				})
+			}
+		}
+	}
+
+	return activity, nil
+}
+
+func parseTCX(data []byte) (*ParsedActivity, error) {
+	var doc tcxFile
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid TCX file: %w", err)
+	}
+
+	activity := &ParsedActivity{Format: "tcx"}
+	for _, act := range doc.Activities {
+		if activity.Sport == "" {
+			activity.Sport = act.Sport
+		}
+		for i, lap := range act.Laps {
+			// Every lap after the first marks a lap-button press
+			if i > 0 {
+				if start, err := time.Parse(time.RFC3339, strings.TrimSpace(lap.StartTime)); err == nil {
+					activity.Laps = append(activity.Laps, start.UTC())
+				}
+			}
+			for _, pt := range lap.Points {
+				// Trackpoints without a position (e.g. GPS still locking)
+				// carry no route information.
+				if pt.Lat == nil || pt.Lng == nil {
+					continue
+				}
+				ts, err := time.Parse(time.RFC3339, strings.TrimSpace(pt.Time))
+				if err != nil {
+					continue
+				}
+				cadence := pt.RunCadence
+				if cadence == nil {
+					cadence = pt.Cadence
+				}
+				activity.Points = append(activity.Points, TrackPoint{
+					Lat:       *pt.Lat,
+					Lng:       *pt.Lng,
+					Timestamp: ts.UTC(),
+					Altitude:  pt.Altitude,
+					Speed:     pt.Speed,
+					HeartRate: pt.HeartRate,
+					Cadence:   cadence,
+				})
+			}
+		}
+	}
+
+	return activity, nil
+}
+
+// FIT constants from the Garmin FIT SDK profile
+const (
+	fitMesgSession = 18
+	fitMesgLap     = 19
+	fitMesgRecord  = 20
+
+	fitFieldTimestamp        = 253
+	fitFieldPositionLat      = 0
+	fitFieldPositionLong     = 1
+	fitFieldAltitude         = 2
+	fitFieldHeartRate        = 3
+	fitFieldCadence          = 4
+	fitFieldSpeed            = 6
+	fitFieldEnhancedSpeed    = 73
+	fitFieldEnhancedAltitude = 78
+	fitFieldSessionSport     = 5
+	fitFieldLapStartTime     = 2
+)
+
+// Seconds between the Unix epoch and the FIT epoch (1989-12-31T00:00:00Z)
+const fitEpochOffset = 631065600
+
+type fitFieldDef struct {
+	num  byte
+	size int
+}
+
+type fitDefinition struct {
+	global    uint16
+	order     binary.ByteOrder
+	fields    []fitFieldDef
+	devSize   int
+	totalSize int
+}
+
+var fitSports = map[uint64]string{
+	1:  "running",
+	2:  "cycling",
+	11: "walking",
+	17: "hiking",
+}
+
+func parseFIT(data []byte) (*ParsedActivity, error) {
+	if len(data) < 12 {
+		return nil, errors.New("invalid FIT file: too short")
+	}
+
+	headerSize := int(data[0])
+	if headerSize < 12 || len(data) < headerSize || string(data[8:12]) != ".FIT" {
+		return nil, errors.New("invalid FIT file: bad header")
+	}
+
+	dataEnd := headerSize + int(binary.LittleEndian.Uint32(data[4:8]))
+	if dataEnd > len(data) {
+		return nil, errors.New("invalid FIT file: truncated")
+	}
+
+	activity := &ParsedActivity{Format: "fit"}
+	definitions := make(map[byte]*fitDefinition)
+	var lastTimestamp uint32
+
+	pos := headerSize
+	for pos < dataEnd {
+		header := data[pos]
+		pos++
+
+		// Compressed timestamp header: 2-bit local type, 5-bit time offset
+		if header&0x80 != 0 {
+			local := (header >> 5) & 0x03
+			offset := uint32(header & 0x1F)
+			ts := (lastTimestamp &^ 0x1F) + offset
+			if offset < lastTimestamp&0x1F {
+				ts += 0x20
+			}
+			lastTimestamp = ts
+
+			def, ok := definitions[local]
+			if !ok || pos+def.totalSize > dataEnd {
+				return nil, errors.New("invalid FIT file: undefined message")
+			}
+			values := readFITFields(def, data[pos:pos+def.totalSize])
+			values[fitFieldTimestamp] = uint64(ts)
+			activity.addFITMessage(def.global, values)
+			pos += def.totalSize
+			continue
+		}
+
+		local := header & 0x0F
+
+		if header&0x40 != 0 {
+			if pos+5 > dataEnd {
+				return nil, errors.New("invalid FIT file: truncated definition")
+			}
+			def := &fitDefinition{order: binary.LittleEndian}
+			if data[pos+1] == 1 {
+				def.order = binary.BigEndian
+			}
+			def.global = def.order.Uint16(data[pos+2 : pos+4])
+			numFields := int(data[pos+4])
+			pos += 5
+
+			if pos+numFields*3 > dataEnd {
+				return nil, errors.New("invalid FIT file: truncated definition")
+			}
+			for i := 0; i < numFields; i++ {
+				field := fitFieldDef{num: data[pos], size: int(data[pos+1])}
+				def.fields = append(def.fields, field)
+				def.totalSize += field.size
+				pos += 3
+			}
+
+			// Developer data fields are skipped but must be accounted for
+			if header&0x20 != 0 {
+				if pos >= dataEnd {
+					return nil, errors.New("invalid FIT file: truncated definition")
+				}
+				numDev := int(data[pos])
+				pos++
+				if pos+numDev*3 > dataEnd {
+					return nil, errors.New("invalid FIT file: truncated definition")
+				}
+				for i := 0; i < numDev; i++ {
+					def.devSize += int(data[pos+1])
+					pos += 3
+				}
+				def.totalSize += def.devSize
+			}
+
+			definitions[local] = def
+			continue
+		}
+
+		def, ok := definitions[local]
+		if !ok || pos+def.totalSize > dataEnd {
+			return nil, errors.New("invalid FIT file: undefined message")
+		}
+		values := readFITFields(def, data[pos:pos+def.totalSize])
+		if ts, ok := values[fitFieldTimestamp]; ok {
+			lastTimestamp = uint32(ts)
+		}
+		activity.addFITMessage(def.global, values)
+		pos += def.totalSize
+	}
+
+	// Lap messages are written when a lap ends, so sort their start times
+	// and drop the first, which is the start of the activity.
+	sort.Slice(activity.fitLapStarts, func(i, j int) bool {
+		return activity.fitLapStarts[i].Before(activity.fitLapStarts[j])
+	})
+	if len(activity.fitLapStarts) > 1 {
+		activity.Laps = activity.fitLapStarts[1:]
+	}
+
+	return activity, nil
+}
+
+// Helper function to decode the scalar fields of a data message. Invalid
+// (all ones / 0x7F..) values are omitted from the result.
+func readFITFields(def *fitDefinition, raw []byte) map[byte]uint64 {
+	values := make(map[byte]uint64)
+	offset := 0
+	for _, field := range def.fields {
+		b := raw[offset : offset+field.size]
+		offset += field.size
+
+		var v, invalid uint64
+		switch field.size {
+		case 1:
+			v, invalid = uint64(b[0]), 0xFF
+		case 2:
+			v, invalid = uint64(def.order.Uint16(b)), 0xFFFF
+		case 4:
+			v, invalid = uint64(def.order.Uint32(b)), 0xFFFFFFFF
+		default:
+			continue
+		}
+
+		if v == invalid || (field.size == 4 && v == 0x7FFFFFFF) {
+			continue
+		}
+		values[field.num] = v
+	}
+	return values
+}
+
+func (a *ParsedActivity) addFITMessage(global uint16, values map[byte]uint64) {
+	switch global {
+	case fitMesgSession:
+		if sport, ok := values[fitFieldSessionSport]; ok && a.Sport == "" {
+			a.Sport = fitSports[sport]
+		}
+	case fitMesgLap:
+		if start, ok := values[fitFieldLapStartTime]; ok {
+			a.fitLapStarts = append(a.fitLapStarts, time.Unix(int64(start)+fitEpochOffset, 0).UTC())
+		}
+	case fitMesgRecord:
+		lat, okLat := values[fitFieldPositionLat]
+		lng, okLng := values[fitFieldPositionLong]
+		ts, okTs := values[fitFieldTimestamp]
+		if !okLat || !okLng || !okTs {
+			return
+		}
+
+		point := TrackPoint{
+			Lat:       semicirclesToDegrees(lat),
+			Lng:       semicirclesToDegrees(lng),
+			Timestamp: time.Unix(int64(ts)+fitEpochOffset, 0).UTC(),
+		}
+
+		if alt, ok := values[fitFieldEnhancedAltitude]; ok {
+			v := float64(alt)/5 - 500
+			point.Altitude = &v
+		} else if alt, ok := values[fitFieldAltitude]; ok {
+			v := float64(alt)/5 - 500
+			point.Altitude = &v
+		}
+		if speed, ok := values[fitFieldEnhancedSpeed]; ok {
+			v := float64(speed) / 1000
+			point.Speed = &v
+		} else if speed, ok := values[fitFieldSpeed]; ok {
+			v := float64(speed) / 1000
+			point.Speed = &v
+		}
+		if hr, ok := values[fitFieldHeartRate]; ok {
+			v := int(hr)
+			point.HeartRate = &v
+		}
+		if cad, ok := values[fitFieldCadence]; ok {
+			v := int(cad)
+			point.Cadence = &v
+		}
+
+		a.Points = append(a.Points, point)
+	}
+}
+
+func semicirclesToDegrees(v uint64) float64 {
+	return float64(int32(uint32(v))) * (180.0 / 2147483648.0)
+}
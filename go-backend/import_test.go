@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// fitBuilder writes just enough of the FIT binary format to exercise
+// parseFIT: little-endian definitions and data messages after a 12-byte
+// header
+type fitBuilder struct {
+	body bytes.Buffer
+}
+
+func (b *fitBuilder) define(local byte, global uint16, fields ...[2]byte) {
+	b.body.WriteByte(0x40 | local)
+	b.body.Write([]byte{0, 0})
+	binary.Write(&b.body, binary.LittleEndian, global)
+	b.body.WriteByte(byte(len(fields)))
+	for _, field := range fields {
+		// Base type isn't read by the parser
+		b.body.Write([]byte{field[0], field[1], 0})
+	}
+}
+
+func (b *fitBuilder) message(header byte, values ...interface{}) {
+	b.body.WriteByte(header)
+	for _, v := range values {
+		binary.Write(&b.body, binary.LittleEndian, v)
+	}
+}
+
+func (b *fitBuilder) bytes() []byte {
+	var file bytes.Buffer
+	file.Write([]byte{12, 0x10, 0, 0})
+	binary.Write(&file, binary.LittleEndian, uint32(b.body.Len()))
+	file.WriteString(".FIT")
+	file.Write(b.body.Bytes())
+	return file.Bytes()
+}
+
+func degreesToSemicircles(degrees float64) int32 {
+	return int32(math.Round(degrees * 2147483648.0 / 180))
+}
+
+func TestParseFITCompressedTimestamps(t *testing.T) {
+	// The low five bits are 30, so an offset of 2 has to roll over
+	base := uint32(1_000_000_030)
+
+	var b fitBuilder
+	b.define(0, fitMesgRecord,
+		[2]byte{fitFieldTimestamp, 4}, [2]byte{fitFieldPositionLat, 4}, [2]byte{fitFieldPositionLong, 4}, [2]byte{fitFieldHeartRate, 1})
+	b.define(1, fitMesgRecord,
+		[2]byte{fitFieldPositionLat, 4}, [2]byte{fitFieldPositionLong, 4}, [2]byte{fitFieldHeartRate, 1})
+	b.define(2, fitMesgSession, [2]byte{fitFieldSessionSport, 1})
+
+	b.message(0x00, base, degreesToSemicircles(10.7769), degreesToSemicircles(106.7009), uint8(140))
+	// Compressed header: bit 7 set, local type 1, 5-bit time offset
+	b.message(0x80|1<<5|31, degreesToSemicircles(10.7770), degreesToSemicircles(106.7010), uint8(142))
+	b.message(0x80|1<<5|2, degreesToSemicircles(10.7771), degreesToSemicircles(106.7011), uint8(0xFF))
+	b.message(0x02, uint8(2))
+
+	activity, err := parseFIT(b.bytes())
+	if err != nil {
+		t.Fatalf("parseFIT: %v", err)
+	}
+
+	fitEpoch := time.Date(1989, 12, 31, 0, 0, 0, 0, time.UTC)
+	want := []time.Time{
+		fitEpoch.Add(time.Duration(base) * time.Second),
+		fitEpoch.Add(time.Duration(base+1) * time.Second),
+		fitEpoch.Add(time.Duration(base+4) * time.Second),
+	}
+	if len(activity.Points) != len(want) {
+		t.Fatalf("parsed %d points, want %d", len(activity.Points), len(want))
+	}
+	for i, ts := range want {
+		if !activity.Points[i].Timestamp.Equal(ts) {
+			t.Errorf("point %d timestamp = %v, want %v", i, activity.Points[i].Timestamp, ts)
+		}
+	}
+
+	if got := activity.Points[1].Lat; math.Abs(got-10.7770) > 1e-6 {
+		t.Errorf("point 1 lat = %v, want 10.7770", got)
+	}
+	if hr := activity.Points[1].HeartRate; hr == nil || *hr != 142 {
+		t.Errorf("point 1 heart rate = %v, want 142", hr)
+	}
+	if hr := activity.Points[2].HeartRate; hr != nil {
+		t.Errorf("invalid heart rate decoded as %d", *hr)
+	}
+	if activity.Sport != "cycling" {
+		t.Errorf("sport = %q, want cycling", activity.Sport)
+	}
+}
+
+func TestParseFITRejectsBadFiles(t *testing.T) {
+	var undefined fitBuilder
+	undefined.message(0x03, uint8(1))
+
+	tests := map[string][]byte{
+		"too short":         []byte(".FIT"),
+		"bad header":        append([]byte{12, 0x10, 0, 0, 0, 0, 0, 0}, []byte("NOPE")...),
+		"truncated":         append([]byte{12, 0x10, 0, 0, 100, 0, 0, 0}, []byte(".FIT")...),
+		"undefined message": undefined.bytes(),
+	}
+
+	for name, data := range tests {
+		if _, err := parseFIT(data); err == nil {
+			t.Errorf("%s: parseFIT succeeded, want an error", name)
+		}
+	}
+}
+
+func TestParseActivityFileSniffsFormat(t *testing.T) {
+	gpx := []byte(`<?xml version="1.0"?>
+<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1" xmlns:gpxtpx="http://www.garmin.com/xmlschemas/TrackPointExtension/v1">
+  <trk><name>Morning Run</name><type>running</type><trkseg>
+    <trkpt lat="10.7769" lon="106.7009"><time>2024-03-10T05:30:00Z</time>
+      <extensions><gpxtpx:TrackPointExtension><gpxtpx:hr>150</gpxtpx:hr><gpxtpx:cad>86</gpxtpx:cad></gpxtpx:TrackPointExtension></extensions></trkpt>
+    <trkpt lat="10.7772" lon="106.7013"><time>2024-03-10T05:30:05Z</time></trkpt>
+  </trkseg></trk>
+</gpx>`)
+
+	activity, err := parseActivityFile("upload", gpx)
+	if err != nil {
+		t.Fatalf("parseActivityFile: %v", err)
+	}
+	if activity.Format != "gpx" || activity.Name != "Morning Run" || activity.Sport != "running" {
+		t.Errorf("parsed %q %q %q, want gpx, Morning Run, running", activity.Format, activity.Name, activity.Sport)
+	}
+	if len(activity.Points) != 2 {
+		t.Fatalf("parsed %d points, want 2", len(activity.Points))
+	}
+	if cad := activity.Points[0].Cadence; cad == nil || *cad != 86 {
+		t.Errorf("cadence = %v, want 86", cad)
+	}
+
+	if _, err := parseActivityFile("notes.txt", []byte("hello")); err == nil {
+		t.Error("parseActivityFile accepted a text file")
+	}
+}
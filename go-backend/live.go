@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Events queued per follower before the oldest are dropped
+	liveBufferSize = 32
+	// Followers who fall this many events behind are disconnected
+	liveMaxDropped     = 256
+	liveMaxSubscribers = 200
+	liveHeartbeat      = 15 * time.Second
+	// Positions replayed to a follower who joins mid-run
+	liveSnapshotPositions = 500
+)
+
+type LiveEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type LiveSnapshot struct {
+	SessionID       string       `json:"session_id"`
+	RunnerName      string       `json:"runner_name"`
+	Title           string       `json:"title"`
+	ActivityType    string       `json:"activity_type"`
+	Status          string       `json:"status"`
+	StartedAt       time.Time    `json:"started_at"`
+	DistanceKm      float64      `json:"distance_km"`
+	DurationSeconds int          `json:"duration_seconds"`
+	Positions       []TrackPoint `json:"positions"`
+}
+
+type liveSubscriber struct {
+	events  chan LiveEvent
+	done    chan struct{}
+	dropped int
+}
+
+// LiveHub fans live session events out to followers' streams. Each
+// follower has a small buffer; when a slow connection fills it the oldest
+// event is dropped (positions are superseded anyway), and followers that
+// keep falling behind are disconnected rather than holding up the runner.
+type LiveHub struct {
+	mu       sync.Mutex
+	sessions map[string]map[*liveSubscriber]struct{}
+}
+
+func NewLiveHub() *LiveHub {
+	return &LiveHub{sessions: make(map[string]map[*liveSubscriber]struct{})}
+}
+
+func (h *LiveHub) subscribe(sessionID string) (*liveSubscriber, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subscribers := h.sessions[sessionID]
+	if len(subscribers) >= liveMaxSubscribers {
+		return nil, false
+	}
+	if subscribers == nil {
+		subscribers = make(map[*liveSubscriber]struct{})
+		h.sessions[sessionID] = subscribers
+	}
+
+	sub := &liveSubscriber{
+		events: make(chan LiveEvent, liveBufferSize),
+		done:   make(chan struct{}),
+	}
+	subscribers[sub] = struct{}{}
+	return sub, true
+}
+
+func (h *LiveHub) unsubscribe(sessionID string, sub *liveSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(sessionID, sub)
+}
+
+func (h *LiveHub) removeLocked(sessionID string, sub *liveSubscriber) {
+	subscribers, ok := h.sessions[sessionID]
+	if !ok {
+		return
+	}
+	if _, ok := subscribers[sub]; !ok {
+		return
+	}
+	delete(subscribers, sub)
+	close(sub.done)
+	if len(subscribers) == 0 {
+		delete(h.sessions, sessionID)
+	}
+}
+
+// publish never blocks the runner's request
+func (h *LiveHub) publish(sessionID string, event LiveEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.sessions[sessionID] {
+		select {
+		case sub.events <- event:
+			continue
+		default:
+		}
+
+		// Buffer full: make room by dropping the oldest queued event
+		select {
+		case <-sub.events:
+			sub.dropped++
+		default:
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped++
+		}
+
+		if sub.dropped > liveMaxDropped {
+			h.removeLocked(sessionID, sub)
+		}
+	}
+}
+
+// closeSession sends a final event and ends every follower's stream
+func (h *LiveHub) closeSession(sessionID string, event LiveEvent) {
+	h.publish(sessionID, event)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.sessions[sessionID] {
+		h.removeLocked(sessionID, sub)
+	}
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Create (or rotate) the share token followers use to watch a session.
+// Rotating revokes the previous link.
+func (s *Server) shareRunSession(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	session, err := s.getRunSession(c.Param("id"), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run session not found"})
+		return
+	}
+
+	if session.Status != "active" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Run session is not active"})
+		return
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share token"})
+		return
+	}
+
+	_, _, err = s.supabase.From("run_sessions").
+		Update(map[string]interface{}{
+			"share_token": token,
+			"updated_at":  time.Now().UTC(),
+		}, "", "").
+		Eq("id", session.ID).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share token"})
+		return
+	}
+
+	// Followers of the old link are cut off
+	s.live.closeSession(session.ID, LiveEvent{Type: "revoked"})
+
+	c.JSON(http.StatusOK, gin.H{
+		"share_token": token,
+		"stream_url":  "/api/live/" + token + "/stream",
+	})
+}
+
+// Stop sharing a session
+func (s *Server) unshareRunSession(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	session, err := s.getRunSession(c.Param("id"), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run session not found"})
+		return
+	}
+
+	_, _, err = s.supabase.From("run_sessions").
+		Update(map[string]interface{}{
+			"share_token": nil,
+			"updated_at":  time.Now().UTC(),
+		}, "", "").
+		Eq("id", session.ID).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share token"})
+		return
+	}
+
+	s.live.closeSession(session.ID, LiveEvent{Type: "revoked"})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Live sharing stopped"})
+}
+
+func (s *Server) getSharedSession(token string) (*RunSession, error) {
+	var session RunSession
+
+	result, _, err := s.supabase.From("run_sessions").
+		Select("*", "", false).
+		Eq("share_token", token).
+		Single().
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(result, &session); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// Helper function to build what a follower sees when they open the link
+func (s *Server) liveSnapshot(session *RunSession) (*LiveSnapshot, error) {
+	positions, err := s.getSessionPositions(session.ID)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := s.getUserPrivacyZones(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	positions = trimPrivatePoints(positions, zones)
+	if len(positions) > liveSnapshotPositions {
+		positions = positions[len(positions)-liveSnapshotPositions:]
+	}
+
+	snapshot := &LiveSnapshot{
+		SessionID:       session.ID,
+		Title:           session.Title,
+		ActivityType:    storedActivityType(session.ActivityType).ID,
+		Status:          session.Status,
+		StartedAt:       session.StartedAt,
+		DistanceKm:      session.DistanceKm,
+		DurationSeconds: session.DurationSeconds,
+		Positions:       positions,
+	}
+	if profile, err := s.getUserProfile(session.UserID); err == nil {
+		snapshot.RunnerName = profile.FullName
+	}
+	return snapshot, nil
+}
+
+// Current state of a shared session, for followers that poll
+func (s *Server) getLiveSession(c *gin.Context) {
+	session, err := s.getSharedSession(c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Live run not found"})
+		return
+	}
+
+	// The recording is only shared while the run is live; afterwards the
+	// run's own visibility applies
+	if session.Status != "active" {
+		c.JSON(http.StatusGone, gin.H{"error": "Run has finished", "run_id": session.RunID})
+		return
+	}
+
+	snapshot, err := s.liveSnapshot(session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch live run"})
+		return
+	}
+
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// Server-Sent Events stream of a shared session: a snapshot first, then
+// position, lap and end events as the runner's client pushes them.
+func (s *Server) streamLiveSession(c *gin.Context) {
+	session, err := s.getSharedSession(c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Live run not found"})
+		return
+	}
+
+	if session.Status != "active" {
+		c.JSON(http.StatusGone, gin.H{"error": "Run has finished", "run_id": session.RunID})
+		return
+	}
+
+	// Subscribe before reading the snapshot so nothing falls in between
+	sub, ok := s.live.subscribe(session.ID)
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many followers for this run"})
+		return
+	}
+	defer s.live.unsubscribe(session.ID, sub)
+
+	snapshot, err := s.liveSnapshot(session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch live run"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("snapshot", snapshot)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-sub.events:
+			c.SSEvent(event.Type, event.Data)
+			return event.Type != "end"
+		case <-sub.done:
+			// Drain whatever was queued before the hub let go, e.g. "end"
+			for {
+				select {
+				case event := <-sub.events:
+					c.SSEvent(event.Type, event.Data)
+				default:
+					return false
+				}
+			}
+		case <-heartbeat.C:
+			c.SSEvent("ping", time.Now().UTC())
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// Helper function for the runner's endpoints to notify followers
+func (s *Server) publishLive(sessionID, eventType string, data interface{}) {
+	s.live.publish(sessionID, LiveEvent{Type: eventType, Data: data})
+}
+
+func (s *Server) endLive(sessionID string, data interface{}) {
+	s.live.closeSession(sessionID, LiveEvent{Type: "end", Data: data})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain-text emails to users
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type MailConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func loadMailConfig() MailConfig {
+	return MailConfig{
+		Host:     envString("SMTP_HOST", ""),
+		Port:     envString("SMTP_PORT", "587"),
+		Username: envString("SMTP_USERNAME", ""),
+		Password: envString("SMTP_PASSWORD", ""),
+		From:     envString("MAIL_FROM", "VSM <no-reply@vsm.local>"),
+	}
+}
+
+// NewMailer sends through SMTP when a host is configured and otherwise
+// only logs the emails, which is enough for local development
+func NewMailer(config MailConfig) Mailer {
+	if config.Host == "" {
+		return logMailer{}
+	}
+	return &smtpMailer{config: config}
+}
+
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+type smtpMailer struct {
+	config MailConfig
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.config.Username != "" {
+		auth = smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)
+	}
+
+	from := m.config.From
+	if start, end := strings.LastIndex(from, "<"), strings.LastIndex(from, ">"); start >= 0 && end > start {
+		from = from[start+1 : end]
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", m.config.From)
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	addr := net.JoinHostPort(m.config.Host, m.config.Port)
+	return smtp.SendMail(addr, auth, from, []string{to}, []byte(message.String()))
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -12,8 +13,19 @@ import (
 )
 
 type Server struct {
-	supabase *supabase.Client
-	router   *gin.Engine
+	supabase   *supabase.Client
+	router     *gin.Engine
+	pipeline   TrackPipeline
+	heatmap    *HeatmapCache
+	live       *LiveHub
+	antiCheat  AntiCheatConfig
+	provenance ProvenanceRules
+	sync       SyncConfig
+	strava     StravaConfig
+	providers  map[string]ActivityProvider
+	events     EventConfig
+	eventLocks *EventLocks
+	mailer     Mailer
 }
 
 func NewServer() *Server {
@@ -48,8 +60,29 @@ func NewServer() *Server {
 	}))
 
 	server := &Server{
-		supabase: client,
-		router:   router,
+		supabase:   client,
+		router:     router,
+		pipeline:   loadTrackPipeline(),
+		heatmap:    NewHeatmapCache(loadHeatmapConfig()),
+		live:       NewLiveHub(),
+		antiCheat:  loadAntiCheatConfig(),
+		provenance: loadProvenanceRules(),
+		sync:       loadSyncConfig(),
+		strava:     loadStravaConfig(),
+		providers:  make(map[string]ActivityProvider),
+		events:     loadEventConfig(),
+		eventLocks: NewEventLocks(),
+		mailer:     NewMailer(loadMailConfig()),
+	}
+
+	if server.strava.ClientID != "" {
+		server.providers["strava"] = NewStravaClient(server.strava)
+	}
+	if len(server.providers) > 0 && server.sync.BackfillInterval > 0 {
+		go server.runSyncBackfill()
+	}
+	if server.events.StatusInterval > 0 {
+		go server.runEventStatusTicker()
 	}
 
 	server.setupRoutes()
@@ -67,6 +100,7 @@ func (s *Server) setupRoutes() {
 		auth.POST("/register", s.register)
 		auth.POST("/logout", s.logout)
 		auth.GET("/me", s.authMiddleware(), s.getCurrentUser)
+		auth.PUT("/me", s.authMiddleware(), s.updateProfile)
 	}
 
 	// User management (Admin only)
@@ -75,9 +109,12 @@ func (s *Server) setupRoutes() {
 	{
 		admin.GET("/users", s.getAllUsers)
 		admin.PUT("/users/:id/role", s.updateUserRole)
+		admin.PUT("/users/:id/university", s.verifyUserUniversity)
 		admin.DELETE("/users/:id", s.deleteUser)
 		admin.GET("/revenue", s.getRevenueStats)
 		admin.GET("/orders", s.getAllOrders)
+		admin.GET("/heatmap/:z/:x/:y", s.getGlobalHeatmapTile)
+		admin.POST("/connections/strava/subscription", s.createStravaSubscription)
 	}
 
 	// CMS routes (Editor and Admin)
@@ -90,11 +127,22 @@ func (s *Server) setupRoutes() {
 		cms.DELETE("/posts/:id", s.deleteBlogPost)
 		cms.POST("/posts/:id/publish", s.publishBlogPost)
 		
+		cms.GET("/events", s.getManagedEvents)
+		cms.GET("/events/:id", s.getManagedEvent)
+		cms.POST("/events", s.createEvent)
+		cms.PUT("/events/:id", s.updateEvent)
+		cms.POST("/events/:id/cancel", s.cancelEvent)
+		cms.POST("/events/:id/archive", s.archiveEvent)
+		cms.GET("/events/:id/registrations", s.getEventRegistrations)
+
 		cms.GET("/orders", s.getOrders)
 		cms.PUT("/orders/:id", s.updateOrderStatus)
 		
 		cms.GET("/support", s.getSupportTickets)
 		cms.PUT("/support/:id", s.respondToTicket)
+
+		cms.GET("/runs/review", s.getRunReviewQueue)
+		cms.PUT("/runs/:id/review", s.reviewRun)
 	}
 
 	// Public API routes
@@ -103,10 +151,73 @@ func (s *Server) setupRoutes() {
 		api.GET("/posts", s.getPublishedPosts)
 		api.GET("/posts/:slug", s.getPostBySlug)
 		api.GET("/events", s.getEvents)
+		api.GET("/events/:id", s.getEvent)
+		api.POST("/events/:id/registration", s.authMiddleware(), s.registerForEvent)
+		api.GET("/events/:id/registration", s.authMiddleware(), s.getEventRegistration)
+		api.DELETE("/events/:id/registration", s.authMiddleware(), s.cancelEventRegistration)
+		api.GET("/activity-types", s.getActivityTypes)
 		api.POST("/support", s.authMiddleware(), s.createSupportTicket)
 		api.POST("/orders", s.authMiddleware(), s.createOrder)
 		api.GET("/runs", s.authMiddleware(), s.getUserRuns)
 		api.POST("/runs", s.authMiddleware(), s.createRun)
+		api.POST("/runs/manual", s.authMiddleware(), s.createManualRun)
+		api.POST("/runs/import", s.authMiddleware(), s.importRun)
+		api.GET("/runs/export", s.authMiddleware(), s.exportAllRuns)
+		api.GET("/runs/training-load", s.authMiddleware(), s.requirePremium(), s.getTrainingLoad)
+		api.GET("/runs/records", s.authMiddleware(), s.getPersonalRecords)
+		api.GET("/runs/summary", s.authMiddleware(), s.getRunSummary)
+		api.GET("/runs/duplicates", s.authMiddleware(), s.getDuplicateRuns)
+		api.POST("/runs/duplicates/merge", s.authMiddleware(), s.mergeDuplicateRuns)
+		api.POST("/runs/duplicates/merge-all", s.authMiddleware(), s.mergeAllDuplicateRuns)
+		api.GET("/runs/heatmap/:z/:x/:y", s.authMiddleware(), s.getHeatmapTile)
+		api.GET("/runs/:id/export", s.authMiddleware(), s.exportRun)
+		api.GET("/runs/:id", s.authMiddleware(), s.getRunDetail)
+		api.PUT("/runs/:id", s.authMiddleware(), s.updateRun)
+		api.DELETE("/runs/:id", s.authMiddleware(), s.deleteRun)
+		api.GET("/segments", s.authMiddleware(), s.getSegments)
+		api.POST("/segments", s.authMiddleware(), s.createSegment)
+		api.GET("/segments/:id", s.authMiddleware(), s.getSegment)
+		api.DELETE("/segments/:id", s.authMiddleware(), s.deleteSegment)
+		api.GET("/segments/:id/leaderboard", s.authMiddleware(), s.getSegmentLeaderboard)
+		api.GET("/privacy-zones", s.authMiddleware(), s.getPrivacyZones)
+		api.POST("/privacy-zones", s.authMiddleware(), s.createPrivacyZone)
+		api.DELETE("/privacy-zones/:id", s.authMiddleware(), s.deletePrivacyZone)
+		api.GET("/feed", s.authMiddleware(), s.getFeed)
+		api.GET("/users/:id/runs", s.authMiddleware(), s.getProfileRuns)
+		api.POST("/users/:id/follow", s.authMiddleware(), s.followUser)
+		api.DELETE("/users/:id/follow", s.authMiddleware(), s.unfollowUser)
+		api.GET("/connections", s.authMiddleware(), s.getConnections)
+		api.GET("/connections/:provider/authorize", s.authMiddleware(), s.authorizeConnection)
+		api.POST("/connections/:provider", s.authMiddleware(), s.connectProvider)
+		api.POST("/connections/:provider/sync", s.authMiddleware(), s.syncConnection)
+		api.DELETE("/connections/:provider", s.authMiddleware(), s.disconnectProvider)
+	}
+
+	// Third-party webhooks, authenticated by the provider's own handshake
+	webhooks := s.router.Group("/api/webhooks")
+	{
+		webhooks.GET("/strava", s.verifyStravaWebhook)
+		webhooks.POST("/strava", s.handleStravaWebhook)
+	}
+
+	// Live GPS run sessions
+	sessions := s.router.Group("/api/runs/sessions")
+	sessions.Use(s.authMiddleware())
+	{
+		sessions.POST("", s.startRunSession)
+		sessions.GET("/:id", s.getRunSessionStatus)
+		sessions.POST("/:id/positions", s.pushPositions)
+		sessions.POST("/:id/laps", s.markLap)
+		sessions.POST("/:id/end", s.endRunSession)
+		sessions.POST("/:id/share", s.shareRunSession)
+		sessions.DELETE("/:id/share", s.unshareRunSession)
+	}
+
+	// Live tracking for followers holding a share token
+	live := s.router.Group("/api/live")
+	{
+		live.GET("/:token", s.getLiveSession)
+		live.GET("/:token/stream", s.streamLiveSession)
 	}
 }
 
@@ -115,6 +226,28 @@ func (s *Server) Start(port string) error {
 	return s.router.Run(":" + port)
 }
 
+// Helper functions to read optional configuration from the environment
+func envString(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func envFloat(key string, fallback float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
 func main() {
 	server := NewServer()
 	
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Plausibility limits for a single activity. Anything outside these is
+// treated as bad input rather than an exceptional performance. Distance
+// and pace limits depend on the activity type.
+const (
+	minMovingSpeedMps     = 0.5
+	maxRunDurationSeconds = 48 * 3600
+	minPaceSecondsPerKm   = 150 // 2:30/km sustained is beyond any human average
+	maxCaloriesPerHour    = 2000
+)
+
+type TrackSummary struct {
+	DistanceKm        float64 `json:"distance_km"`
+	DurationSeconds   int     `json:"duration_seconds"`
+	MovingSeconds     int     `json:"moving_seconds"`
+	PaceSecondsPerKm  int     `json:"pace_seconds_per_km"`
+	ElevationGainM    float64 `json:"elevation_gain_m"`
+	ElevationLossM    float64 `json:"elevation_loss_m"`
+	ElevationSource   string  `json:"elevation_source,omitempty"`
+	GradeAdjustedPace *int    `json:"grade_adjusted_pace_seconds_per_km,omitempty"`
+	AvgHeartRate      *int    `json:"avg_heart_rate,omitempty"`
+	MaxHeartRate      *int    `json:"max_heart_rate,omitempty"`
+	AvgCadence        *int    `json:"avg_cadence,omitempty"`
+}
+
+func summarizeTrack(points []TrackPoint) TrackSummary {
+	summary := TrackSummary{DistanceKm: trackDistanceKm(points)}
+	if len(points) == 0 {
+		return summary
+	}
+
+	summary.DurationSeconds = int(points[len(points)-1].Timestamp.Sub(points[0].Timestamp).Seconds())
+
+	// Moving time only counts intervals where the runner actually covered
+	// ground, so traffic lights and water stops don't dilute the pace.
+	var moving float64
+	for i := 1; i < len(points); i++ {
+		dt := points[i].Timestamp.Sub(points[i-1].Timestamp).Seconds()
+		if dt <= 0 {
+			continue
+		}
+		meters := haversineKm(points[i-1].Lat, points[i-1].Lng, points[i].Lat, points[i].Lng) * 1000
+		if meters/dt >= minMovingSpeedMps {
+			moving += dt
+		}
+	}
+	summary.MovingSeconds = int(moving)
+	summary.PaceSecondsPerKm = paceSecondsPerKm(summary.DistanceKm, summary.MovingSeconds)
+
+	if altitudes := trackAltitudes(points); len(altitudes) > 0 {
+		elevation := elevationChange(altitudes)
+		summary.ElevationGainM = elevation.GainM
+		summary.ElevationLossM = elevation.LossM
+		summary.ElevationSource = "device"
+		summary.GradeAdjustedPace = gradeAdjustedPace(points, summary.MovingSeconds)
+	}
+
+	var hrSum, hrCount, hrMax, cadSum, cadCount int
+	for _, p := range points {
+		if p.HeartRate != nil {
+			hrSum += *p.HeartRate
+			hrCount++
+			if *p.HeartRate > hrMax {
+				hrMax = *p.HeartRate
+			}
+		}
+		if p.Cadence != nil {
+			cadSum += *p.Cadence
+			cadCount++
+		}
+	}
+
+	if hrCount > 0 {
+		avg := hrSum / hrCount
+		summary.AvgHeartRate = &avg
+		summary.MaxHeartRate = &hrMax
+	}
+	if cadCount > 0 {
+		avg := cadSum / cadCount
+		summary.AvgCadence = &avg
+	}
+
+	return summary
+}
+
+// Helper function to copy computed metrics onto a run row
+func applyTrackSummary(run map[string]interface{}, summary TrackSummary) {
+	run["distance_km"] = summary.DistanceKm
+	run["duration_seconds"] = summary.DurationSeconds
+	run["moving_seconds"] = summary.MovingSeconds
+	run["avg_pace_seconds_per_km"] = summary.PaceSecondsPerKm
+	run["avg_pace_per_km"] = formatPace(summary.PaceSecondsPerKm)
+	run["elevation_gain_m"] = summary.ElevationGainM
+	run["elevation_loss_m"] = summary.ElevationLossM
+	run["grade_adjusted_pace_seconds_per_km"] = summary.GradeAdjustedPace
+	if summary.ElevationSource != "" {
+		run["elevation_source"] = summary.ElevationSource
+	}
+	run["avg_heart_rate"] = summary.AvgHeartRate
+	run["max_heart_rate"] = summary.MaxHeartRate
+	run["avg_cadence"] = summary.AvgCadence
+}
+
+func gradeAdjustedPace(points []TrackPoint, movingSeconds int) *int {
+	adjustedKm, ok := gradeAdjustedDistanceKm(points)
+	if !ok || adjustedKm <= 0 {
+		return nil
+	}
+	pace := paceSecondsPerKm(adjustedKm, movingSeconds)
+	return &pace
+}
+
+func validateRunMetrics(activity ActivityType, distanceKm float64, durationSeconds, calories int) error {
+	if distanceKm <= 0 {
+		return errors.New("distance_km must be greater than 0")
+	}
+	if distanceKm > activity.MaxDistanceKm {
+		return fmt.Errorf("distance_km must not exceed %.0f for %s", activity.MaxDistanceKm, strings.ToLower(activity.Name))
+	}
+	if durationSeconds <= 0 {
+		return errors.New("duration_seconds must be greater than 0")
+	}
+	if durationSeconds > maxRunDurationSeconds {
+		return fmt.Errorf("duration_seconds must not exceed %d", maxRunDurationSeconds)
+	}
+	if paceSecondsPerKm(distanceKm, durationSeconds) < activity.MinPaceSecondsPerKm {
+		return fmt.Errorf("average pace faster than %s/km is not physically plausible for %s",
+			formatPace(activity.MinPaceSecondsPerKm), strings.ToLower(activity.Name))
+	}
+	if calories < 0 || float64(calories) > maxCaloriesPerHour*float64(durationSeconds)/3600 {
+		return errors.New("calories_burned is out of range for the run duration")
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// TrackPipeline cleans up raw GPS tracks before metrics are computed.
+// Each stage can be switched off or tuned independently; see
+// loadTrackPipeline for the environment variables that configure it.
+type TrackPipeline struct {
+	// Accuracy filter: drop fixes whose reported accuracy radius is worse
+	// than MaxAccuracyM. Zero disables the stage.
+	MaxAccuracyM float64
+
+	// Smoothing: "kalman", "moving_average" or "" (off)
+	Smoothing string
+	// Kalman process noise, i.e. how fast (m/s) the true position is
+	// expected to drift between fixes.
+	KalmanProcessNoise float64
+	// Fallback measurement error for fixes without an accuracy value
+	DefaultAccuracyM float64
+	// Number of points in the centered moving-average window
+	MovingAverageWindow int
+
+	// Douglas-Peucker tolerance for the stored route. Zero disables it.
+	SimplifyToleranceM float64
+
+	// Pause detection: stretches where the runner stays within
+	// PauseRadiusM of one spot for at least PauseMinSeconds. Zero
+	// PauseMinSeconds disables the stage.
+	PauseRadiusM    float64
+	PauseMinSeconds float64
+
+	// Offline DEM used to fill altitude for tracks recorded without it.
+	// Nil disables the lookup.
+	Elevation ElevationProvider
+}
+
+type Pause struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type ProcessedTrack struct {
+	// Filtered and smoothed points used for all metrics
+	Points []TrackPoint
+	// Simplified copy of Points for storage
+	Stored   []TrackPoint
+	Pauses   []Pause
+	Laps     []time.Time
+	Rejected int
+
+	sourceFormat    string
+	sport           string
+	pauseDetection  bool
+	elevationSource string
+}
+
+func loadTrackPipeline() TrackPipeline {
+	return TrackPipeline{
+		MaxAccuracyM:        envFloat("TRACK_MAX_ACCURACY_M", 30),
+		Smoothing:           envString("TRACK_SMOOTHING", "kalman"),
+		KalmanProcessNoise:  envFloat("TRACK_KALMAN_PROCESS_NOISE", 1.5),
+		DefaultAccuracyM:    envFloat("TRACK_DEFAULT_ACCURACY_M", 10),
+		MovingAverageWindow: envInt("TRACK_MOVING_AVERAGE_WINDOW", 5),
+		SimplifyToleranceM:  envFloat("TRACK_SIMPLIFY_TOLERANCE_M", 2),
+		PauseRadiusM:        envFloat("TRACK_PAUSE_RADIUS_M", 10),
+		PauseMinSeconds:     envFloat("TRACK_PAUSE_MIN_SECONDS", 10),
+		Elevation:           loadElevationProvider(),
+	}
+}
+
+func (tp TrackPipeline) Process(input *Track) *ProcessedTrack {
+	result := &ProcessedTrack{
+		Laps:           input.Laps,
+		sourceFormat:   input.SourceFormat,
+		sport:          input.Sport,
+		pauseDetection: tp.PauseMinSeconds > 0,
+	}
+
+	filtered := make([]TrackPoint, 0, len(input.Points))
+	for _, p := range input.Points {
+		if tp.MaxAccuracyM > 0 && p.Accuracy != nil && *p.Accuracy > tp.MaxAccuracyM {
+			result.Rejected++
+			continue
+		}
+		// Duplicate timestamps carry no new information and break speed math
+		if n := len(filtered); n > 0 && !p.Timestamp.After(filtered[n-1].Timestamp) {
+			result.Rejected++
+			continue
+		}
+		filtered = append(filtered, p)
+	}
+
+	if fillElevation(filtered, tp.Elevation) {
+		result.elevationSource = "dem"
+	}
+
+	switch tp.Smoothing {
+	case "kalman":
+		filtered = tp.kalmanSmooth(filtered)
+	case "moving_average":
+		filtered = movingAverageSmooth(filtered, tp.MovingAverageWindow)
+	}
+	result.Points = filtered
+
+	if result.pauseDetection {
+		result.Pauses = detectPauses(filtered, tp.PauseRadiusM, tp.PauseMinSeconds)
+	}
+
+	result.Stored = filtered
+	if tp.SimplifyToleranceM > 0 {
+		result.Stored = simplifyTrack(filtered, tp.SimplifyToleranceM)
+	}
+
+	return result
+}
+
+// Summary computes run metrics from the cleaned points, taking moving
+// time from detected pauses when that stage is enabled.
+func (pt *ProcessedTrack) Summary() TrackSummary {
+	summary := summarizeTrack(pt.Points)
+	if pt.pauseDetection {
+		var paused float64
+		for _, p := range pt.Pauses {
+			paused += p.End.Sub(p.Start).Seconds()
+		}
+		summary.MovingSeconds = summary.DurationSeconds - int(paused)
+		summary.PaceSecondsPerKm = paceSecondsPerKm(summary.DistanceKm, summary.MovingSeconds)
+		if summary.GradeAdjustedPace != nil {
+			summary.GradeAdjustedPace = gradeAdjustedPace(pt.Points, summary.MovingSeconds)
+		}
+	}
+	if pt.elevationSource != "" && summary.ElevationSource != "" {
+		summary.ElevationSource = pt.elevationSource
+	}
+	return summary
+}
+
+func (pt *ProcessedTrack) Track() *Track {
+	return &Track{
+		Points:       pt.Stored,
+		Pauses:       pt.Pauses,
+		Laps:         pt.Laps,
+		SourceFormat: pt.sourceFormat,
+		Sport:        pt.sport,
+	}
+}
+
+// Scalar Kalman filter on position with variance growing by the process
+// noise over time and each fix weighted by its reported accuracy.
+func (tp TrackPipeline) kalmanSmooth(points []TrackPoint) []TrackPoint {
+	out := make([]TrackPoint, len(points))
+	var lat, lng, variance float64
+	for i, p := range points {
+		accuracy := tp.DefaultAccuracyM
+		if p.Accuracy != nil && *p.Accuracy > 0 {
+			accuracy = *p.Accuracy
+		}
+
+		if i == 0 {
+			lat, lng, variance = p.Lat, p.Lng, accuracy*accuracy
+		} else {
+			dt := p.Timestamp.Sub(points[i-1].Timestamp).Seconds()
+			variance += dt * tp.KalmanProcessNoise * tp.KalmanProcessNoise
+			gain := variance / (variance + accuracy*accuracy)
+			lat += gain * (p.Lat - lat)
+			lng += gain * (p.Lng - lng)
+			variance *= 1 - gain
+		}
+
+		out[i] = p
+		out[i].Lat, out[i].Lng = lat, lng
+	}
+	return out
+}
+
+func movingAverageSmooth(points []TrackPoint, window int) []TrackPoint {
+	if window < 2 {
+		return points
+	}
+	half := window / 2
+	out := make([]TrackPoint, len(points))
+	for i := range points {
+		from, to := max(0, i-half), min(len(points)-1, i+half)
+		var lat, lng float64
+		for j := from; j <= to; j++ {
+			lat += points[j].Lat
+			lng += points[j].Lng
+		}
+		n := float64(to - from + 1)
+		out[i] = points[i]
+		out[i].Lat, out[i].Lng = lat/n, lng/n
+	}
+	return out
+}
+
+// Helper function to find pauses and pin every point inside one to the
+// spot where it started, so GPS wander while standing still adds no
+// distance.
+func detectPauses(points []TrackPoint, radiusM, minSeconds float64) []Pause {
+	var pauses []Pause
+	for i := 0; i < len(points); {
+		anchor := points[i]
+		j := i
+		for j+1 < len(points) && haversineKm(anchor.Lat, anchor.Lng, points[j+1].Lat, points[j+1].Lng)*1000 <= radiusM {
+			j++
+		}
+
+		if j > i && points[j].Timestamp.Sub(anchor.Timestamp).Seconds() >= minSeconds {
+			pauses = append(pauses, Pause{Start: anchor.Timestamp, End: points[j].Timestamp})
+			for k := i + 1; k <= j; k++ {
+				points[k].Lat, points[k].Lng = anchor.Lat, anchor.Lng
+			}
+			i = j
+			continue
+		}
+		i++
+	}
+	return pauses
+}
+
+// Douglas-Peucker simplification using an equirectangular projection
+// around the track, which is accurate to well under a metre at run scale.
+func simplifyTrack(points []TrackPoint, toleranceM float64) []TrackPoint {
+	if len(points) < 3 {
+		return points
+	}
+
+	refLat := toRadians(points[0].Lat)
+	project := func(p TrackPoint) (float64, float64) {
+		x := toRadians(p.Lng) * math.Cos(refLat) * earthRadiusKm * 1000
+		y := toRadians(p.Lat) * earthRadiusKm * 1000
+		return x, y
+	}
+
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+
+	type span struct{ from, to int }
+	stack := []span{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		sp := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		ax, ay := project(points[sp.from])
+		bx, by := project(points[sp.to])
+		maxDist, index := 0.0, -1
+		for i := sp.from + 1; i < sp.to; i++ {
+			px, py := project(points[i])
+			if d := pointSegmentDistance(px, py, ax, ay, bx, by); d > maxDist {
+				maxDist, index = d, i
+			}
+		}
+
+		if index >= 0 && maxDist > toleranceM {
+			keep[index] = true
+			stack = append(stack, span{sp.from, index}, span{index, sp.to})
+		}
+	}
+
+	simplified := make([]TrackPoint, 0, len(points))
+	for i, p := range points {
+		if keep[i] {
+			simplified = append(simplified, p)
+		}
+	}
+	return simplified
+}
+
+func pointSegmentDistance(px, py, ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	if dx == 0 && dy == 0 {
+		return math.Hypot(px-ax, py-ay)
+	}
+	t := ((px-ax)*dx + (py-ay)*dy) / (dx*dx + dy*dy)
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(px-(ax+t*dx), py-(ay+t*dy))
+}
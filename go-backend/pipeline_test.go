@@ -0,0 +1,186 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Metres per degree of latitude on the sphere haversineKm uses
+const testMetresPerDegree = earthRadiusKm * 1000 * math.Pi / 180
+
+var testStart = time.Date(2024, 3, 10, 5, 30, 0, 0, time.UTC)
+
+// Helper function to build a track heading north from a fixed spot, one
+// fix per second, at the given speeds in m/s
+func syntheticTrack(speeds ...float64) []TrackPoint {
+	points := []TrackPoint{{Lat: 10.7769, Lng: 106.7009, Timestamp: testStart}}
+	for i, speed := range speeds {
+		last := points[len(points)-1]
+		points = append(points, TrackPoint{
+			Lat:       last.Lat + speed/testMetresPerDegree,
+			Lng:       last.Lng,
+			Timestamp: testStart.Add(time.Duration(i+1) * time.Second),
+		})
+	}
+	return points
+}
+
+// Helper function to repeat a speed for n seconds
+func steady(speed float64, n int) []float64 {
+	speeds := make([]float64, n)
+	for i := range speeds {
+		speeds[i] = speed
+	}
+	return speeds
+}
+
+func TestSimplifyTrack(t *testing.T) {
+	straight := syntheticTrack(steady(3, 100)...)
+
+	// An L-shaped route: 100 s north, then 100 s east
+	corner := syntheticTrack(steady(3, 100)...)
+	for i := 1; i <= 100; i++ {
+		last := corner[len(corner)-1]
+		corner = append(corner, TrackPoint{
+			Lat:       last.Lat,
+			Lng:       last.Lng + 3/(testMetresPerDegree*math.Cos(toRadians(last.Lat))),
+			Timestamp: last.Timestamp.Add(time.Second),
+		})
+	}
+
+	tests := []struct {
+		name       string
+		points     []TrackPoint
+		toleranceM float64
+		want       int
+	}{
+		{name: "straight line keeps its ends", points: straight, toleranceM: 2, want: 2},
+		{name: "corner is kept", points: corner, toleranceM: 2, want: 3},
+		{name: "short tracks are untouched", points: straight[:2], toleranceM: 2, want: 2},
+	}
+
+	for _, tt := range tests {
+		simplified := simplifyTrack(tt.points, tt.toleranceM)
+		if len(simplified) != tt.want {
+			t.Errorf("%s: kept %d points, want %d", tt.name, len(simplified), tt.want)
+			continue
+		}
+		if simplified[0] != tt.points[0] || simplified[len(simplified)-1] != tt.points[len(tt.points)-1] {
+			t.Errorf("%s: endpoints not kept", tt.name)
+		}
+	}
+}
+
+func TestSimplifyTrackStaysWithinTolerance(t *testing.T) {
+	// A gentle zig-zag whose fixes are 1.8 m either side of the line
+	// through its ends
+	points := syntheticTrack(steady(3, 60)...)
+	for i := range points {
+		offset := 0.9
+		if i%2 == 0 {
+			offset = -0.9
+		}
+		points[i].Lng += offset / (testMetresPerDegree * math.Cos(toRadians(points[i].Lat)))
+	}
+
+	if got := simplifyTrack(points, 2); len(got) != 2 {
+		t.Errorf("zig-zag inside the tolerance kept %d points, want 2", len(got))
+	}
+	if got := simplifyTrack(points, 1); len(got) <= 2 {
+		t.Errorf("zig-zag outside the tolerance kept only %d points", len(got))
+	}
+}
+
+func TestKalmanSmoothDampsOutliers(t *testing.T) {
+	tp := TrackPipeline{KalmanProcessNoise: 1.5, DefaultAccuracyM: 10}
+	points := syntheticTrack(steady(3, 30)...)
+
+	// A 60 m sideways jump on one fix
+	spike := 15
+	raw := points[spike].Lng
+	points[spike].Lng += 60 / (testMetresPerDegree * math.Cos(toRadians(points[spike].Lat)))
+
+	smoothed := tp.kalmanSmooth(points)
+	if len(smoothed) != len(points) {
+		t.Fatalf("kalmanSmooth returned %d points, want %d", len(smoothed), len(points))
+	}
+	if smoothed[0] != points[0] {
+		t.Errorf("first fix moved: %+v", smoothed[0])
+	}
+
+	jumpM := (smoothed[spike].Lng - raw) * testMetresPerDegree * math.Cos(toRadians(points[spike].Lat))
+	if jumpM <= 0 || jumpM >= 30 {
+		t.Errorf("smoothed spike is %.1f m off the line, want between 0 and 30", jumpM)
+	}
+	for i := range points {
+		if !smoothed[i].Timestamp.Equal(points[i].Timestamp) {
+			t.Fatalf("point %d timestamp changed", i)
+		}
+	}
+}
+
+func TestKalmanSmoothTrustsAccurateFixes(t *testing.T) {
+	tp := TrackPipeline{KalmanProcessNoise: 1.5, DefaultAccuracyM: 10}
+	points := syntheticTrack(steady(3, 10)...)
+	accurate := 0.5
+	points[5].Lng += 20 / (testMetresPerDegree * math.Cos(toRadians(points[5].Lat)))
+	points[5].Accuracy = &accurate
+
+	smoothed := tp.kalmanSmooth(points)
+	offM := (points[5].Lng - smoothed[5].Lng) * testMetresPerDegree * math.Cos(toRadians(points[5].Lat))
+	if math.Abs(offM) > 2 {
+		t.Errorf("a 0.5 m accurate fix was pulled %.1f m away", offM)
+	}
+}
+
+func TestDetectPauses(t *testing.T) {
+	// Run 60 s, stand at a light for 30 s with a couple of metres of GPS
+	// wander, then run on
+	speeds := steady(3, 60)
+	for i := 0; i < 30; i++ {
+		if i%2 == 0 {
+			speeds = append(speeds, 2)
+		} else {
+			speeds = append(speeds, -2)
+		}
+	}
+	speeds = append(speeds, steady(3, 60)...)
+	points := syntheticTrack(speeds...)
+
+	pauses := detectPauses(points, 10, 10)
+	if len(pauses) != 1 {
+		t.Fatalf("found %d pauses, want 1: %+v", len(pauses), pauses)
+	}
+
+	seconds := pauses[0].End.Sub(pauses[0].Start).Seconds()
+	if seconds < 30 || seconds > 35 {
+		t.Errorf("pause lasted %.0f s, want about 30", seconds)
+	}
+	for _, p := range points {
+		inside := !p.Timestamp.Before(pauses[0].Start) && !p.Timestamp.After(pauses[0].End)
+		if inside && (p.Lat != points[60].Lat || p.Lng != points[60].Lng) {
+			t.Fatalf("point at %v inside the pause wasn't pinned", p.Timestamp)
+		}
+	}
+
+	if short := detectPauses(syntheticTrack(append(steady(3, 10), 0, 0, 0, 3, 3)...), 10, 10); len(short) != 0 {
+		t.Errorf("a 3 s stop was reported as %d pauses", len(short))
+	}
+}
+
+func TestProcessRejectsInaccurateAndRepeatedFixes(t *testing.T) {
+	tp := TrackPipeline{MaxAccuracyM: 30}
+	points := syntheticTrack(steady(3, 10)...)
+	poor := 80.0
+	points[3].Accuracy = &poor
+	points[6].Timestamp = points[5].Timestamp
+
+	processed := tp.Process(&Track{Points: points})
+	if processed.Rejected != 2 {
+		t.Errorf("rejected %d fixes, want 2", processed.Rejected)
+	}
+	if len(processed.Points) != len(points)-2 {
+		t.Errorf("kept %d fixes, want %d", len(processed.Points), len(points)-2)
+	}
+}
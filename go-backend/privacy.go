@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const maxPrivacyZones = 10
+
+// PrivacyZone hides route points within RadiusM of a place the user
+// doesn't want to reveal, such as their dorm, from everyone but them.
+type PrivacyZone struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	RadiusM   float64   `json:"radius_m"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreatePrivacyZoneRequest struct {
+	Name    string   `json:"name" binding:"required,min=1,max=100"`
+	Lat     *float64 `json:"lat" binding:"required,min=-90,max=90"`
+	Lng     *float64 `json:"lng" binding:"required,min=-180,max=180"`
+	RadiusM float64  `json:"radius_m" binding:"required,min=100,max=2000"`
+}
+
+func (z PrivacyZone) contains(lat, lng float64) bool {
+	return haversineKm(z.Lat, z.Lng, lat, lng)*1000 <= z.RadiusM
+}
+
+// Helper function to drop every point inside any of the zones
+func trimPrivatePoints(points []TrackPoint, zones []PrivacyZone) []TrackPoint {
+	if len(zones) == 0 {
+		return points
+	}
+	kept := make([]TrackPoint, 0, len(points))
+	for _, p := range points {
+		private := false
+		for _, zone := range zones {
+			if zone.contains(p.Lat, p.Lng) {
+				private = true
+				break
+			}
+		}
+		if !private {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// trimPrivateTrack returns a copy of the track without points inside the
+// zones; the stored track is never modified.
+func trimPrivateTrack(track *Track, zones []PrivacyZone) *Track {
+	if track == nil || len(zones) == 0 {
+		return track
+	}
+	trimmed := *track
+	trimmed.Points = trimPrivatePoints(track.Points, zones)
+	return &trimmed
+}
+
+func (s *Server) getUserPrivacyZones(userID string) ([]PrivacyZone, error) {
+	result, _, err := s.supabase.From("privacy_zones").
+		Select("*", "", false).
+		Eq("user_id", userID).
+		Order("created_at", &map[string]interface{}{"ascending": true}).
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var zones []PrivacyZone
+	if err := json.Unmarshal(result, &zones); err != nil {
+		return nil, err
+	}
+
+	return zones, nil
+}
+
+// Helper function to load every user's zones at once, e.g. for the
+// global heatmap
+func (s *Server) getAllPrivacyZones() (map[string][]PrivacyZone, error) {
+	zones := make(map[string][]PrivacyZone)
+	for offset := 0; ; offset += recomputePageSize {
+		result, _, err := s.supabase.From("privacy_zones").
+			Select("*", "", false).
+			Order("created_at", &map[string]interface{}{"ascending": true}).
+			Range(offset, offset+recomputePageSize-1, "", false).
+			Execute()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var page []PrivacyZone
+		if err := json.Unmarshal(result, &page); err != nil {
+			return nil, err
+		}
+		for _, zone := range page {
+			zones[zone.UserID] = append(zones[zone.UserID], zone)
+		}
+
+		if len(page) < recomputePageSize {
+			return zones, nil
+		}
+	}
+}
+
+// redactRun trims the owner's privacy zones out of a run before it is
+// shown to anyone else, along with their heart-rate analysis and review
+// notes. Owners always see everything.
+func (s *Server) redactRun(run *Run, viewerID string) error {
+	if run.UserID == viewerID {
+		return nil
+	}
+	run.HRZones = nil
+	run.TrainingLoad = nil
+	run.SuspicionReasons = nil
+	if !run.RouteData.HasPoints() {
+		return nil
+	}
+	zones, err := s.getUserPrivacyZones(run.UserID)
+	if err != nil {
+		return err
+	}
+	run.RouteData = trimPrivateTrack(run.RouteData, zones)
+	return nil
+}
+
+// Privacy zones
+func (s *Server) getPrivacyZones(c *gin.Context) {
+	zones, err := s.getUserPrivacyZones(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch privacy zones"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"privacy_zones": zones})
+}
+
+func (s *Server) createPrivacyZone(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req CreatePrivacyZoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	existing, err := s.getUserPrivacyZones(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch privacy zones"})
+		return
+	}
+	if len(existing) >= maxPrivacyZones {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can have at most 10 privacy zones"})
+		return
+	}
+
+	zone := PrivacyZone{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Name:      req.Name,
+		Lat:       *req.Lat,
+		Lng:       *req.Lng,
+		RadiusM:   req.RadiusM,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	_, _, err = s.supabase.From("privacy_zones").
+		Insert(zone, false, "", "", "").
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create privacy zone"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, zone)
+}
+
+func (s *Server) deletePrivacyZone(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	_, _, err := s.supabase.From("privacy_zones").
+		Delete("", "").
+		Eq("id", c.Param("id")).
+		Eq("user_id", userID).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete privacy zone"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Privacy zone deleted successfully"})
+}
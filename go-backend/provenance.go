@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Where a run's data came from
+const (
+	// Recorded by our app's GPS, either live or posted after the run
+	ProvenanceGPSLive    = "gps-live"
+	ProvenanceFileUpload = "file-upload"
+	// Typed in by hand, e.g. from a treadmill display
+	ProvenanceManual     = "manual"
+	ProvenanceThirdParty = "third-party-sync"
+)
+
+var provenances = []string{ProvenanceGPSLive, ProvenanceFileUpload, ProvenanceManual, ProvenanceThirdParty}
+
+// ProvenanceRule is the set of provenances that count towards something.
+// Runs stored before provenance was tracked always count.
+type ProvenanceRule map[string]bool
+
+func (r ProvenanceRule) counts(provenance string) bool {
+	return provenance == "" || r[provenance]
+}
+
+// ProvenanceRules decide which runs count where. Manual entries can't be
+// verified, so by default they only count towards the user's own totals.
+type ProvenanceRules struct {
+	// Efforts shown on segment leaderboards
+	Leaderboards ProvenanceRule
+}
+
+func loadProvenanceRules() ProvenanceRules {
+	verified := ProvenanceGPSLive + "," + ProvenanceFileUpload + "," + ProvenanceThirdParty
+	return ProvenanceRules{
+		Leaderboards: parseProvenanceRule(envString("LEADERBOARD_PROVENANCES", verified)),
+	}
+}
+
+// Helper function to read a comma-separated provenance list, ignoring
+// unknown names
+func parseProvenanceRule(value string) ProvenanceRule {
+	rule := make(ProvenanceRule)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		for _, provenance := range provenances {
+			if name == provenance {
+				rule[name] = true
+			}
+		}
+	}
+	return rule
+}
+
+// ManualRunRequest is all a manual entry may carry: no route, locations or
+// heart-rate stream, since none of it could be checked.
+type ManualRunRequest struct {
+	Title           string     `json:"title" binding:"required,min=1,max=200"`
+	Description     *string    `json:"description" binding:"omitempty,max=5000"`
+	ActivityType    string     `json:"activity_type"`
+	DistanceKm      float64    `json:"distance_km" binding:"required"`
+	DurationSeconds int        `json:"duration_seconds" binding:"required"`
+	StartedAt       *time.Time `json:"started_at"`
+	PerceivedEffort *int       `json:"perceived_effort" binding:"omitempty,min=1,max=10"`
+	Visibility      *string    `json:"visibility" binding:"omitempty,oneof=private followers university public"`
+}
+
+// Manual run entry
+func (s *Server) createManualRun(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req ManualRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	activity, err := lookupActivityType(req.ActivityType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	calories := estimateCalories(bodyMetrics(currentProfile(c)), activity, req.DistanceKm, req.DurationSeconds, 1)
+	if err := validateRunMetrics(activity, req.DistanceKm, req.DurationSeconds, calories); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	startedAt := now.Add(-time.Duration(req.DurationSeconds) * time.Second)
+	if req.StartedAt != nil {
+		startedAt = req.StartedAt.UTC()
+	}
+	if startedAt.Add(time.Duration(req.DurationSeconds) * time.Second).After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A manual run must have finished already"})
+		return
+	}
+
+	pace := paceSecondsPerKm(req.DistanceKm, req.DurationSeconds)
+	run := map[string]interface{}{
+		"id":                      uuid.New().String(),
+		"user_id":                 userID,
+		"title":                   req.Title,
+		"description":             req.Description,
+		"perceived_effort":        req.PerceivedEffort,
+		"provenance":              ProvenanceManual,
+		"visibility":              runVisibility(req.Visibility, currentProfile(c)),
+		"distance_km":             req.DistanceKm,
+		"duration_seconds":        req.DurationSeconds,
+		"avg_pace_seconds_per_km": pace,
+		"avg_pace_per_km":         formatPace(pace),
+		"calories_burned":         calories,
+		"review_status":           ReviewClear,
+		"started_at":              startedAt,
+		"created_at":              now,
+	}
+	applyActivity(run, activity, req.DistanceKm, req.DurationSeconds)
+
+	createdRun, err := s.saveRun(run)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create run"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, createdRun)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type recordDistance struct {
+	Key    string
+	Name   string
+	Meters float64
+}
+
+var recordDistances = []recordDistance{
+	{"1k", "1K", 1000},
+	{"5k", "5K", 5000},
+	{"10k", "10K", 10000},
+	{"half_marathon", "Half marathon", 21097.5},
+	{"marathon", "Marathon", 42195},
+}
+
+// BestEffort is the fastest stretch of a run covering a standard distance
+type BestEffort struct {
+	Distance       string    `json:"distance"`
+	DistanceM      float64   `json:"distance_m"`
+	ElapsedSeconds int       `json:"elapsed_seconds"`
+	StartedAt      time.Time `json:"started_at"`
+}
+
+type PersonalRecord struct {
+	ID             string    `json:"id"`
+	UserID         string    `json:"user_id"`
+	RunID          string    `json:"run_id"`
+	Distance       string    `json:"distance"`
+	DistanceM      float64   `json:"distance_m"`
+	ElapsedSeconds int       `json:"elapsed_seconds"`
+	AchievedAt     time.Time `json:"achieved_at"`
+	// Previous record time, nil for the first effort at a distance
+	PreviousSeconds *int `json:"previous_seconds"`
+}
+
+// findBestEfforts slides a window over the track and returns, for every
+// standard distance the run covers, the fastest elapsed time to cover it.
+func findBestEfforts(points []TrackPoint) []BestEffort {
+	if len(points) < 2 {
+		return nil
+	}
+
+	profile := newTrackProfile(points, nil)
+	total := profile.totalDistance()
+
+	var efforts []BestEffort
+	for _, rd := range recordDistances {
+		if total < rd.Meters {
+			break
+		}
+
+		best := math.Inf(1)
+		var bestStart time.Time
+		j := 1
+		for i := 0; i < len(points)-1; i++ {
+			target := profile.distance[i] + rd.Meters
+			if target > total {
+				break
+			}
+			for j < len(points)-1 && profile.distance[j] < target {
+				j++
+			}
+
+			// Interpolate the moment the window reaches the target distance
+			span := profile.distance[j] - profile.distance[j-1]
+			end := points[j].Timestamp
+			if span > 0 {
+				frac := (target - profile.distance[j-1]) / span
+				dt := points[j].Timestamp.Sub(points[j-1].Timestamp)
+				end = points[j-1].Timestamp.Add(time.Duration(frac * float64(dt)))
+			}
+
+			if elapsed := end.Sub(points[i].Timestamp).Seconds(); elapsed < best {
+				best, bestStart = elapsed, points[i].Timestamp
+			}
+		}
+
+		if !math.IsInf(best, 1) {
+			efforts = append(efforts, BestEffort{
+				Distance:       rd.Key,
+				DistanceM:      rd.Meters,
+				ElapsedSeconds: int(math.Round(best)),
+				StartedAt:      bestStart,
+			})
+		}
+	}
+
+	return efforts
+}
+
+// Helper function to store best efforts on a run row; only running
+// activities compete for records.
+func applyBestEfforts(run map[string]interface{}, activity ActivityType, points []TrackPoint) []BestEffort {
+	if !activity.Running {
+		return nil
+	}
+	efforts := findBestEfforts(points)
+	if len(efforts) > 0 {
+		run["best_efforts"] = efforts
+	}
+	return efforts
+}
+
+// recordBestEfforts compares a new run's efforts with the user's current
+// records and stores the ones that beat them.
+func (s *Server) recordBestEfforts(userID, runID string, efforts []BestEffort) ([]PersonalRecord, error) {
+	if len(efforts) == 0 {
+		return nil, nil
+	}
+
+	current, err := s.getCurrentRecords(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []PersonalRecord
+	for _, effort := range efforts {
+		record := PersonalRecord{
+			ID:             uuid.New().String(),
+			UserID:         userID,
+			RunID:          runID,
+			Distance:       effort.Distance,
+			DistanceM:      effort.DistanceM,
+			ElapsedSeconds: effort.ElapsedSeconds,
+			AchievedAt:     effort.StartedAt,
+		}
+		if previous, ok := current[effort.Distance]; ok {
+			if effort.ElapsedSeconds >= previous.ElapsedSeconds {
+				continue
+			}
+			record.PreviousSeconds = &previous.ElapsedSeconds
+		}
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	_, _, err = s.supabase.From("personal_records").
+		Insert(records, false, "", "", "").
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// Helper function to record PRs after a run is saved. Failing to store
+// records must not fail the run itself. Runs flagged for review only set
+// records once approved (see reviewRun).
+func (s *Server) detectPersonalRecords(userID string, run map[string]interface{}, efforts []BestEffort) []PersonalRecord {
+	if status, _ := run["review_status"].(string); !reviewCounts(status) {
+		return nil
+	}
+
+	runID := run["id"].(string)
+	records, err := s.recordBestEfforts(userID, runID, efforts)
+	if err != nil {
+		log.Printf("record best efforts for run %s: %v", runID, err)
+		return nil
+	}
+	return records
+}
+
+func (s *Server) getRecordHistory(userID string) ([]PersonalRecord, error) {
+	result, _, err := s.supabase.From("personal_records").
+		Select("*", "", false).
+		Eq("user_id", userID).
+		Order("achieved_at", &map[string]interface{}{"ascending": true}).
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var records []PersonalRecord
+	if err := json.Unmarshal(result, &records); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (s *Server) getCurrentRecords(userID string) (map[string]PersonalRecord, error) {
+	history, err := s.getRecordHistory(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]PersonalRecord)
+	for _, record := range history {
+		if best, ok := current[record.Distance]; !ok || record.ElapsedSeconds < best.ElapsedSeconds {
+			current[record.Distance] = record
+		}
+	}
+	return current, nil
+}
+
+// rebuildPersonalRecords replays every run's best efforts in date order,
+// e.g. after the run holding a record is deleted or re-typed.
+func (s *Server) rebuildPersonalRecords(userID string) {
+	type runEffort struct {
+		runID  string
+		effort BestEffort
+	}
+	var efforts []runEffort
+	for offset := 0; ; offset += recomputePageSize {
+		result, _, err := s.supabase.From("runs").
+			Select("id, activity_type, review_status, best_efforts", "", false).
+			Eq("user_id", userID).
+			Order("created_at", &map[string]interface{}{"ascending": true}).
+			Range(offset, offset+recomputePageSize-1, "", false).
+			Execute()
+
+		if err != nil {
+			log.Printf("rebuild records for %s: %v", userID, err)
+			return
+		}
+
+		var page []struct {
+			ID           string       `json:"id"`
+			ActivityType string       `json:"activity_type"`
+			ReviewStatus string       `json:"review_status"`
+			BestEfforts  []BestEffort `json:"best_efforts"`
+		}
+		if err := json.Unmarshal(result, &page); err != nil {
+			log.Printf("rebuild records for %s: %v", userID, err)
+			return
+		}
+
+		for _, run := range page {
+			if !isRunningActivity(run.ActivityType) || !reviewCounts(run.ReviewStatus) {
+				continue
+			}
+			for _, effort := range run.BestEfforts {
+				efforts = append(efforts, runEffort{run.ID, effort})
+			}
+		}
+
+		if len(page) < recomputePageSize {
+			break
+		}
+	}
+	sort.Slice(efforts, func(i, j int) bool {
+		return efforts[i].effort.StartedAt.Before(efforts[j].effort.StartedAt)
+	})
+
+	var records []PersonalRecord
+	best := make(map[string]int)
+	for _, e := range efforts {
+		record := PersonalRecord{
+			ID:             uuid.New().String(),
+			UserID:         userID,
+			RunID:          e.runID,
+			Distance:       e.effort.Distance,
+			DistanceM:      e.effort.DistanceM,
+			ElapsedSeconds: e.effort.ElapsedSeconds,
+			AchievedAt:     e.effort.StartedAt,
+		}
+		if previous, ok := best[e.effort.Distance]; ok {
+			if e.effort.ElapsedSeconds >= previous {
+				continue
+			}
+			record.PreviousSeconds = &previous
+		}
+		best[e.effort.Distance] = e.effort.ElapsedSeconds
+		records = append(records, record)
+	}
+
+	_, _, err := s.supabase.From("personal_records").
+		Delete("", "").
+		Eq("user_id", userID).
+		Execute()
+
+	if err != nil {
+		log.Printf("rebuild records for %s: %v", userID, err)
+		return
+	}
+
+	if len(records) == 0 {
+		return
+	}
+
+	_, _, err = s.supabase.From("personal_records").
+		Insert(records, false, "", "", "").
+		Execute()
+
+	if err != nil {
+		log.Printf("rebuild records for %s: %v", userID, err)
+	}
+}
+
+// Personal records: current best per distance plus the full history
+func (s *Server) getPersonalRecords(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	history, err := s.getRecordHistory(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch personal records"})
+		return
+	}
+
+	if distance := c.Query("distance"); distance != "" {
+		filtered := make([]PersonalRecord, 0)
+		for _, record := range history {
+			if record.Distance == distance {
+				filtered = append(filtered, record)
+			}
+		}
+		history = filtered
+	}
+
+	current := make([]PersonalRecord, 0, len(recordDistances))
+	latest := make(map[string]PersonalRecord)
+	for _, record := range history {
+		if best, ok := latest[record.Distance]; !ok || record.ElapsedSeconds < best.ElapsedSeconds {
+			latest[record.Distance] = record
+		}
+	}
+	for _, rd := range recordDistances {
+		if record, ok := latest[rd.Key]; ok {
+			current = append(current, record)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"records": current,
+		"history": history,
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindBestEfforts(t *testing.T) {
+	// 1 km at 4 m/s, 1 km at 5 m/s, then 1 km at 4 m/s: the fastest 1K is
+	// the middle kilometre
+	surge := syntheticTrack(append(append(steady(4, 250), steady(5, 200)...), steady(4, 250)...)...)
+
+	tests := []struct {
+		name   string
+		points []TrackPoint
+		want   []BestEffort
+	}{
+		{name: "too short for any record", points: syntheticTrack(steady(4, 200)...)},
+		{
+			name:   "fastest window is found mid-run",
+			points: surge,
+			want:   []BestEffort{{Distance: "1k", DistanceM: 1000, ElapsedSeconds: 200, StartedAt: testStart.Add(250 * time.Second)}},
+		},
+		{
+			name:   "every covered distance gets an effort",
+			points: syntheticTrack(steady(4, 1300)...),
+			want: []BestEffort{
+				{Distance: "1k", DistanceM: 1000, ElapsedSeconds: 250, StartedAt: testStart},
+				{Distance: "5k", DistanceM: 5000, ElapsedSeconds: 1250, StartedAt: testStart},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := findBestEfforts(tt.points)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d efforts, want %d: %+v", tt.name, len(got), len(tt.want), got)
+			continue
+		}
+		for i, w := range tt.want {
+			if got[i].Distance != w.Distance || got[i].DistanceM != w.DistanceM || got[i].ElapsedSeconds != w.ElapsedSeconds {
+				t.Errorf("%s: effort %d = %+v, want %+v", tt.name, i, got[i], w)
+			}
+			if !got[i].StartedAt.Equal(w.StartedAt) {
+				t.Errorf("%s: effort started at %v, want %v", tt.name, got[i].StartedAt, w.StartedAt)
+			}
+		}
+	}
+}
@@ -0,0 +1,1041 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Registration lifecycle. Pending-payment and confirmed registrations hold
+// a spot; waitlisted ones are promoted in sign-up order as spots free up.
+const (
+	RegistrationPendingPayment = "pending_payment"
+	RegistrationConfirmed      = "confirmed"
+	RegistrationWaitlisted     = "waitlisted"
+	RegistrationCancelled      = "cancelled"
+)
+
+var (
+	heldRegistrationStatuses   = []string{RegistrationPendingPayment, RegistrationConfirmed}
+	activeRegistrationStatuses = []string{RegistrationPendingPayment, RegistrationConfirmed, RegistrationWaitlisted}
+)
+
+var errRegistrationClosed = errors.New("registration is closed")
+
+type EventRegistration struct {
+	ID            string     `json:"id"`
+	EventID       string     `json:"event_id"`
+	UserID        string     `json:"user_id"`
+	DistanceID    string     `json:"distance_id"`
+	Status        string     `json:"status"`
+	PaymentMethod string     `json:"payment_method"`
+	OrderID       *string    `json:"order_id"`
+	PaymentDueAt  *time.Time `json:"payment_due_at"`
+	ConfirmedAt   *time.Time `json:"confirmed_at"`
+	CancelledAt   *time.Time `json:"cancelled_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// Payment method is only needed for paid events; it is reused for the
+// order if the registration is promoted off the waitlist later.
+type RegisterEventRequest struct {
+	DistanceID    string `json:"distance_id" binding:"required"`
+	PaymentMethod string `json:"payment_method" binding:"max=50"`
+}
+
+// EventLocks serializes capacity decisions per event within this process.
+// Other API instances don't see these locks, so the database has the last
+// word: a unique index on (event_id, user_id) over registrations that
+// aren't cancelled allows one active registration per user, and every
+// admission re-counts the held spots afterwards and gives its own spot
+// back if it ranks past capacity (see yieldsSpot).
+type EventLocks struct {
+	mu    sync.Mutex
+	locks map[string]*eventLock
+}
+
+// eventLock counts the callers holding or waiting for it, so it can be
+// dropped once nobody needs it
+type eventLock struct {
+	sync.Mutex
+	holders int
+}
+
+func NewEventLocks() *EventLocks {
+	return &EventLocks{locks: make(map[string]*eventLock)}
+}
+
+func (l *EventLocks) lock(eventID string) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[eventID]
+	if !ok {
+		lock = &eventLock{}
+		l.locks[eventID] = lock
+	}
+	lock.holders++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		l.mu.Lock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(l.locks, eventID)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// registrationWindow reports whether new sign-ups are accepted at now.
+// Without an explicit close, registration closes when the event starts.
+func registrationWindow(event *Event, now time.Time) error {
+	if event.Status != EventUpcoming && event.Status != EventOngoing {
+		return errRegistrationClosed
+	}
+	if event.RegistrationOpensAt != nil && now.Before(*event.RegistrationOpensAt) {
+		return errors.New("registration opens at " + event.RegistrationOpensAt.UTC().Format(time.RFC3339))
+	}
+	closes := event.EventDate
+	if event.RegistrationClosesAt != nil {
+		closes = *event.RegistrationClosesAt
+	}
+	if !now.Before(closes) {
+		return errRegistrationClosed
+	}
+	return nil
+}
+
+func eventDistance(event *Event, distanceID string) (*EventDistance, bool) {
+	for i := range event.Distances {
+		if event.Distances[i].ID == distanceID {
+			return &event.Distances[i], true
+		}
+	}
+	return nil, false
+}
+
+func (s *Server) countRegistrations(eventID string, statuses []string) (int, error) {
+	_, count, err := s.supabase.From("event_registrations").
+		Select("id", "exact", false).
+		Eq("event_id", eventID).
+		In("status", statuses).
+		Execute()
+
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// Helper function to check, after taking a spot, whether registrations
+// admitted by other API instances at the same time pushed the event over
+// capacity and this one has to give its spot back. Held registrations are
+// ranked by sign-up time, then ID, and only those ranked past capacity
+// yield, so two instances can't both give their spot back.
+func (s *Server) yieldsSpot(event *Event, registration *EventRegistration) (bool, error) {
+	if event.Capacity <= 0 {
+		return false, nil
+	}
+	createdAt := registration.CreatedAt.UTC().Format(time.RFC3339Nano)
+	_, ahead, err := s.supabase.From("event_registrations").
+		Select("id", "exact", false).
+		Eq("event_id", event.ID).
+		In("status", heldRegistrationStatuses).
+		Or(fmt.Sprintf(`created_at.lt."%s",and(created_at.eq."%s",id.lt.%s)`, createdAt, createdAt, registration.ID), "").
+		Execute()
+
+	if err != nil {
+		return false, err
+	}
+	return int(ahead) >= event.Capacity, nil
+}
+
+// Helper function to check whether the event holds more registrations
+// than it has spots, e.g. after taking back a late payment
+func (s *Server) overCapacity(event *Event) (bool, error) {
+	if event.Capacity <= 0 {
+		return false, nil
+	}
+	held, err := s.countRegistrations(event.ID, heldRegistrationStatuses)
+	if err != nil {
+		return false, err
+	}
+	return held > event.Capacity, nil
+}
+
+// Helper function to recognise the error PostgREST returns for a unique
+// constraint violation
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "(23505)")
+}
+
+// Helper function to load a user's current (not cancelled) registration
+// for an event, nil if they have none
+func (s *Server) getActiveRegistration(eventID, userID string) (*EventRegistration, error) {
+	result, _, err := s.supabase.From("event_registrations").
+		Select("*", "", false).
+		Eq("event_id", eventID).
+		Eq("user_id", userID).
+		In("status", activeRegistrationStatuses).
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var registrations []EventRegistration
+	if err := json.Unmarshal(result, &registrations); err != nil {
+		return nil, err
+	}
+	if len(registrations) == 0 {
+		return nil, nil
+	}
+	return &registrations[0], nil
+}
+
+func (s *Server) getRegistrationByOrder(orderID string) (*EventRegistration, error) {
+	var registration EventRegistration
+
+	result, _, err := s.supabase.From("event_registrations").
+		Select("*", "", false).
+		Eq("order_id", orderID).
+		Single().
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(result, &registration); err != nil {
+		return nil, err
+	}
+
+	return &registration, nil
+}
+
+// waitlistPosition is 1 for the next registration to be promoted
+func (s *Server) waitlistPosition(registration *EventRegistration) (int, error) {
+	_, count, err := s.supabase.From("event_registrations").
+		Select("id", "exact", false).
+		Eq("event_id", registration.EventID).
+		Eq("status", RegistrationWaitlisted).
+		Lt("created_at", registration.CreatedAt.UTC().Format(time.RFC3339Nano)).
+		Execute()
+
+	if err != nil {
+		return 0, err
+	}
+	return int(count) + 1, nil
+}
+
+// admitRegistration gives a registration a spot: free events confirm it
+// straight away, paid events open an order and hold the spot until the
+// payment is due. Callers hold the event lock and save the registration.
+func (s *Server) admitRegistration(event *Event, registration *EventRegistration, now time.Time) (map[string]interface{}, error) {
+	if event.Price <= 0 {
+		registration.Status = RegistrationConfirmed
+		registration.ConfirmedAt = &now
+		return nil, nil
+	}
+
+	order := map[string]interface{}{
+		"id":              uuid.New().String(),
+		"user_id":         registration.UserID,
+		"order_number":    fmt.Sprintf("VSM-%d-%s", now.Unix(), uuid.New().String()[:8]),
+		"product_type":    "event",
+		"product_id":      event.ID,
+		"amount":          event.Price,
+		"currency":        event.Currency,
+		"status":          "pending",
+		"payment_method":  registration.PaymentMethod,
+		"payment_details": map[string]interface{}{"registration_id": registration.ID, "distance_id": registration.DistanceID},
+		"created_at":      now,
+		"updated_at":      now,
+	}
+
+	result, _, err := s.supabase.From("orders").
+		Insert(order, false, "", "", "").
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var created []map[string]interface{}
+	if err := json.Unmarshal(result, &created); err != nil || len(created) == 0 {
+		return nil, fmt.Errorf("parse created order: %v", err)
+	}
+
+	orderID := order["id"].(string)
+	registration.Status = RegistrationPendingPayment
+	registration.OrderID = &orderID
+	if s.events.PaymentHold > 0 {
+		dueAt := now.Add(s.events.PaymentHold)
+		registration.PaymentDueAt = &dueAt
+	}
+	return created[0], nil
+}
+
+func (s *Server) saveRegistrationStatus(registration *EventRegistration, now time.Time) error {
+	registration.UpdatedAt = now
+	_, _, err := s.supabase.From("event_registrations").
+		Update(map[string]interface{}{
+			"status":         registration.Status,
+			"order_id":       registration.OrderID,
+			"payment_due_at": registration.PaymentDueAt,
+			"confirmed_at":   registration.ConfirmedAt,
+			"cancelled_at":   registration.CancelledAt,
+			"updated_at":     now,
+		}, "", "").
+		Eq("id", registration.ID).
+		Execute()
+
+	return err
+}
+
+// Helper function to cancel a registration, failing its order if it was
+// still unpaid or flagging a paid one for editors to refund
+func (s *Server) cancelRegistration(registration *EventRegistration, now time.Time) error {
+	previous := registration.Status
+
+	registration.Status = RegistrationCancelled
+	registration.PaymentDueAt = nil
+	registration.CancelledAt = &now
+	if err := s.saveRegistrationStatus(registration, now); err != nil {
+		return err
+	}
+
+	if registration.OrderID == nil {
+		return nil
+	}
+	switch previous {
+	case RegistrationPendingPayment:
+		_, _, err := s.supabase.From("orders").
+			Update(map[string]interface{}{"status": "failed", "updated_at": now}, "", "").
+			Eq("id", *registration.OrderID).
+			Eq("status", "pending").
+			Execute()
+		return err
+	case RegistrationConfirmed:
+		_, _, err := s.supabase.From("orders").
+			Update(map[string]interface{}{"status": "refund_pending", "updated_at": now}, "", "").
+			Eq("id", *registration.OrderID).
+			Eq("status", "paid").
+			Execute()
+		return err
+	}
+	return nil
+}
+
+// returnToWaitlist gives up a spot that turned out to be over capacity,
+// failing its unpaid order
+func (s *Server) returnToWaitlist(registration *EventRegistration, now time.Time) error {
+	if registration.OrderID != nil {
+		_, _, err := s.supabase.From("orders").
+			Update(map[string]interface{}{"status": "failed", "updated_at": now}, "", "").
+			Eq("id", *registration.OrderID).
+			Eq("status", "pending").
+			Execute()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	registration.Status = RegistrationWaitlisted
+	registration.OrderID = nil
+	registration.PaymentDueAt = nil
+	registration.ConfirmedAt = nil
+	return s.saveRegistrationStatus(registration, now)
+}
+
+// expirePaymentHolds releases spots whose payment is overdue. Callers hold
+// the event lock.
+func (s *Server) expirePaymentHolds(event *Event, now time.Time) (int, error) {
+	if s.events.PaymentHold <= 0 {
+		return 0, nil
+	}
+
+	result, _, err := s.supabase.From("event_registrations").
+		Select("*", "", false).
+		Eq("event_id", event.ID).
+		Eq("status", RegistrationPendingPayment).
+		Lt("payment_due_at", now.UTC().Format(time.RFC3339)).
+		Execute()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var expired []EventRegistration
+	if err := json.Unmarshal(result, &expired); err != nil {
+		return 0, err
+	}
+
+	for i := range expired {
+		if err := s.cancelRegistration(&expired[i], now); err != nil {
+			return i, err
+		}
+		s.sendRegistrationEmail(event, &expired[i], "The payment wasn't completed in time, so your spot was released.")
+	}
+	return len(expired), nil
+}
+
+// promoteWaitlist fills free spots from the waitlist, oldest sign-up
+// first. Callers hold the event lock.
+func (s *Server) promoteWaitlist(event *Event, now time.Time) error {
+	if event.Status != EventUpcoming && event.Status != EventOngoing {
+		return nil
+	}
+
+	for {
+		free := recomputePageSize
+		if event.Capacity > 0 {
+			held, err := s.countRegistrations(event.ID, heldRegistrationStatuses)
+			if err != nil {
+				return err
+			}
+			if held >= event.Capacity {
+				return nil
+			}
+			if event.Capacity-held < free {
+				free = event.Capacity - held
+			}
+		}
+
+		result, _, err := s.supabase.From("event_registrations").
+			Select("*", "", false).
+			Eq("event_id", event.ID).
+			Eq("status", RegistrationWaitlisted).
+			Order("created_at", &map[string]interface{}{"ascending": true}).
+			Range(0, free-1, "", false).
+			Execute()
+
+		if err != nil {
+			return err
+		}
+
+		var waitlisted []EventRegistration
+		if err := json.Unmarshal(result, &waitlisted); err != nil {
+			return err
+		}
+
+		for i := range waitlisted {
+			registration := &waitlisted[i]
+			if _, err := s.admitRegistration(event, registration, now); err != nil {
+				return err
+			}
+			if err := s.saveRegistrationStatus(registration, now); err != nil {
+				return err
+			}
+			if yields, err := s.yieldsSpot(event, registration); err != nil || yields {
+				if err == nil {
+					err = s.returnToWaitlist(registration, now)
+				}
+				return err
+			}
+			s.sendRegistrationEmail(event, registration, "")
+		}
+
+		if len(waitlisted) < free {
+			return nil
+		}
+	}
+}
+
+// settleEvent expires overdue payment holds and promotes the waitlist into
+// any spots that are free
+func (s *Server) settleEvent(eventID string) error {
+	unlock := s.eventLocks.lock(eventID)
+	defer unlock()
+
+	event, err := s.getEventByID(eventID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if _, err := s.expirePaymentHolds(event, now); err != nil {
+		return err
+	}
+	return s.promoteWaitlist(event, now)
+}
+
+// settleOverdueEvents settles every event with an overdue payment hold,
+// so spots return to the waitlist without waiting for someone to sign up
+func (s *Server) settleOverdueEvents(now time.Time) error {
+	result, _, err := s.supabase.From("event_registrations").
+		Select("event_id", "", false).
+		Eq("status", RegistrationPendingPayment).
+		Lt("payment_due_at", now.UTC().Format(time.RFC3339)).
+		Execute()
+
+	if err != nil {
+		return err
+	}
+
+	var overdue []EventRegistration
+	if err := json.Unmarshal(result, &overdue); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, registration := range overdue {
+		if seen[registration.EventID] {
+			continue
+		}
+		seen[registration.EventID] = true
+		if err := s.settleEvent(registration.EventID); err != nil {
+			log.Printf("settle event %s: %v", registration.EventID, err)
+		}
+	}
+	return nil
+}
+
+// readmitPaidRegistration takes back a registration whose order was
+// marked paid after its spot had been released. Without room for it the
+// order is flagged for a refund instead. Callers hold the event's lock.
+func (s *Server) readmitPaidRegistration(event *Event, registration *EventRegistration, now time.Time) {
+	room := event.Status == EventUpcoming || event.Status == EventOngoing
+	if room {
+		existing, err := s.getActiveRegistration(event.ID, registration.UserID)
+		if err != nil {
+			log.Printf("readmit registration %s: %v", registration.ID, err)
+			return
+		}
+		// They may have signed up again in the meantime
+		room = existing == nil
+	}
+	if room && event.Capacity > 0 {
+		held, err := s.countRegistrations(event.ID, heldRegistrationStatuses)
+		if err != nil {
+			log.Printf("readmit registration %s: %v", registration.ID, err)
+			return
+		}
+		room = held < event.Capacity
+	}
+
+	if room {
+		registration.Status = RegistrationConfirmed
+		registration.PaymentDueAt = nil
+		registration.ConfirmedAt = &now
+		registration.CancelledAt = nil
+		if err := s.saveRegistrationStatus(registration, now); err != nil {
+			log.Printf("readmit registration %s: %v", registration.ID, err)
+			return
+		}
+		over, err := s.overCapacity(event)
+		if err != nil {
+			log.Printf("readmit registration %s: %v", registration.ID, err)
+			return
+		}
+		if !over {
+			s.sendRegistrationEmail(event, registration, "")
+			return
+		}
+
+		registration.Status = RegistrationCancelled
+		registration.ConfirmedAt = nil
+		registration.CancelledAt = &now
+		if err := s.saveRegistrationStatus(registration, now); err != nil {
+			log.Printf("readmit registration %s: %v", registration.ID, err)
+			return
+		}
+	}
+
+	_, _, err := s.supabase.From("orders").
+		Update(map[string]interface{}{"status": "refund_pending", "updated_at": now}, "", "").
+		Eq("id", *registration.OrderID).
+		Eq("status", "paid").
+		Execute()
+
+	if err != nil {
+		log.Printf("flag order %s for refund: %v", *registration.OrderID, err)
+		return
+	}
+	s.sendRegistrationEmail(event, registration, "Your payment arrived after your spot had been released and there is no longer room for you, so it will be refunded.")
+}
+
+// applyEventOrderStatus follows an event order's payment: paying confirms
+// the registration (or takes it back if its hold had run out), a failed
+// or refunded order gives the spot up.
+func (s *Server) applyEventOrderStatus(orderID, status string) {
+	registration, err := s.getRegistrationByOrder(orderID)
+	if err != nil {
+		return
+	}
+
+	unlock := s.eventLocks.lock(registration.EventID)
+	defer unlock()
+
+	// Re-read under the lock; the registration may have moved on meanwhile
+	registration, err = s.getRegistrationByOrder(orderID)
+	if err != nil {
+		return
+	}
+	event, err := s.getEventByID(registration.EventID)
+	if err != nil {
+		log.Printf("load event %s: %v", registration.EventID, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case status == "paid" && registration.Status == RegistrationPendingPayment:
+		registration.Status = RegistrationConfirmed
+		registration.PaymentDueAt = nil
+		registration.ConfirmedAt = &now
+		if err := s.saveRegistrationStatus(registration, now); err != nil {
+			log.Printf("confirm registration %s: %v", registration.ID, err)
+			return
+		}
+		s.sendRegistrationEmail(event, registration, "")
+
+	case status == "paid" && registration.Status == RegistrationCancelled:
+		// The payment was confirmed after the hold ran out
+		s.readmitPaidRegistration(event, registration, now)
+
+	case (status == "failed" || status == "refunded") &&
+		(registration.Status == RegistrationPendingPayment || registration.Status == RegistrationConfirmed):
+		if err := s.cancelRegistration(registration, now); err != nil {
+			log.Printf("cancel registration %s: %v", registration.ID, err)
+			return
+		}
+		reason := "The payment didn't go through, so your spot was released."
+		if status == "refunded" {
+			reason = "Your payment has been refunded."
+		}
+		s.sendRegistrationEmail(event, registration, reason)
+		if err := s.promoteWaitlist(event, now); err != nil {
+			log.Printf("promote waitlist of event %s: %v", event.ID, err)
+		}
+	}
+}
+
+// cancelEventRegistrations cancels everyone's registration when the event
+// itself is cancelled
+func (s *Server) cancelEventRegistrations(eventID string) {
+	unlock := s.eventLocks.lock(eventID)
+	defer unlock()
+
+	event, err := s.getEventByID(eventID)
+	if err != nil {
+		log.Printf("load event %s: %v", eventID, err)
+		return
+	}
+
+	for {
+		result, _, err := s.supabase.From("event_registrations").
+			Select("*", "", false).
+			Eq("event_id", eventID).
+			In("status", activeRegistrationStatuses).
+			Range(0, recomputePageSize-1, "", false).
+			Execute()
+
+		if err != nil {
+			log.Printf("list registrations of event %s: %v", eventID, err)
+			return
+		}
+
+		var registrations []EventRegistration
+		if err := json.Unmarshal(result, &registrations); err != nil {
+			log.Printf("parse registrations of event %s: %v", eventID, err)
+			return
+		}
+
+		now := time.Now().UTC()
+		for i := range registrations {
+			if err := s.cancelRegistration(&registrations[i], now); err != nil {
+				log.Printf("cancel registration %s: %v", registrations[i].ID, err)
+				return
+			}
+			s.sendRegistrationEmail(event, &registrations[i], "")
+		}
+
+		if len(registrations) < recomputePageSize {
+			return
+		}
+	}
+}
+
+// Helper function to email the user about their registration's current
+// status in the background. reason explains a cancellation the user didn't
+// ask for.
+func (s *Server) sendRegistrationEmail(event *Event, registration *EventRegistration, reason string) {
+	subject, body := registrationEmail(event, registration, reason)
+	userID := registration.UserID
+
+	go func() {
+		var profile Profile
+		result, _, err := s.supabase.From("profiles").
+			Select("id, email, full_name", "", false).
+			Eq("id", userID).
+			Single().
+			Execute()
+
+		if err == nil {
+			err = json.Unmarshal(result, &profile)
+		}
+		if err != nil || profile.Email == "" {
+			log.Printf("registration email for user %s: no address", userID)
+			return
+		}
+
+		name := profile.FullName
+		if name == "" {
+			name = "there"
+		}
+		if err := s.mailer.Send(profile.Email, subject, "Hi "+name+",\n\n"+body); err != nil {
+			log.Printf("registration email to %s: %v", profile.Email, err)
+		}
+	}()
+}
+
+func registrationEmail(event *Event, registration *EventRegistration, reason string) (string, string) {
+	location, err := summaryLocation("", nil)
+	if err != nil {
+		location = time.UTC
+	}
+
+	details := fmt.Sprintf("Event: %s\nDate: %s\nLocation: %s\n",
+		event.Name, event.EventDate.In(location).Format("Mon 02 Jan 2006 15:04"), event.Location)
+	if distance, ok := eventDistance(event, registration.DistanceID); ok {
+		details += "Distance: " + distance.Label + "\n"
+	}
+
+	var subject string
+	var body strings.Builder
+	switch registration.Status {
+	case RegistrationConfirmed:
+		subject = "You're registered for " + event.Name
+		body.WriteString("Your registration is confirmed. See you at the start line!\n\n")
+	case RegistrationPendingPayment:
+		subject = "Complete your payment for " + event.Name
+		fmt.Fprintf(&body, "A spot is held for you. Please pay %.0f %s", event.Price, event.Currency)
+		if registration.PaymentDueAt != nil {
+			fmt.Fprintf(&body, " by %s", registration.PaymentDueAt.In(location).Format("15:04 02 Jan 2006"))
+			body.WriteString(" to confirm it; after that the spot goes to the next person on the waitlist.\n\n")
+		} else {
+			body.WriteString(" to confirm it. We'll email you once the payment has been checked.\n\n")
+		}
+	case RegistrationWaitlisted:
+		subject = "You're on the waitlist for " + event.Name
+		body.WriteString("The event is full, so you're on the waitlist. We'll email you as soon as a spot opens up.\n\n")
+	case RegistrationCancelled:
+		subject = "Your registration for " + event.Name + " was cancelled"
+		switch {
+		case reason != "":
+			body.WriteString(reason + "\n")
+		case event.Status == EventCancelled:
+			body.WriteString("Unfortunately the event has been cancelled.")
+			if event.CancellationReason != nil {
+				body.WriteString(" Reason: " + *event.CancellationReason)
+			}
+			body.WriteString("\n")
+		default:
+			body.WriteString("Your registration has been cancelled.\n")
+		}
+		if reason == "" && registration.ConfirmedAt != nil && registration.OrderID != nil {
+			body.WriteString("Your payment will be refunded.\n")
+		}
+		body.WriteString("\n")
+	}
+	body.WriteString(details)
+	return subject, body.String()
+}
+
+// Public event details with how many spots are left
+func (s *Server) getEvent(c *gin.Context) {
+	event, err := s.getEventByID(c.Param("id"))
+	if err != nil || event.Status == EventArchived {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+
+	held, err := s.countRegistrations(event.ID, heldRegistrationStatuses)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch registrations"})
+		return
+	}
+	waitlisted, err := s.countRegistrations(event.ID, []string{RegistrationWaitlisted})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch registrations"})
+		return
+	}
+
+	var spotsLeft *int
+	if event.Capacity > 0 {
+		left := event.Capacity - held
+		if left < 0 {
+			left = 0
+		}
+		spotsLeft = &left
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"event":             event,
+		"registered":        held,
+		"spots_left":        spotsLeft,
+		"waitlisted":        waitlisted,
+		"registration_open": registrationWindow(event, time.Now().UTC()) == nil,
+	})
+}
+
+func (s *Server) registerForEvent(c *gin.Context) {
+	userID := c.GetString("user_id")
+	eventID := c.Param("id")
+
+	var req RegisterEventRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	unlock := s.eventLocks.lock(eventID)
+	defer unlock()
+
+	event, err := s.getEventByID(eventID)
+	if err != nil || event.Status == EventArchived {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+
+	// Postgres keeps microseconds, and yieldsSpot compares created_at
+	// exactly
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if err := registrationWindow(event, now); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := eventDistance(event, req.DistanceID); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Event does not offer distance " + strconv.Quote(req.DistanceID)})
+		return
+	}
+	if event.Price > 0 && req.PaymentMethod == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "payment_method is required for paid events"})
+		return
+	}
+
+	existing, err := s.getActiveRegistration(event.ID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch registration"})
+		return
+	}
+	if existing != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "You are already registered for this event", "registration": existing})
+		return
+	}
+
+	if _, err := s.expirePaymentHolds(event, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check capacity"})
+		return
+	}
+
+	full := false
+	if event.Capacity > 0 {
+		held, err := s.countRegistrations(event.ID, heldRegistrationStatuses)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check capacity"})
+			return
+		}
+		full = held >= event.Capacity
+	}
+
+	registration := EventRegistration{
+		ID:            uuid.New().String(),
+		EventID:       event.ID,
+		UserID:        userID,
+		DistanceID:    req.DistanceID,
+		Status:        RegistrationWaitlisted,
+		PaymentMethod: req.PaymentMethod,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	var order map[string]interface{}
+	if !full {
+		order, err = s.admitRegistration(event, &registration, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
+			return
+		}
+	}
+
+	_, _, err = s.supabase.From("event_registrations").
+		Insert(registration, false, "", "", "").
+		Execute()
+
+	if err != nil {
+		if registration.OrderID != nil {
+			s.supabase.From("orders").
+				Update(map[string]interface{}{"status": "failed", "updated_at": now}, "", "").
+				Eq("id", *registration.OrderID).
+				Execute()
+		}
+		// Another instance registered them first
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "You are already registered for this event"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register for event"})
+		return
+	}
+
+	promoted := false
+	if registration.Status != RegistrationWaitlisted {
+		yields, err := s.yieldsSpot(event, &registration)
+		if err == nil && yields {
+			err = s.returnToWaitlist(&registration, now)
+			order = nil
+			// Whoever kept a spot may have cancelled since, which can
+			// promote this registration straight back
+			if err == nil {
+				err = s.promoteWaitlist(event, now)
+			}
+			if err == nil {
+				var current *EventRegistration
+				if current, err = s.getActiveRegistration(event.ID, userID); err == nil && current != nil {
+					promoted = current.Status != RegistrationWaitlisted
+					registration = *current
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("recheck capacity of event %s: %v", event.ID, err)
+		}
+	}
+
+	// A promotion has already been emailed
+	if !promoted {
+		s.sendRegistrationEmail(event, &registration, "")
+	}
+
+	response := gin.H{"registration": registration}
+	if order != nil {
+		response["order"] = order
+		response["payment_url"] = fmt.Sprintf("/payment/%s", order["id"])
+	}
+	if registration.Status == RegistrationWaitlisted {
+		if position, err := s.waitlistPosition(&registration); err == nil {
+			response["waitlist_position"] = position
+		}
+	}
+
+	c.JSON(http.StatusCreated, response)
+}
+
+func (s *Server) getEventRegistration(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	registration, err := s.getActiveRegistration(c.Param("id"), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch registration"})
+		return
+	}
+	if registration == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "You are not registered for this event"})
+		return
+	}
+
+	response := gin.H{"registration": registration}
+	if registration.Status == RegistrationWaitlisted {
+		if position, err := s.waitlistPosition(registration); err == nil {
+			response["waitlist_position"] = position
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Cancelling frees the spot for the next person on the waitlist
+func (s *Server) cancelEventRegistration(c *gin.Context) {
+	userID := c.GetString("user_id")
+	eventID := c.Param("id")
+
+	unlock := s.eventLocks.lock(eventID)
+	defer unlock()
+
+	event, err := s.getEventByID(eventID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+
+	registration, err := s.getActiveRegistration(eventID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch registration"})
+		return
+	}
+	if registration == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "You are not registered for this event"})
+		return
+	}
+
+	now := time.Now().UTC()
+	if err := s.cancelRegistration(registration, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel registration"})
+		return
+	}
+	s.sendRegistrationEmail(event, registration, "")
+
+	if err := s.promoteWaitlist(event, now); err != nil {
+		log.Printf("promote waitlist of event %s: %v", event.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Registration cancelled successfully", "registration": registration})
+}
+
+// Registrations Management
+func (s *Server) getEventRegistrations(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	status := c.Query("status")
+
+	offset := (page - 1) * limit
+
+	query := s.supabase.From("event_registrations").
+		Select("*, profiles!event_registrations_user_id_fkey(full_name, email, university, student_id)", "exact", false).
+		Eq("event_id", c.Param("id")).
+		Order("created_at", &map[string]interface{}{"ascending": true})
+
+	if status != "" {
+		query = query.In("status", strings.Split(status, ","))
+	}
+
+	result, count, err := query.
+		Range(offset, offset+limit-1, "", false).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch registrations"})
+		return
+	}
+
+	var registrations []map[string]interface{}
+	if err := json.Unmarshal(result, &registrations); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse registrations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"registrations": registrations,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": count,
+			"pages": (int(count) + limit - 1) / limit,
+		},
+	})
+}
@@ -0,0 +1,809 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	segmentMinLengthM = 100.0
+	segmentMaxLengthM = 50000.0
+	// How far a run may stray from the segment line and still match
+	segmentToleranceM = 25.0
+	// Spacing of the checkpoints a run must pass, in order
+	segmentCheckpointM = 50.0
+	// A matched stretch of run must be about as long as the segment; this
+	// rejects runs that touch the start and end but take a shortcut or a detour
+	segmentMinLengthRatio = 0.8
+	segmentMaxLengthRatio = 1.3
+	metersPerDegree       = math.Pi / 180 * 6371000
+)
+
+type Segment struct {
+	ID             string    `json:"id"`
+	CreatorID      string    `json:"creator_id"`
+	Name           string    `json:"name"`
+	Description    *string   `json:"description"`
+	ActivityType   string    `json:"activity_type"`
+	Points         []LatLng  `json:"points"`
+	DistanceM      float64   `json:"distance_m"`
+	ElevationGainM *float64  `json:"elevation_gain_m"`
+	MinLat         float64   `json:"min_lat"`
+	MinLng         float64   `json:"min_lng"`
+	MaxLat         float64   `json:"max_lat"`
+	MaxLng         float64   `json:"max_lng"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type SegmentEffort struct {
+	ID             string    `json:"id"`
+	SegmentID      string    `json:"segment_id"`
+	RunID          string    `json:"run_id"`
+	UserID         string    `json:"user_id"`
+	ElapsedSeconds int       `json:"elapsed_seconds"`
+	StartedAt      time.Time `json:"started_at"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type CreateSegmentRequest struct {
+	RunID          string  `json:"run_id" binding:"required"`
+	Name           string  `json:"name" binding:"required,min=1,max=100"`
+	Description    *string `json:"description" binding:"omitempty,max=1000"`
+	StartDistanceM float64 `json:"start_distance_m" binding:"min=0"`
+	EndDistanceM   float64 `json:"end_distance_m" binding:"required,gtfield=StartDistanceM"`
+}
+
+type LeaderboardEntry struct {
+	Rank           int       `json:"rank"`
+	UserID         string    `json:"user_id"`
+	FullName       string    `json:"full_name"`
+	AvatarURL      string    `json:"avatar_url"`
+	University     string    `json:"university"`
+	IsPremium      bool      `json:"is_premium"`
+	RunID          string    `json:"run_id"`
+	ElapsedSeconds int       `json:"elapsed_seconds"`
+	PacePerKm      string    `json:"pace_per_km"`
+	StartedAt      time.Time `json:"started_at"`
+}
+
+// Helper function to decide whether a run can set an effort on a segment:
+// all running types share segments, anything else needs the same type.
+func segmentAccepts(segmentType, runType string) bool {
+	if isRunningActivity(segmentType) && isRunningActivity(runType) {
+		return true
+	}
+	return storedActivityType(segmentType).ID == storedActivityType(runType).ID
+}
+
+// trackSection cuts the part of a track between two distances, with
+// interpolated end points.
+func trackSection(points []TrackPoint, from, to float64) []TrackPoint {
+	profile := newTrackProfile(points, nil)
+	at := func(meters float64) TrackPoint {
+		for i := 1; i < len(points); i++ {
+			if profile.distance[i] >= meters {
+				span := profile.distance[i] - profile.distance[i-1]
+				if span <= 0 {
+					return points[i]
+				}
+				f := (meters - profile.distance[i-1]) / span
+				p := points[i-1]
+				p.Lat += f * (points[i].Lat - p.Lat)
+				p.Lng += f * (points[i].Lng - p.Lng)
+				p.Timestamp = p.Timestamp.Add(time.Duration(f * float64(points[i].Timestamp.Sub(p.Timestamp))))
+				if p.Altitude != nil && points[i].Altitude != nil {
+					alt := *p.Altitude + f*(*points[i].Altitude-*p.Altitude)
+					p.Altitude = &alt
+				}
+				return p
+			}
+		}
+		return points[len(points)-1]
+	}
+
+	section := []TrackPoint{at(from)}
+	for i, p := range points {
+		if profile.distance[i] > from && profile.distance[i] < to {
+			section = append(section, p)
+		}
+	}
+	return append(section, at(to))
+}
+
+// localPlane projects coordinates to meters around a reference point,
+// accurate enough over the few kilometres of a segment.
+type localPlane struct {
+	lat0, lng0, cosLat float64
+}
+
+func newLocalPlane(ref LatLng) localPlane {
+	return localPlane{lat0: ref.Lat, lng0: ref.Lng, cosLat: math.Cos(toRadians(ref.Lat))}
+}
+
+func (p localPlane) xy(lat, lng float64) (float64, float64) {
+	return (lng - p.lng0) * p.cosLat * metersPerDegree, (lat - p.lat0) * metersPerDegree
+}
+
+// projectOnto returns how far along a->b the closest point to c lies
+// (0..1) and its distance from c.
+func projectOnto(cx, cy, ax, ay, bx, by float64) (float64, float64) {
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if length := dx*dx + dy*dy; length > 0 {
+		t = math.Max(0, math.Min(1, ((cx-ax)*dx+(cy-ay)*dy)/length))
+	}
+	return t, math.Hypot(cx-(ax+t*dx), cy-(ay+t*dy))
+}
+
+// segmentCheckpoints samples the segment line every segmentCheckpointM,
+// always including its start and end.
+func segmentCheckpoints(plane localPlane, points []LatLng) [][2]float64 {
+	var checkpoints [][2]float64
+	var carried float64
+	for i, p := range points {
+		x, y := plane.xy(p.Lat, p.Lng)
+		if i == 0 {
+			checkpoints = append(checkpoints, [2]float64{x, y})
+			continue
+		}
+		px, py := plane.xy(points[i-1].Lat, points[i-1].Lng)
+		length := math.Hypot(x-px, y-py)
+		for d := segmentCheckpointM - carried; d < length; d += segmentCheckpointM {
+			f := d / length
+			checkpoints = append(checkpoints, [2]float64{px + f*(x-px), py + f*(y-py)})
+		}
+		carried = math.Mod(carried+length, segmentCheckpointM)
+	}
+	last := points[len(points)-1]
+	x, y := plane.xy(last.Lat, last.Lng)
+	return append(checkpoints, [2]float64{x, y})
+}
+
+type segmentMatch struct {
+	StartedAt      time.Time
+	ElapsedSeconds int
+}
+
+// matchSegment finds every traversal of the segment in a run. The run has
+// to pass each checkpoint in order within segmentToleranceM, so a run going
+// the other way, or only crossing the start and end, doesn't match.
+func matchSegment(segment *Segment, points []TrackPoint) []segmentMatch {
+	if len(points) < 2 || len(segment.Points) < 2 {
+		return nil
+	}
+
+	plane := newLocalPlane(segment.Points[0])
+	checkpoints := segmentCheckpoints(plane, segment.Points)
+	xs := make([]float64, len(points))
+	ys := make([]float64, len(points))
+	for i, p := range points {
+		xs[i], ys[i] = plane.xy(p.Lat, p.Lng)
+	}
+	profile := newTrackProfile(points, nil)
+
+	// nearest finds the first run leg from k on within tolerance of the
+	// checkpoint, then follows it to the closest approach.
+	nearest := func(cp [2]float64, k, limit int) (int, float64, bool) {
+		for ; k < limit; k++ {
+			if _, d := projectOnto(cp[0], cp[1], xs[k], ys[k], xs[k+1], ys[k+1]); d <= segmentToleranceM {
+				break
+			}
+		}
+		if k >= limit {
+			return 0, 0, false
+		}
+		bestK, bestT, bestD := k, 0.0, math.Inf(1)
+		for ; k < limit; k++ {
+			t, d := projectOnto(cp[0], cp[1], xs[k], ys[k], xs[k+1], ys[k+1])
+			if d > segmentToleranceM {
+				break
+			}
+			if d < bestD {
+				bestK, bestT, bestD = k, t, d
+			}
+		}
+		return bestK, bestT, true
+	}
+	// latest finds the closest approach to the checkpoint among the last
+	// legs before limit that are within tolerance of it
+	latest := func(cp [2]float64, from, limit int) (int, float64) {
+		bestK, bestT, bestD := from, 0.0, math.Inf(1)
+		inside := false
+		for k := limit; k >= from; k-- {
+			t, d := projectOnto(cp[0], cp[1], xs[k], ys[k], xs[k+1], ys[k+1])
+			if d > segmentToleranceM {
+				if inside {
+					break
+				}
+				continue
+			}
+			inside = true
+			if d < bestD {
+				bestK, bestT, bestD = k, t, d
+			}
+		}
+		if !inside {
+			_, bestT = projectOnto(cp[0], cp[1], xs[from], ys[from], xs[from+1], ys[from+1])
+		}
+		return bestK, bestT
+	}
+	timeAt := func(k int, t float64) time.Time {
+		dt := points[k+1].Timestamp.Sub(points[k].Timestamp)
+		return points[k].Timestamp.Add(time.Duration(t * float64(dt)))
+	}
+	distanceAt := func(k int, t float64) float64 {
+		return profile.distance[k] + t*(profile.distance[k+1]-profile.distance[k])
+	}
+
+	var matches []segmentMatch
+	legs := len(points) - 1
+	for k := 0; k < legs; {
+		startK, startT, ok := nearest(checkpoints[0], k, legs)
+		if !ok {
+			break
+		}
+		startDistance := distanceAt(startK, startT)
+
+		// Later checkpoints must come within the segment's length (plus slack)
+		limit := startK
+		for limit < legs && profile.distance[limit] < startDistance+segment.DistanceM*segmentMaxLengthRatio {
+			limit++
+		}
+
+		j, t, matched := startK, startT, true
+		for n, cp := range checkpoints[1:] {
+			if j, t, ok = nearest(cp, j, limit); !ok {
+				matched = false
+				break
+			}
+			// Start from the last pass over the start line before the
+			// segment proper, not an earlier one (e.g. out-and-back)
+			if n == 0 {
+				startK, startT = latest(checkpoints[0], startK, j)
+				startDistance = distanceAt(startK, startT)
+			}
+		}
+
+		if matched {
+			length := distanceAt(j, t) - startDistance
+			if length >= segment.DistanceM*segmentMinLengthRatio && length <= segment.DistanceM*segmentMaxLengthRatio {
+				start := timeAt(startK, startT)
+				matches = append(matches, segmentMatch{
+					StartedAt:      start,
+					ElapsedSeconds: int(math.Round(timeAt(j, t).Sub(start).Seconds())),
+				})
+				k = j + 1
+				continue
+			}
+		}
+		k = startK + 1
+	}
+	return matches
+}
+
+// Helper function to match a newly saved run against every segment whose
+// bounding box it crosses and store the efforts
+func (s *Server) matchRunSegments(userID, runID string, activity ActivityType, points []TrackPoint) {
+	if len(points) < 2 {
+		return
+	}
+
+	minLat, minLng, maxLat, maxLng := points[0].Lat, points[0].Lng, points[0].Lat, points[0].Lng
+	for _, p := range points {
+		minLat, maxLat = math.Min(minLat, p.Lat), math.Max(maxLat, p.Lat)
+		minLng, maxLng = math.Min(minLng, p.Lng), math.Max(maxLng, p.Lng)
+	}
+
+	result, _, err := s.supabase.From("segments").
+		Select("*", "", false).
+		Lte("min_lat", fmt.Sprint(maxLat)).
+		Gte("max_lat", fmt.Sprint(minLat)).
+		Lte("min_lng", fmt.Sprint(maxLng)).
+		Gte("max_lng", fmt.Sprint(minLng)).
+		Execute()
+
+	if err != nil {
+		log.Printf("match segments for run %s: %v", runID, err)
+		return
+	}
+
+	var segments []Segment
+	if err := json.Unmarshal(result, &segments); err != nil {
+		log.Printf("match segments for run %s: %v", runID, err)
+		return
+	}
+
+	// A run already matched against a segment keeps its efforts there
+	matched, err := s.matchedSegmentIDs(runID)
+	if err != nil {
+		log.Printf("match segments for run %s: %v", runID, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	var efforts []SegmentEffort
+	for i := range segments {
+		segment := &segments[i]
+		if matched[segment.ID] || !segmentAccepts(segment.ActivityType, activity.ID) {
+			continue
+		}
+		efforts = append(efforts, segmentEfforts(segment, userID, runID, points, now)...)
+	}
+
+	s.storeSegmentEfforts(runID, efforts)
+}
+
+// rematchRunSegments replaces a run's segment efforts after its activity
+// type changes, which can move it on or off segments of another type
+func (s *Server) rematchRunSegments(userID, runID string, activity ActivityType, track *Track) {
+	_, _, err := s.supabase.From("segment_efforts").
+		Delete("", "").
+		Eq("run_id", runID).
+		Execute()
+
+	if err != nil {
+		log.Printf("rematch segments for run %s: %v", runID, err)
+		return
+	}
+
+	if track.HasPoints() {
+		s.matchRunSegments(userID, runID, activity, track.Points)
+	}
+}
+
+// Helper function to turn a run's matches on one segment into efforts
+func segmentEfforts(segment *Segment, userID, runID string, points []TrackPoint, now time.Time) []SegmentEffort {
+	var efforts []SegmentEffort
+	for _, match := range matchSegment(segment, points) {
+		efforts = append(efforts, SegmentEffort{
+			ID:             uuid.New().String(),
+			SegmentID:      segment.ID,
+			RunID:          runID,
+			UserID:         userID,
+			ElapsedSeconds: match.ElapsedSeconds,
+			StartedAt:      match.StartedAt,
+			CreatedAt:      now,
+		})
+	}
+	return efforts
+}
+
+func (s *Server) storeSegmentEfforts(runID string, efforts []SegmentEffort) {
+	if len(efforts) == 0 {
+		return
+	}
+
+	_, _, err := s.supabase.From("segment_efforts").
+		Insert(efforts, false, "", "", "").
+		Execute()
+
+	if err != nil {
+		log.Printf("store segment efforts for run %s: %v", runID, err)
+	}
+}
+
+// Helper function to list the segments a run already has efforts on
+func (s *Server) matchedSegmentIDs(runID string) (map[string]bool, error) {
+	result, _, err := s.supabase.From("segment_efforts").
+		Select("segment_id", "", false).
+		Eq("run_id", runID).
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		SegmentID string `json:"segment_id"`
+	}
+	if err := json.Unmarshal(result, &rows); err != nil {
+		return nil, err
+	}
+
+	matched := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		matched[row.SegmentID] = true
+	}
+	return matched, nil
+}
+
+func (s *Server) getSegmentByID(segmentID string) (*Segment, error) {
+	var segment Segment
+	result, _, err := s.supabase.From("segments").
+		Select("*", "", false).
+		Eq("id", segmentID).
+		Single().
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(result, &segment); err != nil {
+		return nil, err
+	}
+
+	return &segment, nil
+}
+
+// Create a segment from part of one of the user's runs
+func (s *Server) createSegment(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req CreateSegmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	run, err := s.getUserRun(req.RunID, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Run not found"})
+		return
+	}
+	if !run.RouteData.HasPoints() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Run has no GPS route"})
+		return
+	}
+
+	points := run.RouteData.Points
+	if req.EndDistanceM > newTrackProfile(points, nil).totalDistance() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end_distance_m is beyond the end of the run"})
+		return
+	}
+
+	section := trackSection(points, req.StartDistanceM, req.EndDistanceM)
+	distance := trackDistanceKm(section) * 1000
+	if distance < segmentMinLengthM || distance > segmentMaxLengthM {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Segments must be between %.0f m and %.0f km", segmentMinLengthM, segmentMaxLengthM/1000)})
+		return
+	}
+
+	// Segments are public, so they must not reveal the creator's private places
+	zones, err := s.getUserPrivacyZones(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch privacy zones"})
+		return
+	}
+	if len(trimPrivatePoints(section, zones)) < len(section) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Segment passes through one of your privacy zones"})
+		return
+	}
+
+	segment := Segment{
+		ID:           uuid.New().String(),
+		CreatorID:    userID,
+		Name:         req.Name,
+		Description:  req.Description,
+		ActivityType: storedActivityType(run.ActivityType).ID,
+		DistanceM:    math.Round(distance*10) / 10,
+		MinLat:       section[0].Lat,
+		MinLng:       section[0].Lng,
+		MaxLat:       section[0].Lat,
+		MaxLng:       section[0].Lng,
+		CreatedAt:    time.Now().UTC(),
+	}
+	for _, p := range section {
+		segment.Points = append(segment.Points, LatLng{Lat: p.Lat, Lng: p.Lng})
+		segment.MinLat, segment.MaxLat = math.Min(segment.MinLat, p.Lat), math.Max(segment.MaxLat, p.Lat)
+		segment.MinLng, segment.MaxLng = math.Min(segment.MinLng, p.Lng), math.Max(segment.MaxLng, p.Lng)
+	}
+	if altitudes := trackAltitudes(section); len(altitudes) > 1 {
+		gain := math.Round(elevationChange(altitudes).GainM*10) / 10
+		segment.ElevationGainM = &gain
+	}
+
+	_, _, err = s.supabase.From("segments").
+		Insert(segment, false, "", "", "").
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create segment"})
+		return
+	}
+
+	// The source run is the segment's first effort; it was already matched
+	// against every other segment when it was saved
+	s.storeSegmentEfforts(run.ID, segmentEfforts(&segment, userID, run.ID, points, time.Now().UTC()))
+
+	c.JSON(http.StatusCreated, segment)
+}
+
+// List segments, optionally those inside a map viewport
+func (s *Server) getSegments(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	offset := (page - 1) * limit
+
+	query := s.supabase.From("segments").
+		Select("*", "", false)
+
+	// Viewport filter: segments whose bounding box overlaps the map bounds
+	if c.Query("min_lat") != "" {
+		bounds := make(map[string]float64)
+		for _, key := range []string{"min_lat", "min_lng", "max_lat", "max_lng"} {
+			value, err := strconv.ParseFloat(c.Query(key), 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "min_lat, min_lng, max_lat and max_lng must all be numbers"})
+				return
+			}
+			bounds[key] = value
+		}
+		query = query.
+			Lte("min_lat", fmt.Sprint(bounds["max_lat"])).
+			Gte("max_lat", fmt.Sprint(bounds["min_lat"])).
+			Lte("min_lng", fmt.Sprint(bounds["max_lng"])).
+			Gte("max_lng", fmt.Sprint(bounds["min_lng"]))
+	}
+
+	result, count, err := query.
+		Order("created_at", &map[string]interface{}{"ascending": false}).
+		Range(offset, offset+limit-1, "", false).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch segments"})
+		return
+	}
+
+	var segments []Segment
+	if err := json.Unmarshal(result, &segments); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse segments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"segments": segments,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": count,
+			"pages": (count + limit - 1) / limit,
+		},
+	})
+}
+
+// Segment detail with the current user's efforts, fastest first
+func (s *Server) getSegment(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	segment, err := s.getSegmentByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+
+	result, _, err := s.supabase.From("segment_efforts").
+		Select("*", "", false).
+		Eq("segment_id", segment.ID).
+		Eq("user_id", userID).
+		Order("elapsed_seconds", &map[string]interface{}{"ascending": true}).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch efforts"})
+		return
+	}
+
+	var efforts []SegmentEffort
+	if err := json.Unmarshal(result, &efforts); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse efforts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"segment":    segment,
+		"my_efforts": efforts,
+	})
+}
+
+func (s *Server) deleteSegment(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	segment, err := s.getSegmentByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+	if segment.CreatorID != userID && c.GetString("user_role") != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the creator can delete a segment"})
+		return
+	}
+
+	_, _, err = s.supabase.From("segments").
+		Delete("", "").
+		Eq("id", segment.ID).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete segment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Segment deleted successfully"})
+}
+
+// Segment leaderboard: each athlete's best effort, all time or this year,
+// optionally limited to one university or gender
+func (s *Server) getSegmentLeaderboard(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	segment, err := s.getSegmentByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+
+	period := c.DefaultQuery("period", "all_time")
+	if period != "all_time" && period != "year" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be all_time or year"})
+		return
+	}
+	gender := c.Query("gender")
+	if gender != "" && gender != "male" && gender != "female" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "gender must be male or female"})
+		return
+	}
+	university := c.Query("university")
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+		return
+	}
+
+	viewer, err := s.currentViewer(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch efforts"})
+		return
+	}
+
+	// Best effort per athlete, counting only runs the viewer may see, that
+	// aren't held or rejected by anti-cheat review, whose provenance the
+	// leaderboard rule accepts and whose type still suits the segment
+	best := make(map[string]SegmentEffort)
+	for offset := 0; ; offset += recomputePageSize {
+		query := s.supabase.From("segment_efforts").
+			Select("*", "", false).
+			Eq("segment_id", segment.ID)
+		if period == "year" {
+			loc, _ := summaryLocation("", nil)
+			yearStart := periodStart(time.Now().In(loc), "year")
+			query = query.Gte("started_at", yearStart.Format(time.RFC3339))
+		}
+
+		result, _, err := query.
+			Order("started_at", &map[string]interface{}{"ascending": true}).
+			Range(offset, offset+recomputePageSize-1, "", false).
+			Execute()
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch efforts"})
+			return
+		}
+
+		var efforts []SegmentEffort
+		if err := json.Unmarshal(result, &efforts); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse efforts"})
+			return
+		}
+		runIDs := make([]string, len(efforts))
+		for i, effort := range efforts {
+			runIDs[i] = effort.RunID
+		}
+		audiences, err := s.getRunAudiences(runIDs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch efforts"})
+			return
+		}
+		visible, err := s.visibleRunIDs(viewer, audiences)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch efforts"})
+			return
+		}
+		counted := make(map[string]bool, len(audiences))
+		for _, audience := range audiences {
+			counted[audience.ID] = reviewCounts(audience.ReviewStatus) &&
+				s.provenance.Leaderboards.counts(audience.Provenance) &&
+				segmentAccepts(segment.ActivityType, audience.ActivityType)
+		}
+		for _, effort := range efforts {
+			if !visible[effort.RunID] || !counted[effort.RunID] {
+				continue
+			}
+			if current, ok := best[effort.UserID]; !ok || effort.ElapsedSeconds < current.ElapsedSeconds {
+				best[effort.UserID] = effort
+			}
+		}
+
+		if len(efforts) < recomputePageSize {
+			break
+		}
+	}
+
+	athletes := make([]string, 0, len(best))
+	for id := range best {
+		athletes = append(athletes, id)
+	}
+	profiles := make(map[string]Profile)
+	if len(athletes) > 0 {
+		result, _, err := s.supabase.From("profiles").
+			Select("id, full_name, avatar_url, university, is_premium, sex", "", false).
+			In("id", athletes).
+			Execute()
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch athletes"})
+			return
+		}
+
+		var rows []Profile
+		if err := json.Unmarshal(result, &rows); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse athletes"})
+			return
+		}
+		for _, profile := range rows {
+			profiles[profile.ID] = profile
+		}
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(best))
+	for id, effort := range best {
+		profile := profiles[id]
+		if university != "" && profile.University != university {
+			continue
+		}
+		if gender != "" && (profile.Sex == nil || *profile.Sex != gender) {
+			continue
+		}
+		entries = append(entries, LeaderboardEntry{
+			UserID:         id,
+			FullName:       profile.FullName,
+			AvatarURL:      profile.AvatarURL,
+			University:     profile.University,
+			IsPremium:      profile.IsPremium,
+			RunID:          effort.RunID,
+			ElapsedSeconds: effort.ElapsedSeconds,
+			PacePerKm:      formatPace(paceSecondsPerKm(segment.DistanceM/1000, effort.ElapsedSeconds)),
+			StartedAt:      effort.StartedAt,
+		})
+	}
+
+	// Ties go to whoever set the time first
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].ElapsedSeconds != entries[j].ElapsedSeconds {
+			return entries[i].ElapsedSeconds < entries[j].ElapsedSeconds
+		}
+		return entries[i].StartedAt.Before(entries[j].StartedAt)
+	})
+
+	var me *LeaderboardEntry
+	for i := range entries {
+		entries[i].Rank = i + 1
+		if entries[i].UserID == userID {
+			me = &entries[i]
+		}
+	}
+
+	total := len(entries)
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"segment_id": segment.ID,
+		"period":     period,
+		"entries":    entries,
+		"total":      total,
+		"me":         me,
+	})
+}
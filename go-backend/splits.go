@@ -0,0 +1,289 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	metersPerKm   = 1000.0
+	metersPerMile = 1609.344
+)
+
+type Split struct {
+	Index          int      `json:"index"`
+	DistanceM      float64  `json:"distance_m"`
+	ElapsedSeconds int      `json:"elapsed_seconds"`
+	MovingSeconds  int      `json:"moving_seconds"`
+	PaceSeconds    int      `json:"pace_seconds"`
+	AvgHeartRate   *int     `json:"avg_heart_rate,omitempty"`
+	ElevationGainM *float64 `json:"elevation_gain_m,omitempty"`
+}
+
+type SplitAnalysis struct {
+	Unit              string  `json:"unit"`
+	Splits            []Split `json:"splits"`
+	FastestIndex      int     `json:"fastest_index"`
+	SlowestIndex      int     `json:"slowest_index"`
+	FirstHalfSeconds  int     `json:"first_half_seconds"`
+	SecondHalfSeconds int     `json:"second_half_seconds"`
+	NegativeSplit     bool    `json:"negative_split"`
+}
+
+type Lap struct {
+	Index          int       `json:"index"`
+	StartTime      time.Time `json:"start_time"`
+	DistanceM      float64   `json:"distance_m"`
+	ElapsedSeconds int       `json:"elapsed_seconds"`
+	MovingSeconds  int       `json:"moving_seconds"`
+	PaceSecondsKm  int       `json:"pace_seconds_per_km"`
+	AvgHeartRate   *int      `json:"avg_heart_rate,omitempty"`
+}
+
+type RunSplits struct {
+	Distance *SplitAnalysis `json:"distance"`
+	Laps     []Lap          `json:"laps,omitempty"`
+}
+
+// trackProfile is the cumulative distance/time view of a track that
+// split, lap and best-effort calculations interpolate over.
+type trackProfile struct {
+	points   []TrackPoint
+	pauses   []Pause
+	distance []float64 // cumulative meters at each point
+}
+
+func newTrackProfile(points []TrackPoint, pauses []Pause) *trackProfile {
+	profile := &trackProfile{points: points, pauses: pauses, distance: make([]float64, len(points))}
+	for i := 1; i < len(points); i++ {
+		profile.distance[i] = profile.distance[i-1] +
+			haversineKm(points[i-1].Lat, points[i-1].Lng, points[i].Lat, points[i].Lng)*1000
+	}
+	return profile
+}
+
+func (tp *trackProfile) totalDistance() float64 {
+	if len(tp.distance) == 0 {
+		return 0
+	}
+	return tp.distance[len(tp.distance)-1]
+}
+
+// timeAtDistance interpolates when the runner reached the given distance
+func (tp *trackProfile) timeAtDistance(meters float64) time.Time {
+	n := len(tp.points)
+	if meters <= 0 {
+		return tp.points[0].Timestamp
+	}
+	if meters >= tp.distance[n-1] {
+		return tp.points[n-1].Timestamp
+	}
+
+	lo, hi := 0, n-1
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if tp.distance[mid] < meters {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	span := tp.distance[hi] - tp.distance[lo]
+	if span <= 0 {
+		return tp.points[hi].Timestamp
+	}
+	frac := (meters - tp.distance[lo]) / span
+	dt := tp.points[hi].Timestamp.Sub(tp.points[lo].Timestamp)
+	return tp.points[lo].Timestamp.Add(time.Duration(frac * float64(dt)))
+}
+
+// distanceAtTime interpolates how far the runner had gone at a given time
+func (tp *trackProfile) distanceAtTime(t time.Time) float64 {
+	n := len(tp.points)
+	if !t.After(tp.points[0].Timestamp) {
+		return 0
+	}
+	if !t.Before(tp.points[n-1].Timestamp) {
+		return tp.distance[n-1]
+	}
+
+	i := 1
+	for i < n-1 && tp.points[i].Timestamp.Before(t) {
+		i++
+	}
+	dt := tp.points[i].Timestamp.Sub(tp.points[i-1].Timestamp)
+	if dt <= 0 {
+		return tp.distance[i]
+	}
+	frac := float64(t.Sub(tp.points[i-1].Timestamp)) / float64(dt)
+	return tp.distance[i-1] + frac*(tp.distance[i]-tp.distance[i-1])
+}
+
+// movingSeconds is the elapsed time between from and to minus any pause
+// overlapping that window.
+func (tp *trackProfile) movingSeconds(from, to time.Time) float64 {
+	elapsed := to.Sub(from).Seconds()
+	for _, p := range tp.pauses {
+		start, end := p.Start, p.End
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			elapsed -= end.Sub(start).Seconds()
+		}
+	}
+	return elapsed
+}
+
+// Helper function for the per-window heart rate and climb of a split/lap
+func (tp *trackProfile) windowStats(from, to time.Time) (*int, *float64) {
+	var hrSum, hrCount int
+	var altitudes []float64
+	for _, p := range tp.points {
+		if p.Timestamp.Before(from) || p.Timestamp.After(to) {
+			continue
+		}
+		if p.HeartRate != nil {
+			hrSum += *p.HeartRate
+			hrCount++
+		}
+		if p.Altitude != nil {
+			altitudes = append(altitudes, *p.Altitude)
+		}
+	}
+
+	var hr *int
+	if hrCount > 0 {
+		avg := hrSum / hrCount
+		hr = &avg
+	}
+	var elevation *float64
+	if len(altitudes) > 0 {
+		gain := elevationChange(altitudes).GainM
+		elevation = &gain
+	}
+	return hr, elevation
+}
+
+func computeSplits(points []TrackPoint, pauses []Pause, unit string) *SplitAnalysis {
+	unitMeters := metersPerKm
+	if unit == "mi" {
+		unitMeters = metersPerMile
+	} else {
+		unit = "km"
+	}
+
+	analysis := &SplitAnalysis{Unit: unit, FastestIndex: -1, SlowestIndex: -1}
+	if len(points) < 2 {
+		return analysis
+	}
+
+	profile := newTrackProfile(points, pauses)
+	total := profile.totalDistance()
+	if total <= 0 {
+		return analysis
+	}
+
+	for index, from := 0, 0.0; from < total; index, from = index+1, from+unitMeters {
+		to := from + unitMeters
+		if to > total {
+			to = total
+		}
+		// Ignore GPS slop at the very end that would produce a split of a
+		// few metres with a meaningless pace.
+		if to-from < 50 && index > 0 {
+			break
+		}
+
+		start, end := profile.timeAtDistance(from), profile.timeAtDistance(to)
+		moving := profile.movingSeconds(start, end)
+		hr, elevation := profile.windowStats(start, end)
+
+		split := Split{
+			Index:          index + 1,
+			DistanceM:      to - from,
+			ElapsedSeconds: int(math.Round(end.Sub(start).Seconds())),
+			MovingSeconds:  int(math.Round(moving)),
+			PaceSeconds:    int(math.Round(moving / (to - from) * unitMeters)),
+			AvgHeartRate:   hr,
+			ElevationGainM: elevation,
+		}
+		analysis.Splits = append(analysis.Splits, split)
+	}
+
+	// Only full-length splits compete for fastest/slowest
+	for i, split := range analysis.Splits {
+		if split.DistanceM < unitMeters-1 && len(analysis.Splits) > 1 {
+			continue
+		}
+		if analysis.FastestIndex < 0 || split.PaceSeconds < analysis.Splits[analysis.FastestIndex].PaceSeconds {
+			analysis.FastestIndex = i
+		}
+		if analysis.SlowestIndex < 0 || split.PaceSeconds > analysis.Splits[analysis.SlowestIndex].PaceSeconds {
+			analysis.SlowestIndex = i
+		}
+	}
+
+	half := profile.timeAtDistance(total / 2)
+	analysis.FirstHalfSeconds = int(math.Round(profile.movingSeconds(points[0].Timestamp, half)))
+	analysis.SecondHalfSeconds = int(math.Round(profile.movingSeconds(half, points[len(points)-1].Timestamp)))
+	analysis.NegativeSplit = analysis.SecondHalfSeconds < analysis.FirstHalfSeconds
+
+	return analysis
+}
+
+func computeLaps(points []TrackPoint, pauses []Pause, markers []time.Time) []Lap {
+	if len(points) < 2 || len(markers) == 0 {
+		return nil
+	}
+
+	profile := newTrackProfile(points, pauses)
+	first, last := points[0].Timestamp, points[len(points)-1].Timestamp
+
+	boundaries := []time.Time{first}
+	for _, m := range markers {
+		if m.After(boundaries[len(boundaries)-1]) && m.Before(last) {
+			boundaries = append(boundaries, m)
+		}
+	}
+	boundaries = append(boundaries, last)
+
+	laps := make([]Lap, 0, len(boundaries)-1)
+	for i := 1; i < len(boundaries); i++ {
+		start, end := boundaries[i-1], boundaries[i]
+		distance := profile.distanceAtTime(end) - profile.distanceAtTime(start)
+		moving := profile.movingSeconds(start, end)
+		hr, _ := profile.windowStats(start, end)
+
+		lap := Lap{
+			Index:          i,
+			StartTime:      start,
+			DistanceM:      distance,
+			ElapsedSeconds: int(math.Round(end.Sub(start).Seconds())),
+			MovingSeconds:  int(math.Round(moving)),
+			AvgHeartRate:   hr,
+		}
+		if distance > 0 {
+			lap.PaceSecondsKm = int(math.Round(moving / distance * metersPerKm))
+		}
+		laps = append(laps, lap)
+	}
+
+	return laps
+}
+
+func computeRunSplits(points []TrackPoint, pauses []Pause, laps []time.Time) *RunSplits {
+	return &RunSplits{
+		Distance: computeSplits(points, pauses, "km"),
+		Laps:     computeLaps(points, pauses, laps),
+	}
+}
+
+// Helper function to store split and lap analysis on a run row
+func applyRunSplits(run map[string]interface{}, processed *ProcessedTrack) {
+	run["splits"] = computeRunSplits(processed.Points, processed.Pauses, processed.Laps)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Helper function for a 2.5 km run: 1 km at 4 m/s, 1 km at 5 m/s, then
+// 500 m at 2.5 m/s
+func splitTestTrack() []TrackPoint {
+	speeds := append(steady(4, 250), steady(5, 200)...)
+	return syntheticTrack(append(speeds, steady(2.5, 200)...)...)
+}
+
+func TestComputeSplits(t *testing.T) {
+	points := splitTestTrack()
+	pauses := []Pause{{Start: testStart.Add(50 * time.Second), End: testStart.Add(60 * time.Second)}}
+
+	analysis := computeSplits(points, pauses, "km")
+	if analysis.Unit != "km" {
+		t.Errorf("unit = %q, want km", analysis.Unit)
+	}
+
+	want := []Split{
+		{Index: 1, DistanceM: 1000, ElapsedSeconds: 250, MovingSeconds: 240, PaceSeconds: 240},
+		{Index: 2, DistanceM: 1000, ElapsedSeconds: 200, MovingSeconds: 200, PaceSeconds: 200},
+		{Index: 3, DistanceM: 500, ElapsedSeconds: 200, MovingSeconds: 200, PaceSeconds: 400},
+	}
+	if len(analysis.Splits) != len(want) {
+		t.Fatalf("got %d splits, want %d: %+v", len(analysis.Splits), len(want), analysis.Splits)
+	}
+	for i, w := range want {
+		got := analysis.Splits[i]
+		if got.Index != w.Index || math.Abs(got.DistanceM-w.DistanceM) > 0.5 ||
+			got.ElapsedSeconds != w.ElapsedSeconds || got.MovingSeconds != w.MovingSeconds || got.PaceSeconds != w.PaceSeconds {
+			t.Errorf("split %d = %+v, want %+v", i, got, w)
+		}
+	}
+
+	// The short last split is slowest by pace but doesn't compete
+	if analysis.FastestIndex != 1 || analysis.SlowestIndex != 0 {
+		t.Errorf("fastest/slowest = %d/%d, want 1/0", analysis.FastestIndex, analysis.SlowestIndex)
+	}
+	if analysis.FirstHalfSeconds != 290 || analysis.SecondHalfSeconds != 350 || analysis.NegativeSplit {
+		t.Errorf("halves = %d/%d negative=%v, want 290/350 false",
+			analysis.FirstHalfSeconds, analysis.SecondHalfSeconds, analysis.NegativeSplit)
+	}
+}
+
+func TestComputeSplitsUnitsAndEdges(t *testing.T) {
+	negative := syntheticTrack(append(steady(2.5, 400), steady(5, 300)...)...)
+
+	tests := []struct {
+		name          string
+		points        []TrackPoint
+		unit          string
+		wantUnit      string
+		wantDistances []float64
+		wantNegative  bool
+	}{
+		{name: "miles", points: splitTestTrack(), unit: "mi", wantUnit: "mi", wantDistances: []float64{metersPerMile, 2500 - metersPerMile}},
+		{name: "unknown unit falls back to km", points: splitTestTrack(), unit: "furlong", wantUnit: "km", wantDistances: []float64{1000, 1000, 500}},
+		{name: "negative split", points: negative, unit: "km", wantUnit: "km", wantDistances: []float64{1000, 1000, 500}, wantNegative: true},
+		{name: "GPS slop at the end is dropped", points: syntheticTrack(steady(4, 257)...), unit: "km", wantUnit: "km", wantDistances: []float64{1000}},
+		{name: "a single fix has no splits", points: syntheticTrack(), unit: "km", wantUnit: "km"},
+	}
+
+	for _, tt := range tests {
+		analysis := computeSplits(tt.points, nil, tt.unit)
+		if analysis.Unit != tt.wantUnit {
+			t.Errorf("%s: unit = %q, want %q", tt.name, analysis.Unit, tt.wantUnit)
+		}
+		if len(analysis.Splits) != len(tt.wantDistances) {
+			t.Errorf("%s: got %d splits, want %d", tt.name, len(analysis.Splits), len(tt.wantDistances))
+			continue
+		}
+		for i, want := range tt.wantDistances {
+			if got := analysis.Splits[i].DistanceM; math.Abs(got-want) > 0.5 {
+				t.Errorf("%s: split %d is %.1f m, want %.1f", tt.name, i, got, want)
+			}
+		}
+		if analysis.NegativeSplit != tt.wantNegative {
+			t.Errorf("%s: negative split = %v, want %v", tt.name, analysis.NegativeSplit, tt.wantNegative)
+		}
+	}
+}
+
+func TestComputeLaps(t *testing.T) {
+	points := splitTestTrack()
+	markers := []time.Time{
+		testStart.Add(-time.Minute), // before the run
+		testStart.Add(100 * time.Second),
+		testStart.Add(100 * time.Second), // pressed twice
+		testStart.Add(400 * time.Second),
+		testStart.Add(time.Hour), // after the run
+	}
+
+	laps := computeLaps(points, nil, markers)
+	want := []Lap{
+		{Index: 1, StartTime: testStart, DistanceM: 400, ElapsedSeconds: 100, PaceSecondsKm: 250},
+		{Index: 2, StartTime: testStart.Add(100 * time.Second), DistanceM: 1350, ElapsedSeconds: 300, PaceSecondsKm: 222},
+		{Index: 3, StartTime: testStart.Add(400 * time.Second), DistanceM: 750, ElapsedSeconds: 250, PaceSecondsKm: 333},
+	}
+	if len(laps) != len(want) {
+		t.Fatalf("got %d laps, want %d: %+v", len(laps), len(want), laps)
+	}
+	for i, w := range want {
+		got := laps[i]
+		if got.Index != w.Index || !got.StartTime.Equal(w.StartTime) || math.Abs(got.DistanceM-w.DistanceM) > 0.5 ||
+			got.ElapsedSeconds != w.ElapsedSeconds || got.MovingSeconds != w.ElapsedSeconds || got.PaceSecondsKm != w.PaceSecondsKm {
+			t.Errorf("lap %d = %+v, want %+v", i, got, w)
+		}
+	}
+
+	if laps := computeLaps(points, nil, nil); laps != nil {
+		t.Errorf("no markers gave %d laps, want none", len(laps))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// RunStats are the lifetime totals kept in user_stats so profiles and
+// leaderboards don't have to scan every run. Only running activity types
+// count towards the totals; cross-training is tallied separately.
+type RunStats struct {
+	UserID               string     `json:"user_id"`
+	TotalRuns            int        `json:"total_runs"`
+	TotalDistanceKm      float64    `json:"total_distance_km"`
+	TotalDurationSeconds int        `json:"total_duration_seconds"`
+	TotalCalories        int        `json:"total_calories"`
+	TotalElevationGainM  float64    `json:"total_elevation_gain_m"`
+	LongestRunKm         float64    `json:"longest_run_km"`
+	OtherActivities      int        `json:"other_activities"`
+	LastActivityAt       *time.Time `json:"last_activity_at"`
+	UpdatedAt            time.Time  `json:"updated_at"`
+}
+
+// Helper function to rebuild a user's totals from their runs
+func (s *Server) recomputeUserStats(userID string) (*RunStats, error) {
+	stats := &RunStats{UserID: userID, UpdatedAt: time.Now().UTC()}
+	for offset := 0; ; offset += recomputePageSize {
+		result, _, err := s.supabase.From("runs").
+			Select("activity_type, distance_km, duration_seconds, calories_burned, elevation_gain_m, review_status, started_at, created_at", "", false).
+			Eq("user_id", userID).
+			Order("created_at", &map[string]interface{}{"ascending": true}).
+			Range(offset, offset+recomputePageSize-1, "", false).
+			Execute()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var page []Run
+		if err := json.Unmarshal(result, &page); err != nil {
+			return nil, err
+		}
+
+		for _, run := range page {
+			at := run.CreatedAt
+			if run.StartedAt != nil {
+				at = *run.StartedAt
+			}
+			if stats.LastActivityAt == nil || at.After(*stats.LastActivityAt) {
+				stats.LastActivityAt = &at
+			}
+
+			// Runs held for review or rejected stay out of the totals
+			if !reviewCounts(run.ReviewStatus) {
+				continue
+			}
+			if !isRunningActivity(run.ActivityType) {
+				stats.OtherActivities++
+				continue
+			}
+
+			stats.TotalRuns++
+			stats.TotalDistanceKm += run.DistanceKm
+			stats.TotalDurationSeconds += run.DurationSeconds
+			stats.TotalCalories += run.CaloriesBurned
+			if run.ElevationGainM != nil {
+				stats.TotalElevationGainM += *run.ElevationGainM
+			}
+			if run.DistanceKm > stats.LongestRunKm {
+				stats.LongestRunKm = run.DistanceKm
+			}
+		}
+
+		if len(page) < recomputePageSize {
+			break
+		}
+	}
+
+	_, _, err := s.supabase.From("user_stats").
+		Insert(stats, true, "user_id", "", "").
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Helper function to refresh stats in the background after a run changes
+func (s *Server) refreshUserStats(userID string) {
+	if _, err := s.recomputeUserStats(userID); err != nil {
+		log.Printf("recompute stats for %s: %v", userID, err)
+	}
+}
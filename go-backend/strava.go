@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stravaPageSize = 50
+	stravaTimeout  = 20 * time.Second
+)
+
+// Strava sport types we import, by activity type. Anything else (swims,
+// yoga, e-bike rides, ...) is skipped.
+var stravaSportTypes = map[string]string{
+	"run":         "run",
+	"trailrun":    "trail_run",
+	"virtualrun":  "treadmill",
+	"walk":        "walk",
+	"hike":        "walk",
+	"ride":        "cycling",
+	"virtualride": "cycling",
+	"gravelride":  "cycling",
+}
+
+type StravaConfig struct {
+	ClientID     string
+	ClientSecret string
+	// Base URL of the Strava API; point it at cmd/fake-strava locally
+	BaseURL     string
+	RedirectURI string
+	// Token Strava echoes back when validating the webhook subscription
+	VerifyToken    string
+	SubscriptionID string
+}
+
+func loadStravaConfig() StravaConfig {
+	return StravaConfig{
+		ClientID:       envString("STRAVA_CLIENT_ID", ""),
+		ClientSecret:   envString("STRAVA_CLIENT_SECRET", ""),
+		BaseURL:        strings.TrimRight(envString("STRAVA_API_URL", "https://www.strava.com"), "/"),
+		RedirectURI:    envString("STRAVA_REDIRECT_URI", ""),
+		VerifyToken:    envString("STRAVA_VERIFY_TOKEN", ""),
+		SubscriptionID: envString("STRAVA_SUBSCRIPTION_ID", ""),
+	}
+}
+
+// StravaClient implements ActivityProvider against the Strava v3 API
+type StravaClient struct {
+	config StravaConfig
+	http   *http.Client
+}
+
+func NewStravaClient(config StravaConfig) *StravaClient {
+	return &StravaClient{config: config, http: &http.Client{Timeout: stravaTimeout}}
+}
+
+type stravaTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+	Athlete      *struct {
+		ID int64 `json:"id"`
+	} `json:"athlete"`
+}
+
+type stravaActivity struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	SportType   string    `json:"sport_type"`
+	StartDate   time.Time `json:"start_date"`
+	ElapsedTime int       `json:"elapsed_time"`
+	MovingTime  int       `json:"moving_time"`
+	Distance    float64   `json:"distance"`
+	Manual      bool      `json:"manual"`
+	Private     bool      `json:"private"`
+}
+
+type stravaStream struct {
+	Data json.RawMessage `json:"data"`
+}
+
+func (a stravaActivity) toProvider() ProviderActivity {
+	sport := a.SportType
+	if sport == "" {
+		sport = a.Type
+	}
+	return ProviderActivity{
+		ID:             strconv.FormatInt(a.ID, 10),
+		Name:           a.Name,
+		ActivityType:   stravaSportTypes[strings.ToLower(sport)],
+		StartedAt:      a.StartDate,
+		ElapsedSeconds: a.ElapsedTime,
+		MovingSeconds:  a.MovingTime,
+		DistanceKm:     a.Distance / 1000,
+		Manual:         a.Manual,
+		Private:        a.Private,
+	}
+}
+
+func (sc *StravaClient) Name() string {
+	return "strava"
+}
+
+func (sc *StravaClient) AuthorizeURL(state string) string {
+	query := url.Values{
+		"client_id":       {sc.config.ClientID},
+		"redirect_uri":    {sc.config.RedirectURI},
+		"response_type":   {"code"},
+		"approval_prompt": {"auto"},
+		"scope":           {"activity:read_all"},
+		"state":           {state},
+	}
+	return sc.config.BaseURL + "/oauth/authorize?" + query.Encode()
+}
+
+func (sc *StravaClient) ExchangeCode(ctx context.Context, code string) (*ProviderToken, error) {
+	return sc.token(ctx, url.Values{"grant_type": {"authorization_code"}, "code": {code}})
+}
+
+func (sc *StravaClient) RefreshToken(ctx context.Context, refreshToken string) (*ProviderToken, error) {
+	return sc.token(ctx, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+}
+
+func (sc *StravaClient) token(ctx context.Context, form url.Values) (*ProviderToken, error) {
+	form.Set("client_id", sc.config.ClientID)
+	form.Set("client_secret", sc.config.ClientSecret)
+
+	var response stravaTokenResponse
+	if err := sc.do(ctx, http.MethodPost, "/oauth/token", "", form, &response); err != nil {
+		return nil, err
+	}
+
+	token := &ProviderToken{
+		AccessToken:  response.AccessToken,
+		RefreshToken: response.RefreshToken,
+		ExpiresAt:    time.Unix(response.ExpiresAt, 0).UTC(),
+	}
+	if response.Athlete != nil {
+		token.AthleteID = strconv.FormatInt(response.Athlete.ID, 10)
+	}
+	return token, nil
+}
+
+func (sc *StravaClient) Deauthorize(ctx context.Context, accessToken string) error {
+	return sc.do(ctx, http.MethodPost, "/oauth/deauthorize", accessToken, url.Values{}, nil)
+}
+
+func (sc *StravaClient) ListActivities(ctx context.Context, accessToken string, after time.Time, page int) ([]ProviderActivity, error) {
+	query := url.Values{
+		"after":    {strconv.FormatInt(after.Unix(), 10)},
+		"page":     {strconv.Itoa(page)},
+		"per_page": {strconv.Itoa(stravaPageSize)},
+	}
+
+	var activities []stravaActivity
+	if err := sc.do(ctx, http.MethodGet, "/api/v3/athlete/activities?"+query.Encode(), accessToken, nil, &activities); err != nil {
+		return nil, err
+	}
+
+	result := make([]ProviderActivity, len(activities))
+	for i, activity := range activities {
+		result[i] = activity.toProvider()
+	}
+	return result, nil
+}
+
+func (sc *StravaClient) GetActivity(ctx context.Context, accessToken, id string) (*ProviderActivity, error) {
+	var activity stravaActivity
+	if err := sc.do(ctx, http.MethodGet, "/api/v3/activities/"+url.PathEscape(id), accessToken, nil, &activity); err != nil {
+		return nil, err
+	}
+	result := activity.toProvider()
+	return &result, nil
+}
+
+// GetTrack fetches the activity's streams and zips them into track
+// points. Activities without GPS (treadmill, manual) have no track.
+func (sc *StravaClient) GetTrack(ctx context.Context, accessToken string, activity *ProviderActivity) ([]TrackPoint, error) {
+	query := url.Values{
+		"keys":        {"latlng,time,altitude,heartrate,cadence"},
+		"key_by_type": {"true"},
+	}
+
+	var streams map[string]stravaStream
+	path := "/api/v3/activities/" + url.PathEscape(activity.ID) + "/streams?" + query.Encode()
+	if err := sc.do(ctx, http.MethodGet, path, accessToken, nil, &streams); err != nil {
+		return nil, err
+	}
+
+	var latlng [][2]float64
+	var offsets []int
+	var altitude []float64
+	var heartRate, cadence []int
+	if stream, ok := streams["latlng"]; ok {
+		if err := json.Unmarshal(stream.Data, &latlng); err != nil {
+			return nil, err
+		}
+	}
+	if stream, ok := streams["time"]; ok {
+		if err := json.Unmarshal(stream.Data, &offsets); err != nil {
+			return nil, err
+		}
+	}
+	if len(latlng) == 0 || len(offsets) != len(latlng) {
+		return nil, nil
+	}
+	// The remaining streams are optional; a malformed one is left out
+	if stream, ok := streams["altitude"]; ok {
+		json.Unmarshal(stream.Data, &altitude)
+	}
+	if stream, ok := streams["heartrate"]; ok {
+		json.Unmarshal(stream.Data, &heartRate)
+	}
+	if stream, ok := streams["cadence"]; ok {
+		json.Unmarshal(stream.Data, &cadence)
+	}
+
+	points := make([]TrackPoint, len(latlng))
+	for i, position := range latlng {
+		points[i] = TrackPoint{
+			Lat:       position[0],
+			Lng:       position[1],
+			Timestamp: activity.StartedAt.Add(time.Duration(offsets[i]) * time.Second),
+		}
+		if i < len(altitude) {
+			points[i].Altitude = &altitude[i]
+		}
+		if i < len(heartRate) && heartRate[i] > 0 {
+			points[i].HeartRate = &heartRate[i]
+		}
+		if i < len(cadence) && cadence[i] > 0 {
+			points[i].Cadence = &cadence[i]
+		}
+	}
+	return points, nil
+}
+
+// Subscribe registers our webhook callback; Strava validates it with a
+// GET to the callback before answering.
+func (sc *StravaClient) Subscribe(ctx context.Context, callbackURL string) (string, error) {
+	form := url.Values{
+		"client_id":     {sc.config.ClientID},
+		"client_secret": {sc.config.ClientSecret},
+		"callback_url":  {callbackURL},
+		"verify_token":  {sc.config.VerifyToken},
+	}
+
+	var response struct {
+		ID int64 `json:"id"`
+	}
+	if err := sc.do(ctx, http.MethodPost, "/api/v3/push_subscriptions", "", form, &response); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(response.ID, 10), nil
+}
+
+// Helper function to call the API, posting form as the body when given
+// and decoding the JSON response into out
+func (sc *StravaClient) do(ctx context.Context, method, path, accessToken string, form url.Values, out interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, sc.config.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	resp, err := sc.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("strava rate limit reached")
+	}
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("strava %s %s: %s: %s", method, strings.SplitN(path, "?", 2)[0], resp.Status, bytes.TrimSpace(message))
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			err = fmt.Errorf("%w: %v", errProviderNotFound, err)
+		case resp.StatusCode == http.StatusUnauthorized,
+			// A revoked refresh token is answered with a 400
+			resp.StatusCode == http.StatusBadRequest && path == "/oauth/token":
+			err = fmt.Errorf("%w: %v", errProviderUnauthorized, err)
+		}
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
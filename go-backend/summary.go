@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	_ "time/tzdata" // IANA zones for containers without /usr/share/zoneinfo
+
+	"github.com/gin-gonic/gin"
+)
+
+// Used when neither the request nor the profile names a timezone
+const defaultTimezone = "Asia/Ho_Chi_Minh"
+
+var summaryPeriods = map[string]struct {
+	defaultCount int
+	maxCount     int
+}{
+	"week":  {12, 104},
+	"month": {12, 60},
+	"year":  {5, 20},
+}
+
+type PeriodSummary struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	Runs            int       `json:"runs"`
+	DistanceKm      float64   `json:"distance_km"`
+	DurationSeconds int       `json:"duration_seconds"`
+	MovingSeconds   int       `json:"moving_seconds"`
+	ElevationGainM  float64   `json:"elevation_gain_m"`
+	Calories        int       `json:"calories"`
+	AvgPaceSeconds  *int      `json:"avg_pace_seconds_per_km"`
+	AvgPacePerKm    string    `json:"avg_pace_per_km"`
+}
+
+// PeriodComparison compares the current period so far with the same
+// stretch of the previous one, e.g. Monday-Wednesday against last
+// Monday-Wednesday. Percentages are nil when the previous value is zero.
+type PeriodComparison struct {
+	Previous         PeriodSummary `json:"previous_to_date"`
+	RunsChange       int           `json:"runs_change"`
+	DistanceKmChange float64       `json:"distance_km_change"`
+	DistancePct      *float64      `json:"distance_change_pct"`
+	DurationChange   int           `json:"duration_seconds_change"`
+	DurationPct      *float64      `json:"duration_change_pct"`
+	ElevationChange  float64       `json:"elevation_gain_m_change"`
+}
+
+type Streaks struct {
+	CurrentDays  int `json:"current_days"`
+	LongestDays  int `json:"longest_days"`
+	CurrentWeeks int `json:"current_weeks"`
+	LongestWeeks int `json:"longest_weeks"`
+}
+
+type DayActivity struct {
+	Date       string  `json:"date"`
+	Runs       int     `json:"runs"`
+	DistanceKm float64 `json:"distance_km"`
+}
+
+type summaryRun struct {
+	StartedAt       *time.Time `json:"started_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	DistanceKm      float64    `json:"distance_km"`
+	DurationSeconds int        `json:"duration_seconds"`
+	MovingSeconds   *int       `json:"moving_seconds"`
+	ElevationGainM  *float64   `json:"elevation_gain_m"`
+	CaloriesBurned  int        `json:"calories_burned"`
+	ReviewStatus    string     `json:"review_status"`
+}
+
+func (r summaryRun) at() time.Time {
+	if r.StartedAt != nil {
+		return *r.StartedAt
+	}
+	return r.CreatedAt
+}
+
+// Helper function to pick the user's timezone: ?tz= first, then the
+// profile, then the app default.
+func summaryLocation(requested string, profile *Profile) (*time.Location, error) {
+	name := requested
+	if name == "" && profile != nil && profile.Timezone != nil {
+		name = *profile.Timezone
+	}
+	if name == "" {
+		name = defaultTimezone
+	}
+	return time.LoadLocation(name)
+}
+
+// periodStart truncates t to the start of its week (Monday), month or
+// year in t's location.
+func periodStart(t time.Time, period string) time.Time {
+	y, m, d := t.Date()
+	switch period {
+	case "year":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, t.Location())
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	default:
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, t.Location())
+	}
+}
+
+func addPeriods(start time.Time, period string, n int) time.Time {
+	switch period {
+	case "year":
+		return start.AddDate(n, 0, 0)
+	case "month":
+		return start.AddDate(0, n, 0)
+	default:
+		return start.AddDate(0, 0, 7*n)
+	}
+}
+
+func (p *PeriodSummary) add(run summaryRun) {
+	p.Runs++
+	p.DistanceKm += run.DistanceKm
+	p.DurationSeconds += run.DurationSeconds
+	if run.MovingSeconds != nil && *run.MovingSeconds > 0 {
+		p.MovingSeconds += *run.MovingSeconds
+	} else {
+		p.MovingSeconds += run.DurationSeconds
+	}
+	if run.ElevationGainM != nil {
+		p.ElevationGainM += *run.ElevationGainM
+	}
+	p.Calories += run.CaloriesBurned
+}
+
+// Helper function to round totals and derive the average pace once all
+// runs are added
+func (p *PeriodSummary) finish() {
+	p.DistanceKm = math.Round(p.DistanceKm*100) / 100
+	p.ElevationGainM = math.Round(p.ElevationGainM*10) / 10
+	if p.DistanceKm > 0 {
+		pace := paceSecondsPerKm(p.DistanceKm, p.MovingSeconds)
+		p.AvgPaceSeconds = &pace
+		p.AvgPacePerKm = formatPace(pace)
+	}
+}
+
+func summarizeBetween(runs []summaryRun, from, to time.Time) PeriodSummary {
+	summary := PeriodSummary{Start: from, End: to}
+	for _, run := range runs {
+		if at := run.at(); !at.Before(from) && at.Before(to) {
+			summary.add(run)
+		}
+	}
+	summary.finish()
+	return summary
+}
+
+func percentChange(current, previous float64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	pct := math.Round((current-previous)/previous*1000) / 10
+	return &pct
+}
+
+func comparePeriods(current, previous PeriodSummary) PeriodComparison {
+	return PeriodComparison{
+		Previous:         previous,
+		RunsChange:       current.Runs - previous.Runs,
+		DistanceKmChange: math.Round((current.DistanceKm-previous.DistanceKm)*100) / 100,
+		DistancePct:      percentChange(current.DistanceKm, previous.DistanceKm),
+		DurationChange:   current.DurationSeconds - previous.DurationSeconds,
+		DurationPct:      percentChange(float64(current.DurationSeconds), float64(previous.DurationSeconds)),
+		ElevationChange:  math.Round((current.ElevationGainM-previous.ElevationGainM)*10) / 10,
+	}
+}
+
+// computeStreaks counts consecutive active days and weeks. A streak is
+// still current if the last activity was yesterday (or last week), since
+// today isn't over yet.
+func computeStreaks(runs []summaryRun, now time.Time) Streaks {
+	loc := now.Location()
+	days := make(map[int64]bool)
+	weeks := make(map[int64]bool)
+	for _, run := range runs {
+		at := run.at().In(loc)
+		y, m, d := at.Date()
+		days[time.Date(y, m, d, 0, 0, 0, 0, loc).Unix()] = true
+		weeks[periodStart(at, "week").Unix()] = true
+	}
+
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	currentDays, longestDays := streakLengths(days, today, 1)
+	currentWeeks, longestWeeks := streakLengths(weeks, periodStart(now, "week"), 7)
+
+	return Streaks{
+		CurrentDays:  currentDays,
+		LongestDays:  longestDays,
+		CurrentWeeks: currentWeeks,
+		LongestWeeks: longestWeeks,
+	}
+}
+
+// streakLengths walks a set of active day or week starts (as Unix times
+// of local midnight) in steps of stepDays.
+func streakLengths(active map[int64]bool, latest time.Time, stepDays int) (current, longest int) {
+	loc := latest.Location()
+	step := func(unix int64, n int) int64 {
+		return time.Unix(unix, 0).In(loc).AddDate(0, 0, n*stepDays).Unix()
+	}
+
+	start := latest.Unix()
+	if !active[start] {
+		start = step(start, -1)
+	}
+	for t := start; active[t]; t = step(t, -1) {
+		current++
+	}
+
+	for first := range active {
+		// Only count from the first unit of each streak
+		if active[step(first, -1)] {
+			continue
+		}
+		length := 0
+		for t := first; active[t]; t = step(t, 1) {
+			length++
+		}
+		if length > longest {
+			longest = length
+		}
+	}
+	return current, longest
+}
+
+// Helper function to page through every run the summaries need. Runs held
+// for review or rejected are left out, as they are from the lifetime stats.
+func (s *Server) getSummaryRuns(userID string, types []string) ([]summaryRun, error) {
+	var runs []summaryRun
+	for offset := 0; ; offset += recomputePageSize {
+		query := s.supabase.From("runs").
+			Select("started_at, created_at, distance_km, duration_seconds, moving_seconds, elevation_gain_m, calories_burned, review_status", "", false).
+			Eq("user_id", userID)
+		if len(types) > 0 {
+			query = query.In("activity_type", types)
+		}
+
+		result, _, err := query.
+			Order("created_at", &map[string]interface{}{"ascending": true}).
+			Range(offset, offset+recomputePageSize-1, "", false).
+			Execute()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var page []summaryRun
+		if err := json.Unmarshal(result, &page); err != nil {
+			return nil, err
+		}
+		for _, run := range page {
+			if reviewCounts(run.ReviewStatus) {
+				runs = append(runs, run)
+			}
+		}
+
+		if len(page) < recomputePageSize {
+			return runs, nil
+		}
+	}
+}
+
+// Training summaries per week, month or year in the user's timezone
+func (s *Server) getRunSummary(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	period := c.DefaultQuery("period", "week")
+	limits, ok := summaryPeriods[period]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be one of week, month, year"})
+		return
+	}
+
+	count := limits.defaultCount
+	if value := c.Query("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > limits.maxCount {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "count must be between 1 and " + strconv.Itoa(limits.maxCount)})
+			return
+		}
+		count = n
+	}
+
+	loc, err := summaryLocation(c.Query("tz"), currentProfile(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone"})
+		return
+	}
+
+	// Summaries default to running so cross-training doesn't inflate mileage
+	typeFilter := c.DefaultQuery("type", "running")
+	types, err := parseActivityTypeFilter(typeFilter)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	runs, err := s.getSummaryRuns(userID, types)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch runs"})
+		return
+	}
+
+	now := time.Now().In(loc)
+	currentStart := periodStart(now, period)
+	first := addPeriods(currentStart, period, -(count - 1))
+
+	periods := make([]PeriodSummary, 0, count)
+	for i := 0; i < count; i++ {
+		start := addPeriods(first, period, i)
+		periods = append(periods, summarizeBetween(runs, start, addPeriods(start, period, 1)))
+	}
+	current := periods[len(periods)-1]
+
+	// Compare like with like: the previous period up to the same point
+	previousStart := addPeriods(currentStart, period, -1)
+	previousToDate := summarizeBetween(runs, previousStart, previousStart.Add(now.Sub(currentStart)))
+
+	days := make([]DayActivity, 0)
+	byDate := make(map[string]int)
+	for _, run := range runs {
+		at := run.at().In(loc)
+		if at.Before(first) {
+			continue
+		}
+		date := at.Format("2006-01-02")
+		i, ok := byDate[date]
+		if !ok {
+			i = len(days)
+			byDate[date] = i
+			days = append(days, DayActivity{Date: date})
+		}
+		days[i].Runs++
+		days[i].DistanceKm = math.Round((days[i].DistanceKm+run.DistanceKm)*100) / 100
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+
+	c.JSON(http.StatusOK, gin.H{
+		"period":     period,
+		"timezone":   loc.String(),
+		"periods":    periods,
+		"current":    current,
+		"comparison": comparePeriods(current, previousToDate),
+		"streaks":    computeStreaks(runs, now),
+		"days":       days,
+	})
+}
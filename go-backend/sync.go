@@ -0,0 +1,892 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// Refresh access tokens this long before they expire
+	syncTokenMargin = 5 * time.Minute
+	// Upper bound on pages fetched in one backfill
+	syncMaxPages   = 20
+	syncJobTimeout = 10 * time.Minute
+	// How long the user has to grant access before the OAuth state expires
+	oauthStateTTL = 10 * time.Minute
+)
+
+// Outcomes of syncing one activity
+const (
+	syncImported  = "imported"
+	syncDuplicate = "duplicate"
+	syncSkipped   = "skipped"
+)
+
+// Errors providers wrap so callers can tell a missing activity or a
+// revoked authorization from a transient failure
+var (
+	errProviderNotFound     = errors.New("not found on provider")
+	errProviderUnauthorized = errors.New("authorization revoked on provider")
+)
+
+type SyncConfig struct {
+	BackfillInterval time.Duration
+	// How far back the first backfill of a new connection reaches
+	BackfillDays int
+}
+
+func loadSyncConfig() SyncConfig {
+	return SyncConfig{
+		BackfillInterval: time.Duration(envInt("SYNC_BACKFILL_INTERVAL_MINUTES", 360)) * time.Minute,
+		BackfillDays:     envInt("SYNC_BACKFILL_DAYS", 30),
+	}
+}
+
+type ProviderToken struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+	AthleteID    string
+}
+
+// ProviderActivity is an activity as a provider describes it, before any
+// track is fetched. ActivityType is empty for sports we don't import.
+type ProviderActivity struct {
+	ID             string
+	Name           string
+	ActivityType   string
+	StartedAt      time.Time
+	ElapsedSeconds int
+	MovingSeconds  int
+	DistanceKm     float64
+	Manual         bool
+	Private        bool
+}
+
+// ActivityProvider is a third-party service whose activities are synced
+// into runs. StravaClient is the real one; pointing it at cmd/fake-strava
+// exercises the whole flow locally.
+type ActivityProvider interface {
+	Name() string
+	AuthorizeURL(state string) string
+	ExchangeCode(ctx context.Context, code string) (*ProviderToken, error)
+	RefreshToken(ctx context.Context, refreshToken string) (*ProviderToken, error)
+	Deauthorize(ctx context.Context, accessToken string) error
+	// Activities that started after the given time, oldest first; an
+	// empty page means there are no more
+	ListActivities(ctx context.Context, accessToken string, after time.Time, page int) ([]ProviderActivity, error)
+	GetActivity(ctx context.Context, accessToken, id string) (*ProviderActivity, error)
+	// The GPS track, or nil for activities recorded without one
+	GetTrack(ctx context.Context, accessToken string, activity *ProviderActivity) ([]TrackPoint, error)
+	// Register the webhook callback, returning the subscription ID
+	Subscribe(ctx context.Context, callbackURL string) (string, error)
+}
+
+// syncable is false for sports we don't import and for activities with
+// no duration to check
+func (a *ProviderActivity) syncable() bool {
+	return a.ActivityType != "" && a.ElapsedSeconds > 0
+}
+
+// SyncConnection links a user to their account on a provider
+type SyncConnection struct {
+	ID           string     `json:"id"`
+	UserID       string     `json:"user_id"`
+	Provider     string     `json:"provider"`
+	AthleteID    string     `json:"athlete_id"`
+	AccessToken  string     `json:"access_token"`
+	RefreshToken string     `json:"refresh_token"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	LastSyncedAt *time.Time `json:"last_synced_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+type SyncResult struct {
+	Imported   int `json:"imported"`
+	Duplicates int `json:"duplicates"`
+	Skipped    int `json:"skipped"`
+}
+
+type ConnectProviderRequest struct {
+	Code  string `json:"code" binding:"required"`
+	State string `json:"state" binding:"required"`
+}
+
+type CreateSubscriptionRequest struct {
+	CallbackURL string `json:"callback_url" binding:"required,url"`
+}
+
+// Strava webhook event; IDs are numbers and updates are all strings
+type stravaWebhookEvent struct {
+	ObjectType     string            `json:"object_type"`
+	ObjectID       int64             `json:"object_id"`
+	AspectType     string            `json:"aspect_type"`
+	OwnerID        int64             `json:"owner_id"`
+	SubscriptionID int64             `json:"subscription_id"`
+	Updates        map[string]string `json:"updates"`
+}
+
+// Helper function to resolve the :provider route parameter
+func (s *Server) provider(c *gin.Context) (ActivityProvider, bool) {
+	provider, ok := s.providers[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown or unconfigured provider"})
+	}
+	return provider, ok
+}
+
+func (s *Server) getConnection(provider, userID string) (*SyncConnection, error) {
+	return s.findConnection(provider, "user_id", userID)
+}
+
+func (s *Server) getConnectionByAthlete(provider, athleteID string) (*SyncConnection, error) {
+	return s.findConnection(provider, "athlete_id", athleteID)
+}
+
+func (s *Server) findConnection(provider, column, value string) (*SyncConnection, error) {
+	var connection SyncConnection
+
+	result, _, err := s.supabase.From("sync_connections").
+		Select("*", "", false).
+		Eq("provider", provider).
+		Eq(column, value).
+		Single().
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(result, &connection); err != nil {
+		return nil, err
+	}
+
+	return &connection, nil
+}
+
+// Helper function to return a usable access token, refreshing (and
+// storing) it when it is about to expire
+func (s *Server) connectionToken(ctx context.Context, provider ActivityProvider, connection *SyncConnection) (string, error) {
+	if time.Now().Add(syncTokenMargin).Before(connection.ExpiresAt) {
+		return connection.AccessToken, nil
+	}
+	return s.refreshConnectionToken(ctx, provider, connection)
+}
+
+// Helper function to exchange the connection's refresh token for a new
+// access token and store both
+func (s *Server) refreshConnectionToken(ctx context.Context, provider ActivityProvider, connection *SyncConnection) (string, error) {
+	token, err := provider.RefreshToken(ctx, connection.RefreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	_, _, err = s.supabase.From("sync_connections").
+		Update(map[string]interface{}{
+			"access_token":  token.AccessToken,
+			"refresh_token": token.RefreshToken,
+			"expires_at":    token.ExpiresAt,
+			"updated_at":    time.Now().UTC(),
+		}, "", "").
+		Eq("id", connection.ID).
+		Execute()
+
+	if err != nil {
+		return "", err
+	}
+
+	connection.AccessToken = token.AccessToken
+	connection.RefreshToken = token.RefreshToken
+	connection.ExpiresAt = token.ExpiresAt
+	return token.AccessToken, nil
+}
+
+// findOverlappingRuns returns the user's runs whose time span overlaps
+// [start, end). Runs are at most maxRunDurationSeconds long, which bounds
+// how early an overlapping run can have started.
+func (s *Server) findOverlappingRuns(userID string, start, end time.Time) ([]Run, error) {
+	result, _, err := s.supabase.From("runs").
+		Select("*", "", false).
+		Eq("user_id", userID).
+		Gte("started_at", start.Add(-maxRunDurationSeconds*time.Second).Format(time.RFC3339)).
+		Lt("started_at", end.Format(time.RFC3339)).
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []Run
+	if err := json.Unmarshal(result, &candidates); err != nil {
+		return nil, err
+	}
+
+	return overlappingRuns(candidates, start, end), nil
+}
+
+// Helper function to keep the runs whose time span overlaps [start, end)
+func overlappingRuns(candidates []Run, start, end time.Time) []Run {
+	var runs []Run
+	for _, run := range candidates {
+		if run.StartedAt == nil {
+			continue
+		}
+		runEnd := run.StartedAt.Add(time.Duration(run.DurationSeconds) * time.Second)
+		if run.StartedAt.Before(end) && runEnd.After(start) {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+func (s *Server) getSyncedRun(provider, externalID string) (*Run, error) {
+	var run Run
+
+	result, _, err := s.supabase.From("runs").
+		Select("*", "", false).
+		Eq("external_source", provider).
+		Eq("external_id", externalID).
+		Single().
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(result, &run); err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// syncActivity imports one provider activity as a run unless it is a
+// sport we don't track or the user already has it, either from an earlier
+// sync or recorded here (any run overlapping it in time).
+func (s *Server) syncActivity(ctx context.Context, provider ActivityProvider, connection *SyncConnection, token string, activity *ProviderActivity) (string, error) {
+	if !activity.syncable() {
+		return syncSkipped, nil
+	}
+
+	if _, err := s.getSyncedRun(provider.Name(), activity.ID); err == nil {
+		return syncDuplicate, nil
+	}
+	end := activity.StartedAt.Add(time.Duration(activity.ElapsedSeconds) * time.Second)
+	overlapping, err := s.findOverlappingRuns(connection.UserID, activity.StartedAt, end)
+	if err != nil {
+		return "", err
+	}
+	if len(overlapping) > 0 {
+		return syncDuplicate, nil
+	}
+
+	var points []TrackPoint
+	if !activity.Manual {
+		points, err = provider.GetTrack(ctx, token, activity)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Calories fall back to default body metrics without a profile
+	profile, _ := s.getUserProfile(connection.UserID)
+	activityRules := storedActivityType(activity.ActivityType)
+
+	title := activity.Name
+	if title == "" {
+		title = fmt.Sprintf("%s %s", activityRules.Name, activity.StartedAt.Format("2006-01-02"))
+	}
+
+	provenance := ProvenanceThirdParty
+	if activity.Manual {
+		provenance = ProvenanceManual
+	}
+
+	run := map[string]interface{}{
+		"id":              uuid.New().String(),
+		"user_id":         connection.UserID,
+		"title":           title,
+		"visibility":      runVisibility(nil, profile),
+		"provenance":      provenance,
+		"external_source": provider.Name(),
+		"external_id":     activity.ID,
+		"started_at":      activity.StartedAt,
+		"created_at":      time.Now().UTC(),
+	}
+
+	input := &Track{Points: points, SourceFormat: provider.Name()}
+	var track *Track
+	var efforts []BestEffort
+	if input.HasPoints() && activityRules.UsesGPS && input.Validate() == nil {
+		processed := s.pipeline.Process(input)
+		track = processed.Track()
+		summary := activityRules.adjustSummary(processed.Summary())
+		calories := summaryCalories(profile, activityRules, summary)
+		if err := validateRunMetrics(activityRules, summary.DistanceKm, summary.DurationSeconds, calories); err != nil {
+			return syncSkipped, nil
+		}
+		applyTrackSummary(run, summary)
+		applyActivity(run, activityRules, summary.DistanceKm, summary.MovingSeconds)
+		applyRunSplits(run, processed)
+		applyHeartRate(run, pointHeartRates(processed.Points), profile)
+		efforts = applyBestEfforts(run, activityRules, processed.Points)
+		s.applySuspicion(run, activityRules, points, runTiming{DurationSeconds: activity.ElapsedSeconds})
+		run["calories_burned"] = calories
+		applyTrack(run, track)
+	} else {
+		moving := activity.MovingSeconds
+		if moving <= 0 {
+			moving = activity.ElapsedSeconds
+		}
+		calories := estimateCalories(bodyMetrics(profile), activityRules, activity.DistanceKm, moving, 1)
+		if err := validateRunMetrics(activityRules, activity.DistanceKm, activity.ElapsedSeconds, calories); err != nil {
+			return syncSkipped, nil
+		}
+		applyActivity(run, activityRules, activity.DistanceKm, moving)
+		pace := paceSecondsPerKm(activity.DistanceKm, moving)
+		run["distance_km"] = activity.DistanceKm
+		run["duration_seconds"] = activity.ElapsedSeconds
+		run["moving_seconds"] = moving
+		run["avg_pace_seconds_per_km"] = pace
+		run["avg_pace_per_km"] = formatPace(pace)
+		run["calories_burned"] = calories
+	}
+
+	if _, err := s.saveRun(run); err != nil {
+		return "", err
+	}
+
+	runID := run["id"].(string)
+	s.detectPersonalRecords(connection.UserID, run, efforts)
+	if track.HasPoints() {
+		go s.matchRunSegments(connection.UserID, runID, activityRules, track.Points)
+	}
+	return syncImported, nil
+}
+
+// backfillConnection imports everything since the last sync (or the last
+// BackfillDays for a new connection). Webhooks normally deliver new
+// activities; this catches whatever they missed.
+func (s *Server) backfillConnection(ctx context.Context, provider ActivityProvider, connection *SyncConnection) (*SyncResult, error) {
+	token, err := s.connectionToken(ctx, provider, connection)
+	if err != nil {
+		return nil, err
+	}
+
+	after := time.Now().UTC().AddDate(0, 0, -s.sync.BackfillDays)
+	if connection.LastSyncedAt != nil {
+		after = *connection.LastSyncedAt
+	}
+
+	result := &SyncResult{}
+	latest := after
+	for page := 1; page <= syncMaxPages; page++ {
+		activities, err := provider.ListActivities(ctx, token, after, page)
+		if err != nil {
+			return result, err
+		}
+		if len(activities) == 0 {
+			break
+		}
+
+		for i := range activities {
+			outcome, err := s.syncActivity(ctx, provider, connection, token, &activities[i])
+			if err != nil {
+				return result, err
+			}
+			switch outcome {
+			case syncImported:
+				result.Imported++
+			case syncDuplicate:
+				result.Duplicates++
+			default:
+				result.Skipped++
+			}
+			if activities[i].StartedAt.After(latest) {
+				latest = activities[i].StartedAt
+			}
+		}
+	}
+
+	_, _, err = s.supabase.From("sync_connections").
+		Update(map[string]interface{}{
+			"last_synced_at": latest,
+			"updated_at":     time.Now().UTC(),
+		}, "", "").
+		Eq("id", connection.ID).
+		Execute()
+
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// runSyncBackfill periodically backfills every connection of every
+// configured provider
+func (s *Server) runSyncBackfill() {
+	ticker := time.NewTicker(s.sync.BackfillInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for name, provider := range s.providers {
+			for offset := 0; ; offset += recomputePageSize {
+				result, _, err := s.supabase.From("sync_connections").
+					Select("*", "", false).
+					Eq("provider", name).
+					Order("created_at", &map[string]interface{}{"ascending": true}).
+					Range(offset, offset+recomputePageSize-1, "", false).
+					Execute()
+
+				if err != nil {
+					log.Printf("list %s connections: %v", name, err)
+					break
+				}
+
+				var connections []SyncConnection
+				if err := json.Unmarshal(result, &connections); err != nil {
+					log.Printf("parse %s connections: %v", name, err)
+					break
+				}
+
+				for i := range connections {
+					s.backfillInBackground(provider, &connections[i])
+				}
+
+				if len(connections) < recomputePageSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) backfillInBackground(provider ActivityProvider, connection *SyncConnection) {
+	ctx, cancel := context.WithTimeout(context.Background(), syncJobTimeout)
+	defer cancel()
+
+	if _, err := s.backfillConnection(ctx, provider, connection); err != nil {
+		log.Printf("backfill %s for user %s: %v", provider.Name(), connection.UserID, err)
+	}
+}
+
+// Connections
+func (s *Server) getConnections(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	result, _, err := s.supabase.From("sync_connections").
+		Select("id, provider, athlete_id, last_synced_at, created_at", "", false).
+		Eq("user_id", userID).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch connections"})
+		return
+	}
+
+	var connections []map[string]interface{}
+	if err := json.Unmarshal(result, &connections); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse connections"})
+		return
+	}
+
+	available := make([]string, 0, len(s.providers))
+	for name := range s.providers {
+		available = append(available, name)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"connections": connections, "available": available})
+}
+
+// Where to send the user to grant access. The state is stored against the
+// user and must come back with the code, so a code can't be replayed into
+// someone else's account.
+func (s *Server) authorizeConnection(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	provider, ok := s.provider(c)
+	if !ok {
+		return
+	}
+
+	state, err := newShareToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start authorization"})
+		return
+	}
+
+	now := time.Now().UTC()
+	s.supabase.From("oauth_states").
+		Delete("", "").
+		Eq("user_id", userID).
+		Lt("expires_at", now.Format(time.RFC3339)).
+		Execute()
+
+	_, _, err = s.supabase.From("oauth_states").
+		Insert(map[string]interface{}{
+			"state":      state,
+			"user_id":    userID,
+			"provider":   provider.Name(),
+			"expires_at": now.Add(oauthStateTTL),
+			"created_at": now,
+		}, false, "", "", "").
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start authorization"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"url": provider.AuthorizeURL(state), "state": state})
+}
+
+// Finish OAuth with the code from the provider's redirect, then backfill
+// in the background
+func (s *Server) connectProvider(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	provider, ok := s.provider(c)
+	if !ok {
+		return
+	}
+
+	var req ConnectProviderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Each state is used once, by the user it was issued to
+	result, _, err := s.supabase.From("oauth_states").
+		Delete("", "").
+		Eq("state", req.State).
+		Eq("user_id", userID).
+		Eq("provider", provider.Name()).
+		Gt("expires_at", time.Now().UTC().Format(time.RFC3339)).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify authorization state"})
+		return
+	}
+	if affectedRows(result) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired authorization state"})
+		return
+	}
+
+	token, err := provider.ExchangeCode(c.Request.Context(), req.Code)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to connect account"})
+		return
+	}
+
+	if existing, err := s.getConnectionByAthlete(provider.Name(), token.AthleteID); err == nil && existing.UserID != userID {
+		c.JSON(http.StatusConflict, gin.H{"error": "This account is already connected to another user"})
+		return
+	}
+
+	now := time.Now().UTC()
+	connection := SyncConnection{
+		ID:           uuid.New().String(),
+		UserID:       userID,
+		Provider:     provider.Name(),
+		AthleteID:    token.AthleteID,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		ExpiresAt:    token.ExpiresAt,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+
+	// Reconnecting keeps the sync position of the earlier connection
+	if existing, err := s.getConnection(provider.Name(), userID); err == nil {
+		connection.ID = existing.ID
+		connection.LastSyncedAt = existing.LastSyncedAt
+		connection.CreatedAt = existing.CreatedAt
+	}
+
+	_, _, err = s.supabase.From("sync_connections").
+		Insert(connection, true, "user_id,provider", "", "").
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save connection"})
+		return
+	}
+
+	go s.backfillInBackground(provider, &connection)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Account connected; importing recent activities",
+		"provider":   connection.Provider,
+		"athlete_id": connection.AthleteID,
+	})
+}
+
+// Sync now instead of waiting for the next backfill
+func (s *Server) syncConnection(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	provider, ok := s.provider(c)
+	if !ok {
+		return
+	}
+
+	connection, err := s.getConnection(provider.Name(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not connected"})
+		return
+	}
+
+	result, err := s.backfillConnection(c.Request.Context(), provider, connection)
+	if err != nil {
+		log.Printf("sync %s for user %s: %v", provider.Name(), userID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to sync activities", "result": result})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// Disconnecting keeps the runs already imported
+func (s *Server) disconnectProvider(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	provider, ok := s.provider(c)
+	if !ok {
+		return
+	}
+
+	connection, err := s.getConnection(provider.Name(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not connected"})
+		return
+	}
+
+	// Best effort: the provider may already have revoked the token
+	if token, err := s.connectionToken(c.Request.Context(), provider, connection); err == nil {
+		if err := provider.Deauthorize(c.Request.Context(), token); err != nil {
+			log.Printf("deauthorize %s for user %s: %v", provider.Name(), userID, err)
+		}
+	}
+
+	_, _, err = s.supabase.From("sync_connections").
+		Delete("", "").
+		Eq("id", connection.ID).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disconnect account"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account disconnected"})
+}
+
+// Register the Strava webhook subscription (Admin only, once per app)
+func (s *Server) createStravaSubscription(c *gin.Context) {
+	provider, ok := s.providers["strava"]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Strava is not configured"})
+		return
+	}
+
+	var req CreateSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := provider.Subscribe(c.Request.Context(), req.CallbackURL)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to create subscription: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"subscription_id": id,
+		"message":         "Set STRAVA_SUBSCRIPTION_ID to this value to reject events from other subscriptions",
+	})
+}
+
+// Strava's subscription validation handshake
+func (s *Server) verifyStravaWebhook(c *gin.Context) {
+	if c.Query("hub.mode") != "subscribe" || s.strava.VerifyToken == "" || c.Query("hub.verify_token") != s.strava.VerifyToken {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid verify token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"hub.challenge": c.Query("hub.challenge")})
+}
+
+// Strava expects a 200 within two seconds, so events are handled in the
+// background
+func (s *Server) handleStravaWebhook(c *gin.Context) {
+	provider, ok := s.providers["strava"]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Strava is not configured"})
+		return
+	}
+
+	var event stravaWebhookEvent
+	if err := c.ShouldBindJSON(&event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Events carry no signature, so they are only trusted as far as the
+	// subscription ID and are re-checked against the API before acting
+	if s.strava.SubscriptionID == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Webhook subscription is not configured"})
+		return
+	}
+	if strconv.FormatInt(event.SubscriptionID, 10) != s.strava.SubscriptionID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unknown subscription"})
+		return
+	}
+
+	go s.processStravaEvent(provider, event)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Event received"})
+}
+
+// What an activity event leads to once the activity has been fetched
+const (
+	stravaIgnore = "ignore"
+	stravaRemove = "remove"
+	stravaImport = "import"
+	stravaUpdate = "update"
+)
+
+// stravaActivityAction decides what an activity event does given the
+// result of fetching the activity. Only a delete the API confirms removes
+// a run; a delete for an activity that still exists, or any event whose
+// activity can't be fetched, is ignored.
+func stravaActivityAction(aspectType string, fetchErr error) string {
+	switch {
+	case aspectType == "delete" && errors.Is(fetchErr, errProviderNotFound):
+		return stravaRemove
+	case fetchErr != nil || aspectType == "delete":
+		return stravaIgnore
+	case aspectType == "create":
+		return stravaImport
+	case aspectType == "update":
+		return stravaUpdate
+	}
+	return stravaIgnore
+}
+
+func (s *Server) processStravaEvent(provider ActivityProvider, event stravaWebhookEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), syncJobTimeout)
+	defer cancel()
+
+	connection, err := s.getConnectionByAthlete(provider.Name(), strconv.FormatInt(event.OwnerID, 10))
+	if err != nil {
+		return
+	}
+	activityID := strconv.FormatInt(event.ObjectID, 10)
+
+	switch {
+	case event.ObjectType == "athlete" && event.Updates["authorized"] == "false":
+		// The athlete revoked access on Strava's side, which also revokes
+		// the refresh token; a refresh that still works means they didn't
+		if _, err = s.refreshConnectionToken(ctx, provider, connection); !errors.Is(err, errProviderUnauthorized) {
+			break
+		}
+		_, _, err = s.supabase.From("sync_connections").
+			Delete("", "").
+			Eq("id", connection.ID).
+			Execute()
+
+	case event.ObjectType == "activity":
+		var token string
+		token, err = s.connectionToken(ctx, provider, connection)
+		if err != nil {
+			break
+		}
+		var activity *ProviderActivity
+		activity, err = provider.GetActivity(ctx, token, activityID)
+
+		switch stravaActivityAction(event.AspectType, err) {
+		case stravaRemove:
+			run, lookupErr := s.getSyncedRun(provider.Name(), activityID)
+			if lookupErr != nil {
+				return
+			}
+			if err = s.removeRun(run.ID, connection.UserID); err == nil {
+				go s.refreshUserStats(connection.UserID)
+			}
+		case stravaImport:
+			_, err = s.syncActivity(ctx, provider, connection, token, activity)
+		case stravaUpdate:
+			err = s.applyStravaUpdate(connection.UserID, activity)
+		}
+	}
+
+	if err != nil {
+		log.Printf("strava %s %s %d: %v", event.ObjectType, event.AspectType, event.ObjectID, err)
+	}
+}
+
+// Helper function to mirror title, sport and privacy changes made on
+// Strava, read from the activity as the API returns it now
+func (s *Server) applyStravaUpdate(userID string, activity *ProviderActivity) error {
+	run, err := s.getSyncedRun("strava", activity.ID)
+	if err != nil || run.UserID != userID {
+		return nil
+	}
+
+	updateData := map[string]interface{}{}
+	if activity.Name != "" && activity.Name != run.Title {
+		updateData["title"] = activity.Name
+	}
+
+	// A sport change goes through the same checks as editing the type here;
+	// one the new type's limits reject leaves the run as it was
+	var retyped *ActivityType
+	recordsChanged := false
+	if activity.ActivityType != "" && activity.ActivityType != run.ActivityType {
+		if activityRules, err := lookupActivityType(activity.ActivityType); err != nil {
+			log.Printf("retype strava activity %s: %v", activity.ID, err)
+		} else {
+			profile, _ := s.getUserProfile(userID)
+			recordsChanged, err = retypeRun(updateData, run, activityRules, bodyMetrics(profile))
+			if err != nil {
+				log.Printf("retype strava activity %s: %v", activity.ID, err)
+			} else {
+				retyped = &activityRules
+			}
+		}
+	}
+	if activity.Private && run.Visibility != VisibilityPrivate {
+		updateData["visibility"] = VisibilityPrivate
+	}
+	if len(updateData) == 0 {
+		return nil
+	}
+
+	_, _, err = s.supabase.From("runs").
+		Update(updateData, "", "").
+		Eq("id", run.ID).
+		Execute()
+
+	if err != nil {
+		return err
+	}
+
+	if retyped != nil {
+		go s.refreshRetypedRun(userID, run, *retyped, recordsChanged)
+	}
+	return nil
+}
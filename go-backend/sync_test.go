@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Helper function to stand up a fake Strava API with a few activities: a
+// run, a swim we don't import, and activity 404 which has been deleted.
+// The refresh token "revoked" is answered like a deauthorized athlete.
+func fakeStrava(t *testing.T) *StravaClient {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("refresh_token") == "revoked" {
+			http.Error(w, `{"message":"Bad Request","errors":[{"field":"refresh_token","code":"invalid"}]}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"access-2","refresh_token":"refresh-2","expires_at":1710000000,"athlete":{"id":42}}`)
+	})
+	authorized := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer access-2" {
+				http.Error(w, `{"message":"Authorization Error"}`, http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+		}
+	}
+	mux.HandleFunc("/api/v3/athlete/activities", authorized(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") != "1" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, `[
+			{"id":1,"name":"Lunch Run","sport_type":"Run","start_date":"2024-03-10T05:30:00Z","elapsed_time":1800,"moving_time":1750,"distance":5000},
+			{"id":2,"name":"Pool","type":"Swim","start_date":"2024-03-11T05:30:00Z","elapsed_time":1200,"distance":1500}
+		]`)
+	}))
+	mux.HandleFunc("/api/v3/activities/1", authorized(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":1,"name":"Lunch Run","sport_type":"TrailRun","start_date":"2024-03-10T05:30:00Z","elapsed_time":1800,"distance":5000,"private":true}`)
+	}))
+	mux.HandleFunc("/api/v3/activities/1/streams", authorized(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"latlng":{"data":[[10.7769,106.7009],[10.7770,106.7010]]},"time":{"data":[0,5]},"cadence":{"data":[86,0]}}`)
+	}))
+	mux.HandleFunc("/api/v3/activities/404", authorized(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Record Not Found"}`, http.StatusNotFound)
+	}))
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return NewStravaClient(StravaConfig{ClientID: "1", ClientSecret: "secret", BaseURL: server.URL})
+}
+
+func TestStravaListActivitiesSkipsUnknownSports(t *testing.T) {
+	client := fakeStrava(t)
+	ctx := context.Background()
+
+	activities, err := client.ListActivities(ctx, "access-2", testStart.AddDate(0, 0, -30), 1)
+	if err != nil {
+		t.Fatalf("ListActivities: %v", err)
+	}
+	if len(activities) != 2 {
+		t.Fatalf("listed %d activities, want 2", len(activities))
+	}
+
+	run, swim := activities[0], activities[1]
+	if run.ID != "1" || run.ActivityType != "run" || run.DistanceKm != 5 || !run.syncable() {
+		t.Errorf("run = %+v, want a syncable 5 km run", run)
+	}
+	if swim.ActivityType != "" || swim.syncable() {
+		t.Errorf("swim = %+v, want it skipped", swim)
+	}
+
+	if next, err := client.ListActivities(ctx, "access-2", testStart, 2); err != nil || len(next) != 0 {
+		t.Errorf("page 2 = %v, %v, want an empty page", next, err)
+	}
+}
+
+func TestStravaGetActivityAndTrack(t *testing.T) {
+	client := fakeStrava(t)
+	ctx := context.Background()
+
+	activity, err := client.GetActivity(ctx, "access-2", "1")
+	if err != nil {
+		t.Fatalf("GetActivity: %v", err)
+	}
+	if activity.ActivityType != "trail_run" || !activity.Private {
+		t.Errorf("activity = %+v, want a private trail run", activity)
+	}
+
+	points, err := client.GetTrack(ctx, "access-2", activity)
+	if err != nil {
+		t.Fatalf("GetTrack: %v", err)
+	}
+	if len(points) != 2 || !points[1].Timestamp.Equal(activity.StartedAt.Add(5*time.Second)) {
+		t.Fatalf("track = %+v", points)
+	}
+	// Strava reports cadence per foot, which is how it is stored
+	if points[0].Cadence == nil || *points[0].Cadence != 86 || points[1].Cadence != nil {
+		t.Errorf("cadence = %v, %v, want 86 and none", points[0].Cadence, points[1].Cadence)
+	}
+
+	if _, err := client.GetActivity(ctx, "access-2", "404"); !errors.Is(err, errProviderNotFound) {
+		t.Errorf("deleted activity error = %v, want errProviderNotFound", err)
+	}
+}
+
+func TestStravaRevokedToken(t *testing.T) {
+	client := fakeStrava(t)
+	ctx := context.Background()
+
+	token, err := client.RefreshToken(ctx, "refresh-1")
+	if err != nil {
+		t.Fatalf("RefreshToken: %v", err)
+	}
+	if token.AccessToken != "access-2" || token.AthleteID != "42" || !token.ExpiresAt.Equal(time.Unix(1710000000, 0)) {
+		t.Errorf("token = %+v", token)
+	}
+
+	if _, err := client.RefreshToken(ctx, "revoked"); !errors.Is(err, errProviderUnauthorized) {
+		t.Errorf("revoked refresh error = %v, want errProviderUnauthorized", err)
+	}
+	if _, err := client.GetActivity(ctx, "access-1", "1"); !errors.Is(err, errProviderUnauthorized) {
+		t.Errorf("stale access token error = %v, want errProviderUnauthorized", err)
+	}
+}
+
+func TestStravaActivityAction(t *testing.T) {
+	notFound := fmt.Errorf("%w: strava GET /api/v3/activities/1: 404", errProviderNotFound)
+	transient := errors.New("strava rate limit reached")
+
+	tests := []struct {
+		name     string
+		aspect   string
+		fetchErr error
+		want     string
+	}{
+		{name: "delete confirmed by the API", aspect: "delete", fetchErr: notFound, want: stravaRemove},
+		{name: "delete for an activity that still exists", aspect: "delete", want: stravaIgnore},
+		{name: "delete during an outage", aspect: "delete", fetchErr: transient, want: stravaIgnore},
+		{name: "create", aspect: "create", want: stravaImport},
+		{name: "create for a vanished activity", aspect: "create", fetchErr: notFound, want: stravaIgnore},
+		{name: "update", aspect: "update", want: stravaUpdate},
+		{name: "update with a revoked token", aspect: "update", fetchErr: errProviderUnauthorized, want: stravaIgnore},
+	}
+
+	for _, tt := range tests {
+		if got := stravaActivityAction(tt.aspect, tt.fetchErr); got != tt.want {
+			t.Errorf("%s: action = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOverlappingRunsDedupe(t *testing.T) {
+	at := func(minutes int) *time.Time {
+		started := testStart.Add(time.Duration(minutes) * time.Minute)
+		return &started
+	}
+	candidates := []Run{
+		{ID: "before", StartedAt: at(-60), DurationSeconds: 1800},
+		{ID: "ends-at-start", StartedAt: at(-30), DurationSeconds: 1800},
+		{ID: "recorded-here", StartedAt: at(-5), DurationSeconds: 1800},
+		{ID: "inside", StartedAt: at(10), DurationSeconds: 600},
+		{ID: "starts-at-end", StartedAt: at(30), DurationSeconds: 600},
+		{ID: "no-start", DurationSeconds: 1800},
+	}
+
+	// The synced activity runs for half an hour from testStart
+	got := overlappingRuns(candidates, testStart, testStart.Add(30*time.Minute))
+	want := []string{"recorded-here", "inside"}
+	if len(got) != len(want) {
+		t.Fatalf("found %d overlapping runs, want %d: %+v", len(got), len(want), got)
+	}
+	for i, id := range want {
+		if got[i].ID != id {
+			t.Errorf("overlap %d = %s, want %s", i, got[i].ID, id)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Coordinates are encoded with 6 decimal places (~0.1 m), which is finer
+// than consumer GPS accuracy and keeps distances stable after a round trip.
+const polylinePrecision = 6
+
+type TrackPoint struct {
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	Timestamp time.Time `json:"timestamp"`
+	Accuracy  *float64  `json:"accuracy,omitempty"`
+	Altitude  *float64  `json:"altitude,omitempty"`
+	Speed     *float64  `json:"speed,omitempty"`
+	HeartRate *int      `json:"heart_rate,omitempty"`
+	// Cycles per minute: one foot's strides when running or walking (as
+	// FIT, GPX, TCX and Strava record it), pedal revolutions when cycling
+	Cadence *int `json:"cadence,omitempty"`
+}
+
+// Track is the typed representation of a run's route. It is stored in
+// runs.route_data using the compact encoding produced by MarshalJSON.
+type Track struct {
+	Points       []TrackPoint
+	Pauses       []Pause
+	Laps         []time.Time
+	SourceFormat string
+	Sport        string
+}
+
+type LatLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Compact wire format: coordinates as an encoded polyline, time as
+// millisecond offsets from start_time, and optional sensor channels as
+// parallel arrays (null where a point has no reading).
+type encodedTrack struct {
+	Polyline     string      `json:"polyline"`
+	Precision    int         `json:"precision"`
+	StartTime    time.Time   `json:"start_time"`
+	TimeOffsets  []int64     `json:"time_offsets"`
+	Altitude     []*float64  `json:"altitude,omitempty"`
+	Accuracy     []*float64  `json:"accuracy,omitempty"`
+	Speed        []*float64  `json:"speed,omitempty"`
+	HeartRate    []*int      `json:"heart_rate,omitempty"`
+	Cadence      []*int      `json:"cadence,omitempty"`
+	Pauses       []Pause     `json:"pauses,omitempty"`
+	Laps         []time.Time `json:"laps,omitempty"`
+	SourceFormat string      `json:"source_format,omitempty"`
+	Sport        string      `json:"sport,omitempty"`
+}
+
+func (t Track) MarshalJSON() ([]byte, error) {
+	enc := encodedTrack{
+		Polyline:     encodePolyline(t.Points, polylinePrecision),
+		Precision:    polylinePrecision,
+		TimeOffsets:  make([]int64, len(t.Points)),
+		Pauses:       t.Pauses,
+		Laps:         t.Laps,
+		SourceFormat: t.SourceFormat,
+		Sport:        t.Sport,
+	}
+
+	var hasAlt, hasAcc, hasSpeed, hasHR, hasCad bool
+	for i, p := range t.Points {
+		if i == 0 {
+			enc.StartTime = p.Timestamp.UTC()
+		}
+		enc.TimeOffsets[i] = p.Timestamp.Sub(enc.StartTime).Milliseconds()
+		hasAlt = hasAlt || p.Altitude != nil
+		hasAcc = hasAcc || p.Accuracy != nil
+		hasSpeed = hasSpeed || p.Speed != nil
+		hasHR = hasHR || p.HeartRate != nil
+		hasCad = hasCad || p.Cadence != nil
+	}
+
+	if hasAlt {
+		enc.Altitude = make([]*float64, len(t.Points))
+	}
+	if hasAcc {
+		enc.Accuracy = make([]*float64, len(t.Points))
+	}
+	if hasSpeed {
+		enc.Speed = make([]*float64, len(t.Points))
+	}
+	if hasHR {
+		enc.HeartRate = make([]*int, len(t.Points))
+	}
+	if hasCad {
+		enc.Cadence = make([]*int, len(t.Points))
+	}
+	for i, p := range t.Points {
+		if hasAlt {
+			enc.Altitude[i] = p.Altitude
+		}
+		if hasAcc {
+			enc.Accuracy[i] = p.Accuracy
+		}
+		if hasSpeed {
+			enc.Speed[i] = p.Speed
+		}
+		if hasHR {
+			enc.HeartRate[i] = p.HeartRate
+		}
+		if hasCad {
+			enc.Cadence[i] = p.Cadence
+		}
+	}
+
+	return json.Marshal(enc)
+}
+
+// UnmarshalJSON accepts both the compact encoding and a plain
+// {"points": [...]} payload, which is what older rows and simple
+// clients send.
+func (t *Track) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		encodedTrack
+		Points []TrackPoint `json:"points"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	t.Pauses = raw.Pauses
+	t.Laps = raw.Laps
+	t.SourceFormat = raw.SourceFormat
+	t.Sport = raw.Sport
+
+	if raw.Polyline == "" {
+		t.Points = raw.Points
+		return nil
+	}
+
+	precision := raw.Precision
+	if precision == 0 {
+		precision = 5
+	}
+	coords, err := decodePolyline(raw.Polyline, precision)
+	if err != nil {
+		return err
+	}
+	if len(raw.TimeOffsets) != len(coords) {
+		return errors.New("route_data time_offsets length does not match polyline")
+	}
+
+	t.Points = make([]TrackPoint, len(coords))
+	for i, coord := range coords {
+		p := TrackPoint{
+			Lat:       coord.Lat,
+			Lng:       coord.Lng,
+			Timestamp: raw.StartTime.Add(time.Duration(raw.TimeOffsets[i]) * time.Millisecond),
+		}
+		if i < len(raw.Altitude) {
+			p.Altitude = raw.Altitude[i]
+		}
+		if i < len(raw.Accuracy) {
+			p.Accuracy = raw.Accuracy[i]
+		}
+		if i < len(raw.Speed) {
+			p.Speed = raw.Speed[i]
+		}
+		if i < len(raw.HeartRate) {
+			p.HeartRate = raw.HeartRate[i]
+		}
+		if i < len(raw.Cadence) {
+			p.Cadence = raw.Cadence[i]
+		}
+		t.Points[i] = p
+	}
+
+	return nil
+}
+
+func (t *Track) Validate() error {
+	for i, p := range t.Points {
+		if err := (LatLng{p.Lat, p.Lng}).Validate(); err != nil {
+			return fmt.Errorf("route point %d: %w", i, err)
+		}
+		if p.Timestamp.IsZero() {
+			return fmt.Errorf("route point %d is missing a timestamp", i)
+		}
+		if i > 0 && p.Timestamp.Before(t.Points[i-1].Timestamp) {
+			return fmt.Errorf("route point %d is out of time order", i)
+		}
+		if p.Accuracy != nil && *p.Accuracy < 0 {
+			return fmt.Errorf("route point %d has negative accuracy", i)
+		}
+		if p.Speed != nil && *p.Speed < 0 {
+			return fmt.Errorf("route point %d has negative speed", i)
+		}
+		if p.HeartRate != nil && (*p.HeartRate < 20 || *p.HeartRate > 250) {
+			return fmt.Errorf("route point %d has an invalid heart rate", i)
+		}
+		if p.Cadence != nil && (*p.Cadence < 0 || *p.Cadence > 300) {
+			return fmt.Errorf("route point %d has an invalid cadence", i)
+		}
+	}
+	return nil
+}
+
+func (t *Track) HasPoints() bool {
+	return t != nil && len(t.Points) >= 2
+}
+
+func (t *Track) Start() LatLng {
+	return LatLng{t.Points[0].Lat, t.Points[0].Lng}
+}
+
+func (t *Track) End() LatLng {
+	last := t.Points[len(t.Points)-1]
+	return LatLng{last.Lat, last.Lng}
+}
+
+// EWKT returns the route as a PostGIS LINESTRING in WGS 84
+func (t *Track) EWKT() string {
+	coords := make([]string, len(t.Points))
+	for i, p := range t.Points {
+		coords[i] = fmt.Sprintf("%.6f %.6f", p.Lng, p.Lat)
+	}
+	return "SRID=4326;LINESTRING(" + strings.Join(coords, ",") + ")"
+}
+
+func (l LatLng) Validate() error {
+	if math.IsNaN(l.Lat) || l.Lat < -90 || l.Lat > 90 {
+		return errors.New("latitude must be between -90 and 90")
+	}
+	if math.IsNaN(l.Lng) || l.Lng < -180 || l.Lng > 180 {
+		return errors.New("longitude must be between -180 and 180")
+	}
+	return nil
+}
+
+// EWKT returns the location as a PostGIS POINT in WGS 84
+func (l LatLng) EWKT() string {
+	return fmt.Sprintf("SRID=4326;POINT(%.6f %.6f)", l.Lng, l.Lat)
+}
+
+// Helper function to set the route columns of a run row from a track
+func applyTrack(run map[string]interface{}, track *Track) {
+	run["route_data"] = track
+	run["route_geom"] = track.EWKT()
+	run["start_location"] = track.Start().EWKT()
+	run["end_location"] = track.End().EWKT()
+	run["started_at"] = track.Points[0].Timestamp
+}
+
+// Google encoded polyline algorithm with configurable precision
+func encodePolyline(points []TrackPoint, precision int) string {
+	factor := math.Pow10(precision)
+	var b strings.Builder
+	var prevLat, prevLng int64
+	for _, p := range points {
+		lat := int64(math.Round(p.Lat * factor))
+		lng := int64(math.Round(p.Lng * factor))
+		writePolylineValue(&b, lat-prevLat)
+		writePolylineValue(&b, lng-prevLng)
+		prevLat, prevLng = lat, lng
+	}
+	return b.String()
+}
+
+func writePolylineValue(b *strings.Builder, v int64) {
+	u := uint64(v) << 1
+	if v < 0 {
+		u = ^u
+	}
+	for u >= 0x20 {
+		b.WriteByte(byte((0x20 | (u & 0x1f)) + 63))
+		u >>= 5
+	}
+	b.WriteByte(byte(u + 63))
+}
+
+func decodePolyline(encoded string, precision int) ([]LatLng, error) {
+	factor := math.Pow10(precision)
+	var coords []LatLng
+	var lat, lng int64
+	for i := 0; i < len(encoded); {
+		dLat, n, err := readPolylineValue(encoded[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		dLng, n, err := readPolylineValue(encoded[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		lat += dLat
+		lng += dLng
+		coords = append(coords, LatLng{float64(lat) / factor, float64(lng) / factor})
+	}
+	return coords, nil
+}
+
+func readPolylineValue(s string) (int64, int, error) {
+	var result uint64
+	var shift uint
+	for i := 0; i < len(s); i++ {
+		b := uint64(s[i]) - 63
+		if s[i] < 63 || shift > 60 {
+			return 0, 0, errors.New("invalid polyline encoding")
+		}
+		result |= (b & 0x1f) << shift
+		shift += 5
+		if b < 0x20 {
+			v := int64(result >> 1)
+			if result&1 != 0 {
+				v = ^v
+			}
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("truncated polyline encoding")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEncodePolylineReferenceExample(t *testing.T) {
+	// The example from Google's polyline algorithm documentation
+	points := []TrackPoint{
+		{Lat: 38.5, Lng: -120.2},
+		{Lat: 40.7, Lng: -120.95},
+		{Lat: 43.252, Lng: -126.453},
+	}
+
+	if got, want := encodePolyline(points, 5), "_p~iF~ps|U_ulLnnqC_mqNvxq`@"; got != want {
+		t.Fatalf("encodePolyline = %q, want %q", got, want)
+	}
+}
+
+func TestPolylineRoundTrip(t *testing.T) {
+	points := []TrackPoint{
+		{Lat: 10.776889, Lng: 106.700981},
+		{Lat: 10.777012, Lng: 106.701243},
+		{Lat: 10.776501, Lng: 106.699874},
+		{Lat: -33.856784, Lng: 151.215297},
+		{Lat: 0, Lng: 0},
+		{Lat: 89.999999, Lng: -179.999999},
+	}
+
+	tests := []struct {
+		precision int
+		tolerance float64
+	}{
+		{precision: 5, tolerance: 0.5e-5},
+		{precision: 6, tolerance: 0.5e-6},
+	}
+
+	for _, tt := range tests {
+		encoded := encodePolyline(points, tt.precision)
+		decoded, err := decodePolyline(encoded, tt.precision)
+		if err != nil {
+			t.Fatalf("precision %d: decodePolyline: %v", tt.precision, err)
+		}
+		if len(decoded) != len(points) {
+			t.Fatalf("precision %d: decoded %d points, want %d", tt.precision, len(decoded), len(points))
+		}
+		for i, p := range points {
+			if math.Abs(decoded[i].Lat-p.Lat) > tt.tolerance || math.Abs(decoded[i].Lng-p.Lng) > tt.tolerance {
+				t.Errorf("precision %d: point %d = %v, want %v", tt.precision, i, decoded[i], LatLng{p.Lat, p.Lng})
+			}
+		}
+	}
+}
+
+func TestDecodePolylineRejectsBadInput(t *testing.T) {
+	tests := map[string]string{
+		"truncated":     "_p~iF~ps|",
+		"invalid bytes": "_p~iF ps|U",
+	}
+
+	for name, encoded := range tests {
+		if _, err := decodePolyline(encoded, 5); err == nil {
+			t.Errorf("%s: decodePolyline(%q) succeeded, want an error", name, encoded)
+		}
+	}
+}
+
+func TestTrackJSONRoundTrip(t *testing.T) {
+	start := time.Date(2024, 3, 10, 5, 30, 0, 0, time.UTC)
+	heartRate, cadence := 150, 86
+	altitude := 12.5
+	track := Track{
+		Points: []TrackPoint{
+			{Lat: 10.776889, Lng: 106.700981, Timestamp: start, HeartRate: &heartRate},
+			{Lat: 10.777012, Lng: 106.701243, Timestamp: start.Add(1500 * time.Millisecond), Cadence: &cadence},
+			{Lat: 10.777301, Lng: 106.701874, Timestamp: start.Add(3 * time.Second), Altitude: &altitude},
+		},
+		Laps:         []time.Time{start.Add(2 * time.Second)},
+		SourceFormat: "gpx",
+	}
+
+	data, err := json.Marshal(track)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var decoded Track
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if len(decoded.Points) != len(track.Points) {
+		t.Fatalf("decoded %d points, want %d", len(decoded.Points), len(track.Points))
+	}
+	for i, p := range track.Points {
+		got := decoded.Points[i]
+		if !got.Timestamp.Equal(p.Timestamp) {
+			t.Errorf("point %d timestamp = %v, want %v", i, got.Timestamp, p.Timestamp)
+		}
+		if math.Abs(got.Lat-p.Lat) > 1e-6 || math.Abs(got.Lng-p.Lng) > 1e-6 {
+			t.Errorf("point %d = %v,%v, want %v,%v", i, got.Lat, got.Lng, p.Lat, p.Lng)
+		}
+	}
+	if decoded.Points[0].HeartRate == nil || *decoded.Points[0].HeartRate != heartRate {
+		t.Errorf("heart rate not preserved: %v", decoded.Points[0].HeartRate)
+	}
+	if decoded.Points[1].HeartRate != nil {
+		t.Errorf("point without heart rate decoded with %d", *decoded.Points[1].HeartRate)
+	}
+	if decoded.Points[1].Cadence == nil || *decoded.Points[1].Cadence != cadence {
+		t.Errorf("cadence not preserved: %v", decoded.Points[1].Cadence)
+	}
+	if decoded.Points[2].Altitude == nil || *decoded.Points[2].Altitude != altitude {
+		t.Errorf("altitude not preserved: %v", decoded.Points[2].Altitude)
+	}
+	if len(decoded.Laps) != 1 || !decoded.Laps[0].Equal(track.Laps[0]) || decoded.SourceFormat != "gpx" {
+		t.Errorf("laps or source format not preserved: %v %q", decoded.Laps, decoded.SourceFormat)
+	}
+}
+
+func TestTrackUnmarshalPlainPoints(t *testing.T) {
+	var track Track
+	data := `{"points":[{"lat":10.1,"lng":106.2,"timestamp":"2024-03-10T05:30:00Z"}]}`
+	if err := json.Unmarshal([]byte(data), &track); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(track.Points) != 1 || track.Points[0].Lat != 10.1 || track.Points[0].Lng != 106.2 {
+		t.Fatalf("points = %+v", track.Points)
+	}
+}
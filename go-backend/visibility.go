@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Who can see a run besides its owner
+const (
+	VisibilityPrivate    = "private"
+	VisibilityFollowers  = "followers"
+	VisibilityUniversity = "university"
+	VisibilityPublic     = "public"
+
+	// For new runs when the user hasn't chosen a default
+	defaultRunVisibility = VisibilityFollowers
+	// Chunk size for id lists passed to In() filters
+	visibilityLookupChunk = 100
+)
+
+// Viewer is whoever is asking for runs. Every endpoint that returns other
+// people's runs or efforts goes through canViewRun with one of these.
+type Viewer struct {
+	ID         string
+	Role       string
+	University string
+	following  map[string]bool
+}
+
+// runAudience is the part of a run that decides who can see it and
+// where it counts
+type runAudience struct {
+	ID           string `json:"id"`
+	UserID       string `json:"user_id"`
+	Visibility   string `json:"visibility"`
+	ReviewStatus string `json:"review_status"`
+	Provenance   string `json:"provenance"`
+	ActivityType string `json:"activity_type"`
+}
+
+// Helper function to resolve the visibility of a new run: the requested
+// level, else the owner's default
+func runVisibility(requested *string, profile *Profile) string {
+	if requested != nil && *requested != "" {
+		return *requested
+	}
+	if profile != nil && profile.DefaultRunVisibility != nil {
+		return *profile.DefaultRunVisibility
+	}
+	return defaultRunVisibility
+}
+
+func validVisibility(value string) bool {
+	switch value {
+	case VisibilityPrivate, VisibilityFollowers, VisibilityUniversity, VisibilityPublic:
+		return true
+	}
+	return false
+}
+
+// Helper function to build the viewer for the authenticated request
+func (s *Server) currentViewer(c *gin.Context) (*Viewer, error) {
+	viewer := &Viewer{
+		ID:   c.GetString("user_id"),
+		Role: c.GetString("user_role"),
+	}
+	// A self-declared university doesn't count until an admin verifies it
+	if profile := currentProfile(c); profile != nil && profile.UniversityVerifiedAt != nil {
+		viewer.University = profile.University
+	}
+
+	following, err := s.getFollowing(viewer.ID)
+	if err != nil {
+		return nil, err
+	}
+	viewer.following = make(map[string]bool, len(following))
+	for _, id := range following {
+		viewer.following[id] = true
+	}
+	return viewer, nil
+}
+
+// canView applies the visibility rules. Runs stored before visibility
+// existed were only ever shown to their owner and stay private.
+func (v *Viewer) canView(ownerID, ownerUniversity, visibility string) bool {
+	if ownerID == v.ID || v.Role == "admin" {
+		return true
+	}
+	switch visibility {
+	case VisibilityPublic:
+		return true
+	case VisibilityUniversity:
+		return ownerUniversity != "" && ownerUniversity == v.University
+	case VisibilityFollowers:
+		return v.following[ownerID]
+	default:
+		return false
+	}
+}
+
+// canViewRun checks a single run, looking up the owner's university only
+// when the rule needs it
+func (s *Server) canViewRun(viewer *Viewer, ownerID, visibility string) (bool, error) {
+	university := ""
+	if visibility == VisibilityUniversity && ownerID != viewer.ID {
+		owner, err := s.getUserProfile(ownerID)
+		if err != nil {
+			return false, err
+		}
+		university = owner.University
+	}
+	return viewer.canView(ownerID, university, visibility), nil
+}
+
+// visibleRunIDs filters a batch of runs down to the ones the viewer may
+// see, with one university lookup for the whole batch
+func (s *Server) visibleRunIDs(viewer *Viewer, runs []runAudience) (map[string]bool, error) {
+	var owners []string
+	seen := make(map[string]bool)
+	for _, run := range runs {
+		if run.Visibility == VisibilityUniversity && run.UserID != viewer.ID && !seen[run.UserID] {
+			seen[run.UserID] = true
+			owners = append(owners, run.UserID)
+		}
+	}
+
+	universities, err := s.getUniversities(owners)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make(map[string]bool, len(runs))
+	for _, run := range runs {
+		if viewer.canView(run.UserID, universities[run.UserID], run.Visibility) {
+			visible[run.ID] = true
+		}
+	}
+	return visible, nil
+}
+
+// Helper function to look up the audience of runs by ID, e.g. for
+// segment efforts
+func (s *Server) getRunAudiences(runIDs []string) ([]runAudience, error) {
+	var audiences []runAudience
+	for start := 0; start < len(runIDs); start += visibilityLookupChunk {
+		end := start + visibilityLookupChunk
+		if end > len(runIDs) {
+			end = len(runIDs)
+		}
+
+		result, _, err := s.supabase.From("runs").
+			Select("id, user_id, visibility, review_status, provenance, activity_type", "", false).
+			In("id", runIDs[start:end]).
+			Execute()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var page []runAudience
+		if err := json.Unmarshal(result, &page); err != nil {
+			return nil, err
+		}
+		audiences = append(audiences, page...)
+	}
+	return audiences, nil
+}
+
+func (s *Server) getUniversities(userIDs []string) (map[string]string, error) {
+	universities := make(map[string]string, len(userIDs))
+	for start := 0; start < len(userIDs); start += visibilityLookupChunk {
+		end := start + visibilityLookupChunk
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		result, _, err := s.supabase.From("profiles").
+			Select("id, university", "", false).
+			In("id", userIDs[start:end]).
+			Execute()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var rows []struct {
+			ID         string `json:"id"`
+			University string `json:"university"`
+		}
+		if err := json.Unmarshal(result, &rows); err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			universities[row.ID] = row.University
+		}
+	}
+	return universities, nil
+}
+
+func (s *Server) getRunByID(runID string) (*Run, error) {
+	var run Run
+
+	result, _, err := s.supabase.From("runs").
+		Select("*", "", false).
+		Eq("id", runID).
+		Single().
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(result, &run); err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// getVisibleRun loads a run for the viewer; runs they may not see are
+// reported as not found so their existence isn't revealed.
+func (s *Server) getVisibleRun(viewer *Viewer, runID string) (*Run, error) {
+	run, err := s.getRunByID(runID)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := s.canViewRun(viewer, run.UserID, run.Visibility)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("run %s is not visible", runID)
+	}
+	return run, nil
+}
+
+// visibilityFilter is canView as a PostgREST or-filter over runs of the
+// given owners, so the database pages and counts only what the viewer may
+// see. Empty means no restriction.
+func (s *Server) visibilityFilter(viewer *Viewer, owners []string) (string, error) {
+	if viewer.Role == "admin" {
+		return "", nil
+	}
+
+	var followed, others []string
+	for _, owner := range owners {
+		if owner == viewer.ID {
+			continue
+		}
+		others = append(others, owner)
+		if viewer.following[owner] {
+			followed = append(followed, owner)
+		}
+	}
+
+	var classmates []string
+	if viewer.University != "" && len(others) > 0 {
+		universities, err := s.getUniversities(others)
+		if err != nil {
+			return "", err
+		}
+		for _, owner := range others {
+			if universities[owner] == viewer.University {
+				classmates = append(classmates, owner)
+			}
+		}
+	}
+
+	clauses := []string{"visibility.eq." + VisibilityPublic}
+	if viewer.ID != "" {
+		clauses = append(clauses, "user_id.eq."+viewer.ID)
+	}
+	if len(followed) > 0 {
+		clauses = append(clauses, "and(visibility.eq."+VisibilityFollowers+",user_id.in.("+strings.Join(followed, ",")+"))")
+	}
+	if len(classmates) > 0 {
+		clauses = append(clauses, "and(visibility.eq."+VisibilityUniversity+",user_id.in.("+strings.Join(classmates, ",")+"))")
+	}
+	return strings.Join(clauses, ","), nil
+}
+
+// Helper function to page through runs of the given owners that the viewer
+// may see, newest first, with other people's routes redacted
+func (s *Server) getVisibleRuns(viewer *Viewer, owners []string, offset, limit int) ([]Run, int, error) {
+	filter, err := s.visibilityFilter(viewer, owners)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := s.supabase.From("runs").
+		Select("*", "exact", false).
+		In("user_id", owners)
+
+	if filter != "" {
+		query = query.Or(filter, "")
+	}
+
+	result, count, err := query.
+		Order("started_at", &map[string]interface{}{"ascending": false}).
+		Range(offset, offset+limit-1, "", false).
+		Execute()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var runs []Run
+	if err := json.Unmarshal(result, &runs); err != nil {
+		return nil, 0, err
+	}
+
+	for i := range runs {
+		if err := s.redactRun(&runs[i], viewer.ID); err != nil {
+			return nil, 0, err
+		}
+	}
+	return runs, int(count), nil
+}
+
+func (s *Server) getFollowing(userID string) ([]string, error) {
+	result, _, err := s.supabase.From("follows").
+		Select("followee_id", "", false).
+		Eq("follower_id", userID).
+		Execute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		FolloweeID string `json:"followee_id"`
+	}
+	if err := json.Unmarshal(result, &rows); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = row.FolloweeID
+	}
+	return ids, nil
+}
+
+// Follows
+func (s *Server) followUser(c *gin.Context) {
+	userID := c.GetString("user_id")
+	followeeID := c.Param("id")
+
+	if followeeID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot follow yourself"})
+		return
+	}
+	if _, err := s.getUserProfile(followeeID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	_, _, err := s.supabase.From("follows").
+		Insert(map[string]interface{}{
+			"follower_id": userID,
+			"followee_id": followeeID,
+			"created_at":  time.Now().UTC(),
+		}, true, "follower_id,followee_id", "", "").
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to follow user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Following user"})
+}
+
+func (s *Server) unfollowUser(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	_, _, err := s.supabase.From("follows").
+		Delete("", "").
+		Eq("follower_id", userID).
+		Eq("followee_id", c.Param("id")).
+		Execute()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unfollow user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Unfollowed user"})
+}
+
+// Activity feed: the viewer's own runs and those of people they follow
+func (s *Server) getFeed(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	offset := (page - 1) * limit
+
+	viewer, err := s.currentViewer(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch feed"})
+		return
+	}
+
+	owners := []string{viewer.ID}
+	for id := range viewer.following {
+		owners = append(owners, id)
+	}
+
+	runs, count, err := s.getVisibleRuns(viewer, owners, offset, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch feed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"runs": runs,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": count,
+			"pages": (count + limit - 1) / limit,
+		},
+	})
+}
+
+// Runs on a user's profile that the viewer may see
+func (s *Server) getProfileRuns(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	offset := (page - 1) * limit
+
+	viewer, err := s.currentViewer(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch runs"})
+		return
+	}
+
+	runs, count, err := s.getVisibleRuns(viewer, []string{c.Param("id")}, offset, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch runs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"runs":      runs,
+		"following": viewer.following[c.Param("id")],
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": count,
+			"pages": (count + limit - 1) / limit,
+		},
+	})
+}